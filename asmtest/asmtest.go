@@ -0,0 +1,393 @@
+// Package asmtest runs the tests in assembly test files. A test file is named *_test.asm and each of its labels
+// starting with test_ is a routine that is called in a fresh VM. Tests use the routines in the <test> system include
+// to make assertions, and can run the program for a number of clock ticks and check the midi messages it sends.
+package asmtest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/instructions"
+	"github.com/andrewesterhuizen/penpal/midi"
+	"github.com/andrewesterhuizen/penpal/penpal"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// DefaultBudget is the number of instructions a test routine can execute before it fails when no budget is configured
+const DefaultBudget = 1000000
+
+// Config configures how tests are run
+type Config struct {
+	// Verbose reports each test as it runs and passes rather than only failures, like go test -v
+	Verbose bool
+	// Run selects the tests to run by name, all tests are run if it is nil
+	Run *regexp.Regexp
+	// Budget is the number of instructions a test routine can execute before it fails, DefaultBudget is used if it is 0
+	Budget int
+	// ClockSpeed is the clock speed of the runtime, penpal.DefaultClockSpeed is used if it is 0
+	ClockSpeed int
+	// Seed seeds the random number generator of each test's VM so that tests are repeatable
+	Seed int64
+}
+
+// Result is the outcome of a test, Failure is empty if it passed
+type Result struct {
+	Name    string
+	Failure string
+	Elapsed time.Duration
+}
+
+// Discover returns the test files matched by patterns, which are used like the packages given to go test:
+// a file, a directory, or a directory followed by /... for the directory and all of its subdirectories
+func Discover(patterns []string) ([]string, error) {
+	files := []string{}
+	seen := map[string]bool{}
+
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+
+	for _, pattern := range patterns {
+		if dir := strings.TrimSuffix(pattern, "..."); dir != pattern {
+			if dir == "" {
+				dir = "."
+			}
+
+			err := filepath.Walk(filepath.Clean(dir), func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if !info.IsDir() && strings.HasSuffix(path, "_test.asm") {
+					add(path)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		info, err := os.Stat(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			add(filepath.Clean(pattern))
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(pattern, "*_test.asm"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches {
+			add(m)
+		}
+	}
+
+	return files, nil
+}
+
+// assertionError is returned by the <test> syscalls when an assertion fails
+type assertionError struct {
+	message string
+}
+
+func (e *assertionError) Error() string {
+	return e.message
+}
+
+// testFile is an assembled test file
+type testFile struct {
+	filename string
+	program  []byte
+	info     assembler.ProgramInfo
+	config   Config
+}
+
+// testState is the expectations recorded by a test through the <test> syscalls
+type testState struct {
+	expected []midi.MidiMessage
+	ticks    int
+}
+
+func assemble(filename string) (*testFile, error) {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	systemIncludes, err := penpal.GetSystemIncludes()
+	if err != nil {
+		return nil, err
+	}
+
+	systemIncludes["test"] = testInclude
+
+	a := assembler.New(assembler.Config{
+		SystemIncludes: systemIncludes,
+		InteruptLabels: penpal.InteruptLabels,
+		OptionalStart:  true,
+	})
+
+	program, err := a.GetProgram(filename, string(source))
+	if err != nil {
+		return nil, err
+	}
+
+	return &testFile{filename: filename, program: program, info: a.Info()}, nil
+}
+
+// tests returns the names of the test routines in address order
+func (f *testFile) tests() []string {
+	names := []string{}
+
+	for label := range f.info.Labels {
+		if !strings.HasPrefix(label, "test_") {
+			continue
+		}
+
+		if f.config.Run != nil && !f.config.Run.MatchString(label) {
+			continue
+		}
+
+		names = append(names, label)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		a, b := f.info.Labels[names[i]], f.info.Labels[names[j]]
+		if a != b {
+			return a < b
+		}
+
+		return names[i] < names[j]
+	})
+
+	return names
+}
+
+// location returns the file and line of the first of addrs that is in the test file,
+// or the first address as a label and offset if none are
+func (f *testFile) location(addrs ...uint16) string {
+	for _, addr := range addrs {
+		if l, ok := f.info.LineAt(addr); ok && l.File == f.filename {
+			return fmt.Sprintf("%s:%d", filepath.Base(l.File), l.Line)
+		}
+	}
+
+	return f.info.Symbolize(addrs[0])
+}
+
+// failure describes an error returned while running a test with the location in the test file that led to it
+func (f *testFile) failure(err error, v *vm.VM) string {
+	var fault *vm.Fault
+	if !errors.As(err, &fault) {
+		return fmt.Sprintf("%s: %s", f.location(v.IP()), err)
+	}
+
+	// return addresses are after the call instruction, so the address before is in the call
+	addrs := []uint16{fault.IP}
+	for _, addr := range fault.CallChain {
+		addrs = append(addrs, addr-1)
+	}
+
+	// assertions are reported without the syscall that raised them
+	var assertion *assertionError
+	if errors.As(err, &assertion) {
+		return fmt.Sprintf("%s: %s", f.location(addrs...), assertion)
+	}
+
+	return fmt.Sprintf("%s: %s", f.location(addrs...), fault.Err)
+}
+
+func formatMessages(messages []midi.MidiMessage) string {
+	if len(messages) == 0 {
+		return "        (none)\n"
+	}
+
+	b := strings.Builder{}
+	for _, m := range messages {
+		fmt.Fprintf(&b, "        0x%02x 0x%02x 0x%02x\n", m[0], m[1], m[2])
+	}
+
+	return b.String()
+}
+
+func equalMessages(a []midi.MidiMessage, b []midi.MidiMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// run runs a test in a fresh VM and returns a description of its failure, or an empty string if it passed
+func (f *testFile) run(name string) string {
+	v := vm.New()
+	v.Seed(f.config.Seed)
+
+	err := v.SetStack(vm.DefaultStackTop, f.info.StackSize)
+	if err != nil {
+		return err.Error()
+	}
+
+	v.Load(f.program)
+
+	h := &midi.RecordingMidiHandler{}
+	r := penpal.NewRuntime(penpal.RuntimeConfig{ClockSpeed: f.config.ClockSpeed}, v, h)
+
+	state := testState{}
+
+	v.RegisterSyscall(SyscallAssertEq, func(v *vm.VM) error {
+		a, _ := v.GetRegister(instructions.RegisterA)
+		b, _ := v.GetRegister(instructions.RegisterB)
+
+		if a != b {
+			return &assertionError{fmt.Sprintf("assert_eq failed: A is 0x%02x (%d), B is 0x%02x (%d)", a, a, b, b)}
+		}
+
+		return nil
+	})
+
+	v.RegisterSyscall(SyscallExpectMidi, func(v *vm.VM) error {
+		status := v.Pop()
+		data1 := v.Pop()
+		data2 := v.Pop()
+
+		state.expected = append(state.expected, midi.MidiMessage{status, data1, data2})
+		return nil
+	})
+
+	v.RegisterSyscall(SyscallRunTicks, func(v *vm.VM) error {
+		a, _ := v.GetRegister(instructions.RegisterA)
+		state.ticks = int(a)
+		return nil
+	})
+
+	addr := f.info.Labels[name]
+
+	budget := f.config.Budget
+	if budget <= 0 {
+		budget = DefaultBudget
+	}
+
+	err = v.Call(addr, budget)
+	if err != nil {
+		return f.failure(err, v)
+	}
+
+	if state.ticks > 0 {
+		err = r.RunTicks(state.ticks)
+		if err != nil {
+			return f.failure(err, v)
+		}
+	}
+
+	if (len(state.expected) > 0 || state.ticks > 0) && !equalMessages(state.expected, h.Messages) {
+		got := strings.TrimSuffix(formatMessages(h.Messages), "\n")
+
+		return fmt.Sprintf("%s: expected midi messages after %d ticks:\n%s    got:\n%s",
+			f.location(addr), state.ticks, formatMessages(state.expected), got)
+	}
+
+	return ""
+}
+
+// RunFile assembles a test file and runs each of its tests
+func RunFile(filename string, config Config) ([]Result, error) {
+	f, err := assemble(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	f.config = config
+	results := []Result{}
+
+	for _, name := range f.tests() {
+		start := time.Now()
+		failure := f.run(name)
+
+		results = append(results, Result{Name: name, Failure: failure, Elapsed: time.Since(start)})
+	}
+
+	return results, nil
+}
+
+// Run runs the tests in the files matched by patterns and writes the results to w in the format of go test.
+// It returns true if all of the tests passed.
+func Run(w io.Writer, patterns []string, config Config) (bool, error) {
+	files, err := Discover(patterns)
+	if err != nil {
+		return false, err
+	}
+
+	passed := true
+
+	for _, filename := range files {
+		start := time.Now()
+
+		results, err := RunFile(filename, config)
+		if err != nil {
+			fmt.Fprintf(w, "# %s\n%s\n", filename, err)
+			fmt.Fprintf(w, "FAIL\t%s [build failed]\n", filename)
+			passed = false
+			continue
+		}
+
+		if len(results) == 0 {
+			fmt.Fprintf(w, "?   \t%s\t[no tests]\n", filename)
+			continue
+		}
+
+		filePassed := true
+
+		for _, result := range results {
+			if config.Verbose {
+				fmt.Fprintf(w, "=== RUN   %s\n", result.Name)
+			}
+
+			if result.Failure != "" {
+				filePassed = false
+				fmt.Fprintf(w, "--- FAIL: %s (%.2fs)\n    %s\n", result.Name, result.Elapsed.Seconds(), result.Failure)
+			} else if config.Verbose {
+				fmt.Fprintf(w, "--- PASS: %s (%.2fs)\n", result.Name, result.Elapsed.Seconds())
+			}
+		}
+
+		elapsed := time.Since(start).Seconds()
+
+		if filePassed {
+			fmt.Fprintf(w, "ok  \t%s\t%.3fs\n", filename, elapsed)
+		} else {
+			fmt.Fprintf(w, "FAIL\t%s\t%.3fs\n", filename, elapsed)
+			passed = false
+		}
+	}
+
+	return passed, nil
+}
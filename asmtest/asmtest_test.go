@@ -0,0 +1,200 @@
+package asmtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testProgram = `#include <midi>
+#include <test>
+
+count: db 0
+
+start:
+loop:
+	wait
+	jump loop
+
+on_tick:
+	push 0
+	push 0
+	push 0xf8
+	push 3
+	call midi_send_message
+	reti
+
+test_passes:
+	mov A, 2
+	mov B, 2
+	push 0
+	call assert_eq
+	ret
+
+test_fails:
+	mov A, 2
+	mov B, 3
+	push 0
+	call assert_eq
+	ret
+
+test_sends_clock:
+	push 0
+	push 0
+	push 0xf8
+	push 3
+	call expect_midi
+
+	push 0
+	push 0
+	push 0xf8
+	push 3
+	call expect_midi
+
+	mov A, 2
+	push 0
+	call run_ticks
+	ret
+
+test_expects_too_many_ticks:
+	push 0
+	push 0
+	push 0xf8
+	push 3
+	call expect_midi
+
+	mov A, 2
+	push 0
+	call run_ticks
+	ret
+
+test_never_returns:
+	jump test_never_returns
+`
+
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "asmtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, source := range files {
+		path := filepath.Join(dir, name)
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(path, []byte(source), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestDiscover(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a_test.asm":     "",
+		"a.asm":          "",
+		"sub/b_test.asm": "",
+	})
+
+	files, err := Discover([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0] != filepath.Join(dir, "a_test.asm") {
+		t.Errorf("expected only the test file in the directory, got %v", files)
+	}
+
+	files, err = Discover([]string{dir + "/...", filepath.Join(dir, "a_test.asm")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 || files[1] != filepath.Join(dir, "sub", "b_test.asm") {
+		t.Errorf("expected the test files in the directory and its subdirectories once, got %v", files)
+	}
+}
+
+func TestRunFile(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"program_test.asm": testProgram})
+
+	results, err := RunFile(filepath.Join(dir, "program_test.asm"), Config{Budget: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name    string
+		failure string
+	}{
+		{"test_passes", ""},
+		{"test_fails", "program_test.asm:30: assert_eq failed: A is 0x02 (2), B is 0x03 (3)"},
+		{"test_sends_clock", ""},
+		{"test_expects_too_many_ticks", "program_test.asm:52: expected midi messages after 2 ticks:"},
+		{"test_never_returns", "program_test.asm:64: subroutine did not return within 1000 instructions"},
+	}
+
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results and got %d: %v", len(expected), len(results), results)
+	}
+
+	for i, e := range expected {
+		r := results[i]
+
+		if r.Name != e.name {
+			t.Errorf("expected test %d to be %s and got %s", i, e.name, r.Name)
+		}
+
+		if e.failure == "" && r.Failure != "" || !strings.HasPrefix(r.Failure, e.failure) {
+			t.Errorf("expected %s to fail with %q, got %q", e.name, e.failure, r.Failure)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"program_test.asm": testProgram,
+		"empty_test.asm":   "#include <midi>\nstart:\n\thalt\n",
+		"broken_test.asm":  "mov Z, 1\n",
+	})
+
+	out := bytes.Buffer{}
+
+	passed, err := Run(&out, []string{dir}, Config{Verbose: true, Run: regexp.MustCompile("passes|clock")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if passed {
+		t.Error("expected the broken file to fail")
+	}
+
+	for _, line := range []string{
+		"FAIL\t" + filepath.Join(dir, "broken_test.asm") + " [build failed]",
+		"?   \t" + filepath.Join(dir, "empty_test.asm") + "\t[no tests]",
+		"=== RUN   test_passes",
+		"--- PASS: test_passes",
+		"--- PASS: test_sends_clock",
+		"ok  \t" + filepath.Join(dir, "program_test.asm"),
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in output:\n%s", line, out.String())
+		}
+	}
+
+	if strings.Contains(out.String(), "test_fails") {
+		t.Errorf("expected tests not matching -run to be skipped:\n%s", out.String())
+	}
+}
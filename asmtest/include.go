@@ -0,0 +1,37 @@
+package asmtest
+
+// system calls registered for tests, they use numbers from the range left free for embedders by the runtime
+const (
+	// SyscallAssertEq fails the test if A is not equal to B
+	SyscallAssertEq = 0x80
+	// SyscallExpectMidi pops status, data1 and data2 from the stack and adds them to the midi messages the test expects
+	SyscallExpectMidi = 0x81
+	// SyscallRunTicks runs the program from start for A clock ticks once the test returns
+	SyscallRunTicks = 0x82
+)
+
+// testInclude is the source of the <test> system include, which is available to test files
+var testInclude = `
+// fails the test if A is not equal to B
+assert_eq:
+	sys 0x80
+	ret
+
+// adds a message to the midi messages the program is expected to send during the test
+// args: (status, data1, data2)
+expect_midi:
+	load (fp+9), A
+	push
+	load (fp+8), A
+	push
+	load (fp+7), A
+	push
+	sys 0x81
+	ret
+
+// runs the program from start for A clock ticks once the test returns, the midi messages
+// sent during the test are then checked against the expected messages
+run_ticks:
+	sys 0x82
+	ret
+`
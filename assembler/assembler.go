@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 )
 
 type fileGetterFunc func(path string) (string, error)
@@ -22,6 +24,9 @@ type Config struct {
 	fileGetterFunc          fileGetterFunc
 	SystemIncludes          map[string]string
 	InteruptLabels          [3]string
+	// OptionalStart assembles programs without a start label, the entry point halts instead.
+	// This is for programs that are only called into, such as tests.
+	OptionalStart bool
 }
 
 type Assembler struct {
@@ -29,6 +34,70 @@ type Assembler struct {
 	getFile              fileGetterFunc
 	systemIncludeSources map[string]string
 	lexer                lexer
+	info                 ProgramInfo
+}
+
+// ProgramInfo describes the program assembled by the last call to GetProgram
+type ProgramInfo struct {
+	// StackSize is the size of the stack declared with the .stack directive, it's 0 if it wasn't declared
+	StackSize uint16
+	// Labels is the address of each label in the program
+	Labels map[string]uint16
+	// Sections is the kind of each range of the program's bytes in address order
+	Sections []Section
+	// Lines is the source line of each instruction in address order, the entry point table has no lines
+	Lines []SourceLine
+}
+
+// SourceLine is the source of the instruction assembled to the bytes from Start up to End
+type SourceLine struct {
+	Start       uint16
+	End         uint16
+	File        string
+	Line        int
+	Instruction byte
+}
+
+// LineAt returns the source line of the instruction that includes addr
+func (i ProgramInfo) LineAt(addr uint16) (SourceLine, bool) {
+	n := sort.Search(len(i.Lines), func(n int) bool { return i.Lines[n].End > addr })
+
+	if n < len(i.Lines) && i.Lines[n].Start <= addr {
+		return i.Lines[n], true
+	}
+
+	return SourceLine{}, false
+}
+
+// Label returns the closest label at or before addr and its address, ok is false if there is no label before addr
+func (i ProgramInfo) Label(addr uint16) (label string, labelAddr uint16, ok bool) {
+	for l, a := range i.Labels {
+		if a > addr {
+			continue
+		}
+
+		// labels at the same address are picked in alphabetical order so the output doesn't change between runs
+		if !ok || a > labelAddr || (a == labelAddr && l < label) {
+			label, labelAddr, ok = l, a, true
+		}
+	}
+
+	return label, labelAddr, ok
+}
+
+// Symbolize returns addr as an offset from the closest label at or before it, e.g. "loop+0x3"
+func (i ProgramInfo) Symbolize(addr uint16) string {
+	label, labelAddr, ok := i.Label(addr)
+
+	if !ok {
+		return fmt.Sprintf("0x%04x", addr)
+	}
+
+	if addr == labelAddr {
+		return label
+	}
+
+	return fmt.Sprintf("%s+0x%x", label, addr-labelAddr)
 }
 
 func New(config Config) Assembler {
@@ -55,7 +124,7 @@ func (a *Assembler) getIncludeTokens(filename string, tokens []token) ([]token,
 	for _, t := range tokens {
 		switch t.tokenType {
 		case tokenTypeFileInclude:
-			name := t.value
+			name := a.resolveInclude(filename, t.value)
 
 			// get file
 			f, err := a.getFile(name)
@@ -111,12 +180,39 @@ func (a *Assembler) getIncludeTokens(filename string, tokens []token) ([]token,
 	return out, nil
 }
 
-func (a *Assembler) getEntryPointTableTokens() ([]token, error) {
+// resolveInclude returns the path of a file included by filename, paths are relative to the including file
+// if it exists there and otherwise to the working directory
+func (a *Assembler) resolveInclude(filename string, name string) string {
+	if filename == "" || filepath.IsAbs(name) {
+		return name
+	}
+
+	relative := filepath.Join(filepath.Dir(filename), name)
+	if _, err := a.getFile(relative); err == nil {
+		return relative
+	}
+
+	return name
+}
+
+// getEntryPointTableTokens returns tokens for the jump table at the start of the program,
+// interupt labels that are not defined in the program are left empty
+func (a *Assembler) getEntryPointTableTokens(definedLabels map[string]bool) ([]token, error) {
 	buf := bytes.Buffer{}
-	buf.WriteString("jump start\n")
+
+	// the table is code even where an interupt isn't defined, so a store can't set a vector
+	buf.WriteString(".code\n")
+
+	if a.config.OptionalStart && !definedLabels["start"] {
+		buf.WriteString("halt\n")
+		buf.WriteString("db 0\n")
+		buf.WriteString("db 0\n")
+	} else {
+		buf.WriteString("jump start\n")
+	}
 
 	for _, label := range a.config.InteruptLabels {
-		if label != "" {
+		if label != "" && definedLabels[label] {
 			buf.WriteString(fmt.Sprintf("jump %s\n", label))
 		} else {
 			buf.WriteString("db 0\n")
@@ -125,24 +221,51 @@ func (a *Assembler) getEntryPointTableTokens() ([]token, error) {
 		}
 	}
 
+	buf.WriteString(".data\n")
+
 	return a.lexer.Run("", buf.String())
 }
 
-func (a *Assembler) GetProgram(filename string, source string) ([]uint8, error) {
-	// get tokens for entry point table
-	tokens := []token{}
+func getDefinedLabels(tokens []token) map[string]bool {
+	labels := map[string]bool{}
 
-	if !a.config.disableEntryPointsTable {
-		entryPointTableTokens, err := a.getEntryPointTableTokens()
-		if err != nil {
-			return nil, err
+	for _, t := range tokens {
+		if t.tokenType == tokenTypeLabel {
+			labels[t.value] = true
 		}
+	}
 
-		entryPointTableTokens = entryPointTableTokens[:len(entryPointTableTokens)-1]
+	return labels
+}
 
-		tokens = append(tokens, entryPointTableTokens...)
+// LabelRange returns the range of addresses from label up to the next label, or up to the end of
+// the program for the last label. The end of the range is exclusive.
+func (i ProgramInfo) LabelRange(label string) (uint16, uint16, bool) {
+	start, exists := i.Labels[label]
+	if !exists {
+		return 0, 0, false
 	}
 
+	end := start + 1
+	if n := len(i.Sections); n > 0 && i.Sections[n-1].End > end {
+		end = i.Sections[n-1].End
+	}
+
+	for _, addr := range i.Labels {
+		if addr > start && addr < end {
+			end = addr
+		}
+	}
+
+	return start, end, true
+}
+
+// Info returns information about the program assembled by the last call to GetProgram
+func (a *Assembler) Info() ProgramInfo {
+	return a.info
+}
+
+func (a *Assembler) GetProgram(filename string, source string) ([]uint8, error) {
 	// get tokens for entry point file
 	entryPointTokens, err := a.lexer.Run(filename, source)
 	if err != nil {
@@ -155,6 +278,20 @@ func (a *Assembler) GetProgram(filename string, source string) ([]uint8, error)
 		return nil, err
 	}
 
+	// get tokens for entry point table
+	tokens := []token{}
+
+	if !a.config.disableEntryPointsTable {
+		entryPointTableTokens, err := a.getEntryPointTableTokens(getDefinedLabels(combinedTokens))
+		if err != nil {
+			return nil, err
+		}
+
+		entryPointTableTokens = entryPointTableTokens[:len(entryPointTableTokens)-1]
+
+		tokens = append(tokens, entryPointTableTokens...)
+	}
+
 	tokens = append(tokens, combinedTokens...)
 
 	p := newParser()
@@ -163,5 +300,7 @@ func (a *Assembler) GetProgram(filename string, source string) ([]uint8, error)
 		return nil, err
 	}
 
+	a.info = ProgramInfo{StackSize: p.stackSize, Labels: p.labels, Sections: p.sections, Lines: p.lines}
+
 	return bin, nil
 }
@@ -3,6 +3,8 @@ package assembler
 import (
 	"fmt"
 	"testing"
+
+	"github.com/andrewesterhuizen/penpal/instructions"
 )
 
 type assemblerTestCase struct {
@@ -144,6 +146,39 @@ func TestAssembler_NoEntryPoint_ReturnsError(t *testing.T) {
 	}
 }
 
+func TestAssembler_OptionalStart_HaltsWithoutEntryPoint(t *testing.T) {
+	a := New(Config{OptionalStart: true})
+
+	program, err := a.GetProgram("", "swap\n")
+	if err != nil {
+		t.Fatalf("failed to get program due to error: %s", err)
+	}
+
+	if program[0] != instructions.Halt {
+		t.Errorf("expected the entry point to halt, got 0x%02x", program[0])
+	}
+}
+
+func TestAssembler_FileInclude_RelativeToIncludingFile(t *testing.T) {
+	a := New(Config{
+		disableEntryPointsTable: true,
+		fileGetterFunc: newMockFileGetterFunc(map[string]string{
+			"lib/a.asm": "#include \"b.asm\"\n",
+			"lib/b.asm": "db 1\n",
+			"c.asm":     "db 2\n",
+		}),
+	})
+
+	program, err := a.GetProgram("lib/main.asm", "start:\n#include \"a.asm\"\n#include \"c.asm\"\n")
+	if err != nil {
+		t.Fatalf("failed to get program due to error: %s", err)
+	}
+
+	if len(program) != 2 || program[0] != 1 || program[1] != 2 {
+		t.Errorf("expected the bytes of lib/b.asm and c.asm, got %v", program)
+	}
+}
+
 func TestAssembler_MissingSystemInclude_ReturnsError(t *testing.T) {
 	a := New(Config{})
 
@@ -169,3 +204,269 @@ func TestAssembler_UndefinedLabel_ReturnsError(t *testing.T) {
 		t.Errorf("expected assembler to return error for undefined label")
 	}
 }
+
+func TestAssembler_CallWithoutOperand_ReturnsError(t *testing.T) {
+	a := New(Config{})
+
+	source := `start:
+	call
+	`
+
+	_, err := a.GetProgram("", source)
+
+	if err == nil {
+		t.Errorf("expected assembler to return error for call without an operand")
+	}
+}
+
+func TestAssembler_PointerOffsetOutOfRange_ReturnsError(t *testing.T) {
+	for _, offset := range []string{"+128", "+200", "-129", "-200"} {
+		a := New(Config{})
+
+		source := fmt.Sprintf(`start:
+		load ((0x1234)%s), A
+		`, offset)
+
+		_, err := a.GetProgram("", source)
+
+		if err == nil {
+			t.Errorf("expected assembler to return error for pointer offset %s", offset)
+		}
+	}
+}
+
+func TestAssembler_InteruptTable_SkipsUndefinedLabels(t *testing.T) {
+	a := New(Config{InteruptLabels: [3]string{"on_tick", "on_start", "on_stop"}})
+
+	source := `start:
+	halt
+	on_stop:
+	reti
+	`
+
+	program, err := a.GetProgram("", source)
+	if err != nil {
+		t.Fatalf("failed to get program due to error: %s", err)
+	}
+
+	expected := []uint8{
+		instructions.Jump, 0x00, 0x0c,
+		0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00,
+		instructions.Jump, 0x00, 0x0d,
+		instructions.Halt,
+		instructions.Reti,
+	}
+
+	if len(program) != len(expected) {
+		t.Fatalf("expected %d bytes and got %d", len(expected), len(program))
+	}
+
+	for i, b := range expected {
+		if program[i] != b {
+			t.Errorf("expected 0x%02x and got 0x%02x at pos %d", b, program[i], i)
+		}
+	}
+}
+
+func TestAssembler_StackDirective(t *testing.T) {
+	a := New(Config{})
+
+	source := `.stack 0x100
+
+	start:
+	halt
+	`
+
+	program, err := a.GetProgram("", source)
+	if err != nil {
+		t.Fatalf("failed to get program due to error: %s", err)
+	}
+
+	// the directive doesn't emit any bytes
+	if len(program) != 13 {
+		t.Errorf("expected 13 bytes and got %d", len(program))
+	}
+
+	if a.Info().StackSize != 0x100 {
+		t.Errorf("expected stack size 0x100 and got 0x%x", a.Info().StackSize)
+	}
+}
+
+func TestAssembler_StackDirective_ReturnsErrorIfDeclaredTwice(t *testing.T) {
+	a := New(Config{})
+
+	source := `.stack 16
+	.stack 32
+	start:
+	halt
+	`
+
+	_, err := a.GetProgram("", source)
+	if err == nil {
+		t.Errorf("expected assembler to return error for second stack directive")
+	}
+}
+
+func TestProgramInfo_Symbolize(t *testing.T) {
+	info := ProgramInfo{Labels: map[string]uint16{"start": 0x0c, "loop": 0x0c, "sub": 0x20}}
+
+	testCases := map[uint16]string{
+		0x0003: "0x0003",
+		0x000c: "loop",
+		0x000f: "loop+0x3",
+		0x0020: "sub",
+		0x0031: "sub+0x11",
+	}
+
+	for addr, expected := range testCases {
+		if s := info.Symbolize(addr); s != expected {
+			t.Errorf("expected 0x%04x to be %s and got %s", addr, expected, s)
+		}
+	}
+}
+
+func TestAssembler_Sections(t *testing.T) {
+	a := New(Config{InteruptLabels: [3]string{"on_tick", "on_start", "on_stop"}})
+
+	source := `counter: db 0
+	.rodata
+	table:
+	db 1
+	db 2
+	.io
+	register: db 0
+	.data
+	start:
+	halt
+	db 3
+	`
+
+	_, err := a.GetProgram("", source)
+	if err != nil {
+		t.Fatalf("failed to get program due to error: %s", err)
+	}
+
+	expected := []Section{
+		{Kind: SectionCode, Start: 0x00, End: 0x0c},
+		{Kind: SectionData, Start: 0x0c, End: 0x0d},
+		{Kind: SectionROData, Start: 0x0d, End: 0x0f},
+		{Kind: SectionIO, Start: 0x0f, End: 0x10},
+		{Kind: SectionCode, Start: 0x10, End: 0x11},
+		{Kind: SectionData, Start: 0x11, End: 0x12},
+	}
+
+	sections := a.Info().Sections
+
+	if len(sections) != len(expected) {
+		t.Fatalf("expected %d sections and got %d: %v", len(expected), len(sections), sections)
+	}
+
+	for i, s := range expected {
+		if sections[i] != s {
+			t.Errorf("expected section %v and got %v", s, sections[i])
+		}
+	}
+}
+
+func TestAssembler_UnknownDirective_ReturnsError(t *testing.T) {
+	a := New(Config{})
+
+	source := `.bss
+	start:
+	halt
+	`
+
+	_, err := a.GetProgram("", source)
+	if err == nil {
+		t.Errorf("expected assembler to return error for unknown directive")
+	}
+}
+
+func TestProgramInfo_LabelRange(t *testing.T) {
+	a := New(Config{})
+
+	source := `i: db 0
+	notes:
+	db 1
+	db 2
+	db 3
+	start:
+	halt
+	`
+
+	_, err := a.GetProgram("", source)
+	if err != nil {
+		t.Fatalf("failed to get program due to error: %s", err)
+	}
+
+	testCases := []struct {
+		label string
+		start uint16
+		end   uint16
+	}{
+		{"i", 0x0c, 0x0d},
+		{"notes", 0x0d, 0x10},
+		{"start", 0x10, 0x11},
+	}
+
+	for _, tc := range testCases {
+		start, end, ok := a.Info().LabelRange(tc.label)
+		if !ok {
+			t.Errorf("expected label %s to exist", tc.label)
+			continue
+		}
+
+		if start != tc.start || end != tc.end {
+			t.Errorf("expected %s to be 0x%02x-0x%02x and got 0x%02x-0x%02x", tc.label, tc.start, tc.end, start, end)
+		}
+	}
+
+	if _, _, ok := a.Info().LabelRange("missing"); ok {
+		t.Error("expected missing label not to exist")
+	}
+}
+
+func TestAssembler_Lines(t *testing.T) {
+	a := New(Config{InteruptLabels: [3]string{"on_tick", "on_start", "on_stop"}})
+
+	source := `count: db 0
+start:
+	mov A, 1
+
+	jumpz start
+	halt
+`
+
+	_, err := a.GetProgram("test.asm", source)
+	if err != nil {
+		t.Fatalf("failed to get program due to error: %s", err)
+	}
+
+	expected := []SourceLine{
+		{Start: 0x0c, End: 0x0d, File: "test.asm", Line: 1, Instruction: instructions.Db},
+		{Start: 0x0d, End: 0x10, File: "test.asm", Line: 3, Instruction: instructions.Mov},
+		{Start: 0x10, End: 0x13, File: "test.asm", Line: 5, Instruction: instructions.Jumpz},
+		{Start: 0x13, End: 0x14, File: "test.asm", Line: 6, Instruction: instructions.Halt},
+	}
+
+	info := a.Info()
+
+	if len(info.Lines) != len(expected) {
+		t.Fatalf("expected %d lines and got %d: %v", len(expected), len(info.Lines), info.Lines)
+	}
+
+	for i, l := range expected {
+		if info.Lines[i] != l {
+			t.Errorf("expected line %v and got %v", l, info.Lines[i])
+		}
+	}
+
+	if l, ok := info.LineAt(0x11); !ok || l.Line != 5 {
+		t.Errorf("expected 0x0011 to be in line 5, got %v", l)
+	}
+
+	if _, ok := info.LineAt(0x03); ok {
+		t.Error("expected the entry point table to have no line")
+	}
+}
@@ -0,0 +1,103 @@
+package assembler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchmarkSizes is the number of generated blocks in each benchmark source, each block assembles to 34 bytes
+var benchmarkSizes = []int{100, 1000}
+
+// generateSource returns a program with n blocks of data and subroutines that call each other,
+// it uses labels, comments, every addressing mode the parser supports and most instructions
+func generateSource(n int) string {
+	var sb strings.Builder
+
+	sb.WriteString("start:\n")
+	sb.WriteString("    push 0\n")
+	sb.WriteString(fmt.Sprintf("    call func_%d\n", n-1))
+	sb.WriteString("    halt\n\n")
+
+	for i := 0; i < n; i++ {
+		callee := i - 1
+		if callee < 0 {
+			callee = 0
+		}
+
+		fmt.Fprintf(&sb, "var_%d: db 0x%02x\n\n", i, i&0xff)
+		fmt.Fprintf(&sb, "func_%d:\n", i)
+		fmt.Fprintf(&sb, "    // increment var_%d\n", i)
+		fmt.Fprintf(&sb, "    load var_%d, A\n", i)
+		sb.WriteString("    mov B, 1\n")
+		sb.WriteString("    add\n")
+		fmt.Fprintf(&sb, "    store A, var_%d\n", i)
+		fmt.Fprintf(&sb, "    load (var_%d[A]), B\n", i)
+		sb.WriteString("    push 0x10\n")
+		sb.WriteString("    pop\n")
+		fmt.Fprintf(&sb, "    jumpz func_%d_end\n", i)
+		fmt.Fprintf(&sb, "    call func_%d\n", callee)
+		fmt.Fprintf(&sb, "func_%d_end:\n", i)
+		sb.WriteString("    ret\n\n")
+	}
+
+	return sb.String()
+}
+
+func BenchmarkLexer_Run(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		source := generateSource(n)
+
+		b.Run(fmt.Sprintf("blocks=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(source)))
+			l := newLexer()
+
+			for i := 0; i < b.N; i++ {
+				_, err := l.Run("bench.asm", source)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParser_Run(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		source := generateSource(n)
+
+		tokens, err := newLexer().Run("bench.asm", source)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("blocks=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(source)))
+
+			for i := 0; i < b.N; i++ {
+				_, err := newParser().Run(tokens)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAssembler_GetProgram(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		source := generateSource(n)
+
+		b.Run(fmt.Sprintf("blocks=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(source)))
+			a := New(Config{InteruptLabels: [3]string{"on_tick", "on_start", "on_stop"}})
+
+			for i := 0; i < b.N; i++ {
+				_, err := a.GetProgram("bench.asm", source)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
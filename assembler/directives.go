@@ -0,0 +1,110 @@
+package assembler
+
+import "fmt"
+
+// SectionKind is the kind of memory a section of the program is loaded into
+type SectionKind uint8
+
+const (
+	// SectionData is writable data, db values are in the data section unless another section is declared
+	SectionData SectionKind = iota
+	// SectionCode is instructions, and values declared after a .code directive such as jump tables
+	SectionCode
+	// SectionROData is read only data declared after a .rodata directive
+	SectionROData
+	// SectionIO is memory mapped registers declared after a .io directive
+	SectionIO
+)
+
+func (k SectionKind) String() string {
+	switch k {
+	case SectionData:
+		return "data"
+	case SectionCode:
+		return "code"
+	case SectionROData:
+		return "rodata"
+	case SectionIO:
+		return "io"
+	default:
+		return "unknown"
+	}
+}
+
+// Section is a range of the program's bytes of the same kind, End is exclusive
+type Section struct {
+	Kind  SectionKind
+	Start uint16
+	End   uint16
+}
+
+var sectionDirectives = map[string]SectionKind{
+	"data":   SectionData,
+	"code":   SectionCode,
+	"rodata": SectionROData,
+	"io":     SectionIO,
+}
+
+// parseDirective parses a directive, directives start with a dot and don't emit any bytes.
+// Section directives set the section of the db values that follow them, instructions are always code.
+func (p *parser) parseDirective() error {
+	t, err := p.expect(tokenTypeText)
+	if err != nil {
+		return err
+	}
+
+	if kind, isSection := sectionDirectives[t.value]; isSection {
+		p.section = kind
+		p.skipIf(tokenTypeNewLine)
+		return nil
+	}
+
+	switch t.value {
+	case "stack":
+		return p.parseStackDirective()
+	default:
+		return fmt.Errorf("unknown directive .%s", t.value)
+	}
+}
+
+// addSection records that the bytes from start to the end of the program are of kind,
+// adjacent bytes of the same kind are merged into one section
+func (p *parser) addSection(start int, kind SectionKind) {
+	end := len(p.instructions)
+	if end == start {
+		return
+	}
+
+	if n := len(p.sections); n > 0 && p.sections[n-1].Kind == kind && int(p.sections[n-1].End) == start {
+		p.sections[n-1].End = uint16(end)
+		return
+	}
+
+	p.sections = append(p.sections, Section{Kind: kind, Start: uint16(start), End: uint16(end)})
+}
+
+// parseStackDirective parses ".stack n", which declares the size of the stack in bytes
+func (p *parser) parseStackDirective() error {
+	if p.stackSize > 0 {
+		return fmt.Errorf("stack size has already been declared")
+	}
+
+	t, err := p.expect(tokenTypeInteger)
+	if err != nil {
+		return err
+	}
+
+	n, err := parseIntegerToken(t)
+	if err != nil {
+		return err
+	}
+
+	if n == 0 || n > 0xffff {
+		return fmt.Errorf("stack size %d is out of range", n)
+	}
+
+	p.stackSize = uint16(n)
+
+	p.skipIf(tokenTypeNewLine)
+	return nil
+}
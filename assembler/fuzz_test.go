@@ -0,0 +1,38 @@
+package assembler
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzAssembler_GetProgram assembles arbitrary source, the assembler should return an error rather than panic
+func FuzzAssembler_GetProgram(f *testing.F) {
+	examples, err := filepath.Glob("../cmd/*.asm")
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, path := range examples {
+		source, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(string(source))
+	}
+
+	for _, source := range []string{"", "#", "#include", "#include \"", "#include <midi", "start:\n#include \"a.asm\"", ".", ".stack", "load (", "store A, (fp+", "load ((ptr)-A), B", "store A, (-("} {
+		f.Add(source)
+	}
+
+	f.Fuzz(func(t *testing.T, source string) {
+		a := New(Config{
+			fileGetterFunc: newMockFileGetterFunc(map[string]string{"a.asm": "db 1\n"}),
+			SystemIncludes: map[string]string{"midi": "midi_bpm: db 120\n"},
+			InteruptLabels: [3]string{"on_tick", "on_start", "on_stop"},
+		})
+
+		a.GetProgram("fuzz.asm", source)
+	})
+}
@@ -7,14 +7,12 @@ import (
 )
 
 func getRegister(r string) (byte, error) {
-	switch r {
-	case "A":
-		return instructions.RegisterA, nil
-	case "B":
-		return instructions.RegisterB, nil
-	default:
+	reg, exists := instructions.RegistersByName[r]
+	if !exists {
 		return 0, fmt.Errorf("expected register and got %s", r)
 	}
+
+	return reg, nil
 }
 
 func (p *parser) parseNoOperandInstruction(instruction byte) error {
@@ -23,6 +21,29 @@ func (p *parser) parseNoOperandInstruction(instruction byte) error {
 	return nil
 }
 
+func (p *parser) parseByteOperandInstruction(instruction byte) error {
+	p.addByte(instruction)
+
+	t, err := p.expect(tokenTypeInteger)
+	if err != nil {
+		return err
+	}
+
+	n, err := parseIntegerToken(t)
+	if err != nil {
+		return err
+	}
+
+	if n > 0xff {
+		return fmt.Errorf("operand 0x%x does not fit in a byte", n)
+	}
+
+	p.addByte(byte(n))
+
+	p.skipIf(tokenTypeNewLine)
+	return nil
+}
+
 func (p *parser) parseDB() error {
 	t, err := p.expect(tokenTypeInteger)
 	if err != nil {
@@ -40,6 +61,63 @@ func (p *parser) parseDB() error {
 	return nil
 }
 
+// parseDW parses a word of data, which is either an integer or the address of a label
+func (p *parser) parseDW() error {
+	t := p.nextToken()
+
+	var n uint16
+
+	switch t.tokenType {
+	case tokenTypeInteger:
+		i, err := parseIntegerToken(t)
+		if err != nil {
+			return err
+		}
+
+		if i > 0xffff {
+			return fmt.Errorf("operand 0x%x does not fit in a word", i)
+		}
+
+		n = uint16(i)
+
+	case tokenTypeText:
+		addr, err := p.getLabelAddress(t.value)
+		if err != nil {
+			return err
+		}
+
+		n = addr
+
+	default:
+		return fmt.Errorf("unexpected token %s", t.value)
+	}
+
+	p.addByte(byte(n >> 8))
+	p.addByte(byte(n))
+
+	p.skipIf(tokenTypeNewLine)
+	return nil
+}
+
+// parseJumpOrCall parses a jump or call to an address, through an address in memory or, for call (sp), to the address on the stack
+func (p *parser) parseJumpOrCall(instruction byte) error {
+	switch instruction {
+	case instructions.JumpIndirect, instructions.CallIndirect:
+		return p.parseWordInstruction(instruction)
+	case instructions.CallStack:
+		for _, tt := range []tokenType{tokenTypeLeftParen, tokenTypeText, tokenTypeRightParen} {
+			_, err := p.expect(tt)
+			if err != nil {
+				return err
+			}
+		}
+
+		return p.parseNoOperandInstruction(instruction)
+	default:
+		return p.parseAddressInstruction(instruction)
+	}
+}
+
 func (p *parser) parseAddressInstruction(instruction byte) error {
 	p.addByte(instruction)
 
@@ -64,6 +142,9 @@ func (p *parser) parseAddressInstruction(instruction byte) error {
 
 		addr = i
 
+	case tokenTypeNewLine, tokenTypeEndOfFile:
+		return fmt.Errorf("%s expects an address", instructions.Names[instruction])
+
 	default:
 		return fmt.Errorf("unexpected token %s", t.value)
 	}
@@ -108,6 +189,26 @@ func (p *parser) parseAddressInstruction(instruction byte) error {
 // 	return err
 // }
 
+// parsePopRegister parses a pop into a register, a pop without an operand pops into A
+func (p *parser) parsePopRegister() error {
+	p.addByte(instructions.PopRegister)
+
+	t, err := p.expect(tokenTypeText)
+	if err != nil {
+		return err
+	}
+
+	reg, err := getRegister(t.value)
+	if err != nil {
+		return err
+	}
+
+	p.addByte(reg)
+
+	p.skipIf(tokenTypeNewLine)
+	return nil
+}
+
 func (p *parser) parsePushInstruction() error {
 	p.addByte(instructions.Push)
 
@@ -135,6 +236,15 @@ func (p *parser) parsePushInstruction() error {
 
 		p.addByte(byte(n))
 
+	case tokenTypeText:
+		reg, err := getRegister(t.value)
+		if err != nil {
+			return err
+		}
+
+		p.addByte(instructions.Register)
+		p.addByte(reg)
+
 	default:
 		fmt.Println(t)
 		return fmt.Errorf("unexpected operand \"%s\"", t.value)
@@ -190,6 +300,11 @@ func (p *parser) parseOffsetAddress() (byte, byte, uint16, error) {
 		return 0, 0, 0, err
 	}
 
+	switch p.peek().tokenType {
+	case tokenTypeLeftParen, tokenTypeMinus:
+		return p.parsePointerAddress()
+	}
+
 	t, err := p.expect(tokenTypeText)
 	if err != nil {
 		return 0, 0, 0, err
@@ -277,6 +392,10 @@ func (p *parser) parseOffsetAddress() (byte, byte, uint16, error) {
 			return 0, 0, 0, fmt.Errorf("unexpected token \"%s\"", t.value)
 		}
 
+	// no offset
+	case tokenTypeRightParen:
+		p.backup()
+
 	// handle offset from [n] or [reg]
 	case tokenTypeLeftBracket:
 		p.backup()
@@ -300,6 +419,183 @@ func (p *parser) parseOffsetAddress() (byte, byte, uint16, error) {
 	return mode, modeArg, labelAddress, nil
 }
 
+// parsePointerLocation parses the (label), (n) or (fp+n) holding the pointer of a pointer address
+func (p *parser) parsePointerLocation() (byte, uint16, error) {
+	_, err := p.expect(tokenTypeLeftParen)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	t := p.nextToken()
+
+	var flag byte
+	var addr uint16
+
+	switch {
+	case t.tokenType == tokenTypeInteger:
+		n, err := parseIntegerToken(t)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		addr = uint16(n)
+
+	case t.tokenType == tokenTypeText && t.value == "fp":
+		flag = instructions.PointerInFrame
+
+		sign := p.nextToken()
+		if sign.tokenType != tokenTypePlus && sign.tokenType != tokenTypeMinus {
+			p.backup()
+			break
+		}
+
+		n, err := p.expect(tokenTypeInteger)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		offset, err := parseIntegerToken(n)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		addr = uint16(offset)
+		if sign.tokenType == tokenTypeMinus {
+			addr = -addr
+		}
+
+	case t.tokenType == tokenTypeText:
+		label, exists := p.labels[t.value]
+		if !exists {
+			return 0, 0, fmt.Errorf("no definitions found for label %s", t.value)
+		}
+
+		addr = label
+
+	default:
+		return 0, 0, fmt.Errorf("unexpected token \"%s\"", t.value)
+	}
+
+	_, err = p.expect(tokenTypeRightParen)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return flag, addr, nil
+}
+
+// parsePointerAddress parses an address through a pointer in memory after its opening paren:
+// ((ptr)), ((ptr)+n), ((ptr)-n) and ((ptr)+A) offset the pointer, ((ptr)+) increments it after the access and
+// (-(ptr)) decrements it before, so that a store through (-(ptr)) and a load through ((ptr)+) push and pop
+func (p *parser) parsePointerAddress() (byte, byte, uint16, error) {
+	if p.peek().tokenType == tokenTypeMinus {
+		p.nextToken()
+
+		flag, addr, err := p.parsePointerLocation()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		_, err = p.expect(tokenTypeRightParen)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		return instructions.PointerPreDecrement | flag, 0, addr, nil
+	}
+
+	flag, addr, err := p.parsePointerLocation()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	mode := byte(instructions.PointerWithOffset)
+	modeArg := byte(0)
+
+	next := p.nextToken()
+
+	switch next.tokenType {
+	case tokenTypePlus:
+		t := p.nextToken()
+
+		switch t.tokenType {
+		case tokenTypeRightParen:
+			p.backup()
+			mode = instructions.PointerPostIncrement
+
+		case tokenTypeInteger:
+			n, err := parseIntegerToken(t)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+
+			modeArg, err = signedByteOffset(n, false)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+
+		case tokenTypeText:
+			reg, err := getRegister(t.value)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+
+			mode = instructions.PointerPlusRegister
+			modeArg = byte(reg)
+
+		default:
+			return 0, 0, 0, fmt.Errorf("unexpected token \"%s\"", t.value)
+		}
+
+	case tokenTypeMinus:
+		t, err := p.expect(tokenTypeInteger)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		n, err := parseIntegerToken(t)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		modeArg, err = signedByteOffset(n, true)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+	// no offset
+	case tokenTypeRightParen:
+		p.backup()
+
+	default:
+		return 0, 0, 0, fmt.Errorf("unexpected token \"%s\"", next.value)
+	}
+
+	_, err = p.expect(tokenTypeRightParen)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return mode | flag, modeArg, addr, nil
+}
+
+// signedByteOffset returns the offset n, negated if negative is set, as the signed byte the VM reads
+func signedByteOffset(n uint64, negative bool) (byte, error) {
+	if negative {
+		if n > 128 {
+			return 0, fmt.Errorf("offset -%d does not fit in a signed byte", n)
+		}
+
+		return byte(-int(n)), nil
+	}
+
+	if n > 127 {
+		return 0, fmt.Errorf("offset %d does not fit in a signed byte", n)
+	}
+
+	return byte(n), nil
+}
+
 func (p *parser) parseMemoryAddress() (byte, byte, byte, byte, error) {
 	t := p.nextToken()
 
@@ -459,3 +755,22 @@ func (p *parser) parseStore() error {
 	p.skipIf(tokenTypeNewLine)
 	return nil
 }
+
+// parseWordInstruction parses an instruction that operates on the A:B pair and the word at a memory address,
+// the address is encoded like the address of a load
+func (p *parser) parseWordInstruction(instruction byte) error {
+	p.addByte(instruction)
+
+	mode, modeArg, h, l, err := p.parseMemoryAddress()
+	if err != nil {
+		return err
+	}
+
+	p.addByte(h)
+	p.addByte(l)
+	p.addByte(mode)
+	p.addByte(modeArg)
+
+	p.skipIf(tokenTypeNewLine)
+	return nil
+}
@@ -133,7 +133,7 @@ func (l *lexer) errWithPos(err error) error {
 func (l *lexer) Run(filename string, input string) ([]token, error) {
 	l.reset(filename, input)
 
-	for {
+	for l.pos < len(l.input) {
 		l.start = l.pos
 		r := rune(l.input[l.pos])
 
@@ -209,16 +209,23 @@ func (l *lexer) Run(filename string, input string) ([]token, error) {
 		default:
 			return nil, fmt.Errorf("encountered unexpected rune '%v' (%d)", string(r), r)
 		}
-
-		if l.pos >= len(l.input) {
-			l.addToken(tokenTypeEndOfFile)
-			break
-		}
 	}
 
+	l.start = l.pos
+	l.addToken(tokenTypeEndOfFile)
+
 	return l.tokens, nil
 }
 
+// current returns the rune at the current position
+func (l *lexer) current() rune {
+	if l.pos >= len(l.input) {
+		return eof
+	}
+
+	return rune(l.input[l.pos])
+}
+
 func (l *lexer) next() rune {
 	l.pos++
 
@@ -293,47 +300,42 @@ func (l *lexer) lexText() {
 }
 
 func (l *lexer) lexInclude() error {
-	r := rune(l.input[l.pos])
+	start := l.pos
+	r := l.current()
 
 	// skip "include" text
 	for isAlphaNumeric(r) {
 		r = l.next()
 	}
 
-	r = l.next()
+	if directive := l.input[start:l.pos]; directive != "include" {
+		return fmt.Errorf("unknown directive #%s", directive)
+	}
+
+	for r == ' ' || r == '\t' {
+		r = l.next()
+	}
 
 	tt := tokenTypeFileInclude
+	closing := '"'
 
 	switch r {
 	case '"':
 		tt = tokenTypeFileInclude
 	case '<':
 		tt = tokenTypeSystemInclude
+		closing = '>'
 	default:
-		fmt.Println(l.input)
-		return fmt.Errorf("expected '<' or '\"', got %s", string(r))
+		return fmt.Errorf("expected '<' or '\"' after #include")
 	}
 
 	l.pos++
 	l.start = l.pos
 
-	r = rune(l.input[l.pos])
-
-	for isAlphaNumeric(r) {
-		r = l.next()
-	}
-
-	if r == '.' {
-		r = l.next()
-
-		// get extension
-		for isAlphaNumeric(r) {
-			r = l.next()
+	for r = l.current(); r != closing; r = l.next() {
+		if r == eof || r == '\n' {
+			return fmt.Errorf("unterminated #include, expected %c", closing)
 		}
-
-		l.addToken(tt)
-		l.pos++ // skip '>' or '"'
-		return nil
 	}
 
 	l.addToken(tt)
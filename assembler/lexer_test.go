@@ -161,3 +161,23 @@ func TestLexer(t *testing.T) {
 		}
 	}
 }
+
+func TestLexer_Errors(t *testing.T) {
+	l := newLexer()
+
+	tokens, err := l.Run("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 1 || tokens[0].tokenType != tokenTypeEndOfFile {
+		t.Errorf("expected only an end of file token for empty input, got %v", tokens)
+	}
+
+	for _, input := range []string{"#", "#include", "#include \"a.asm", "#include <midi\n", "#define X"} {
+		_, err := l.Run("", input)
+		if err == nil {
+			t.Errorf("expected an error lexing %q", input)
+		}
+	}
+}
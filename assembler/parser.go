@@ -13,6 +13,10 @@ type parser struct {
 	instructions        []byte
 	currentLableAddress uint16
 	labels              map[string]uint16
+	stackSize           uint16
+	section             SectionKind
+	sections            []Section
+	lines               []SourceLine
 }
 
 func newParser() *parser {
@@ -105,6 +109,10 @@ func (p *parser) parseInstruction(t token) error {
 	case "swap":
 		return p.parseNoOperandInstruction(instructions.Swap)
 	case "pop":
+		if p.instructionAt(p.index) == instructions.PopRegister {
+			return p.parsePopRegister()
+		}
+
 		return p.parseNoOperandInstruction(instructions.Pop)
 	case "ret":
 		return p.parseNoOperandInstruction(instructions.Ret)
@@ -128,6 +136,22 @@ func (p *parser) parseInstruction(t token) error {
 		return p.parseNoOperandInstruction(instructions.And)
 	case "or":
 		return p.parseNoOperandInstruction(instructions.Or)
+	case "xor":
+		return p.parseNoOperandInstruction(instructions.Xor)
+	case "not":
+		return p.parseNoOperandInstruction(instructions.Not)
+	case "mod":
+		return p.parseNoOperandInstruction(instructions.Mod)
+	case "inc":
+		return p.parseNoOperandInstruction(instructions.Inc)
+	case "dec":
+		return p.parseNoOperandInstruction(instructions.Dec)
+	case "neg":
+		return p.parseNoOperandInstruction(instructions.Neg)
+	case "rol":
+		return p.parseNoOperandInstruction(instructions.Rol)
+	case "ror":
+		return p.parseNoOperandInstruction(instructions.Ror)
 	case "gt":
 		return p.parseNoOperandInstruction(instructions.GT)
 	case "gte":
@@ -140,18 +164,48 @@ func (p *parser) parseInstruction(t token) error {
 		return p.parseNoOperandInstruction(instructions.Eq)
 	case "neq":
 		return p.parseNoOperandInstruction(instructions.Neq)
+	case "cmp":
+		return p.parseNoOperandInstruction(instructions.Cmp)
+	case "adc":
+		return p.parseNoOperandInstruction(instructions.Adc)
+	case "sbb":
+		return p.parseNoOperandInstruction(instructions.Sbb)
 	case "rand":
 		return p.parseNoOperandInstruction(instructions.Rand)
 	case "halt":
 		return p.parseNoOperandInstruction(instructions.Halt)
-	case "call":
-		return p.parseAddressInstruction(instructions.Call)
-	case "jump":
-		return p.parseAddressInstruction(instructions.Jump)
+	case "wait":
+		return p.parseNoOperandInstruction(instructions.Wait)
+	case "sys":
+		return p.parseByteOperandInstruction(instructions.Sys)
+	case "call", "jump":
+		return p.parseJumpOrCall(p.instructionAt(p.index))
 	case "jumpz":
 		return p.parseAddressInstruction(instructions.Jumpz)
 	case "jumpnz":
 		return p.parseAddressInstruction(instructions.Jumpnz)
+	case "jc":
+		return p.parseAddressInstruction(instructions.Jc)
+	case "jnc":
+		return p.parseAddressInstruction(instructions.Jnc)
+	case "jn":
+		return p.parseAddressInstruction(instructions.Jn)
+	case "je":
+		return p.parseAddressInstruction(instructions.Je)
+	case "jne":
+		return p.parseAddressInstruction(instructions.Jne)
+	case "load16":
+		return p.parseWordInstruction(instructions.Load16)
+	case "store16":
+		return p.parseWordInstruction(instructions.Store16)
+	case "add16":
+		return p.parseWordInstruction(instructions.Add16)
+	case "sub16":
+		return p.parseWordInstruction(instructions.Sub16)
+	case "cmp16":
+		return p.parseWordInstruction(instructions.Cmp16)
+	case "inc16":
+		return p.parseNoOperandInstruction(instructions.Inc16)
 	case "load":
 		return p.parseLoad()
 	case "store":
@@ -160,6 +214,8 @@ func (p *parser) parseInstruction(t token) error {
 		return p.parseMov()
 	case "db":
 		return p.parseDB()
+	case "dw":
+		return p.parseDW()
 	default:
 		return fmt.Errorf("unexpected instruction %v", t.value)
 	}
@@ -172,7 +228,25 @@ func (p *parser) parseToken(t token) error {
 	case tokenTypeNewLine:
 		// skip whitespace
 	case tokenTypeInstruction:
+		start := len(p.instructions)
+		index := p.index
 		err = p.parseInstruction(t)
+
+		if t.value == "db" || t.value == "dw" {
+			p.addSection(start, p.section)
+		} else {
+			p.addSection(start, SectionCode)
+		}
+
+		if err == nil && t.fileName != "" {
+			p.lines = append(p.lines, SourceLine{
+				Start:       uint16(start),
+				End:         uint16(len(p.instructions)),
+				File:        t.fileName,
+				Line:        t.line,
+				Instruction: p.instructionAt(index),
+			})
+		}
 	case tokenTypeLabel:
 		n := p.peek()
 
@@ -181,6 +255,11 @@ func (p *parser) parseToken(t token) error {
 			p.index++
 		}
 
+	case tokenTypeDot:
+		if err := p.parseDirective(); err != nil {
+			return fmt.Errorf("error parsing directive: %w", err)
+		}
+
 	default:
 		return fmt.Errorf("unexpected token %v", t.value)
 	}
@@ -202,14 +281,60 @@ func (p *parser) parseTokens() error {
 	return nil
 }
 
+// instructionAt returns the opcode of the instruction token at index. Jumps and calls through
+// an address in memory are written with the address in parentheses, call (sp) calls the address
+// on the stack and a pop with a register pops into it, these have their own opcodes which have
+// different widths.
+func (p *parser) instructionAt(index int) uint8 {
+	t := p.tokens[index]
+	ins := instructions.InstructionByName[t.value]
+
+	if ins != instructions.Jump && ins != instructions.Call && ins != instructions.Pop {
+		return ins
+	}
+
+	next := tokenTypeEndOfFile
+	if index+1 < len(p.tokens) {
+		next = p.tokens[index+1].tokenType
+	}
+
+	switch {
+	case ins == instructions.Pop && next == tokenTypeText:
+		return instructions.PopRegister
+	case ins == instructions.Pop:
+		return ins
+	case next == tokenTypeLeftParen && ins == instructions.Jump:
+		return instructions.JumpIndirect
+	case next == tokenTypeLeftParen && p.isStackOperand(index+1):
+		return instructions.CallStack
+	case next == tokenTypeLeftParen:
+		return instructions.CallIndirect
+	default:
+		return ins
+	}
+}
+
+// isStackOperand returns true if the tokens at index are (sp)
+func (p *parser) isStackOperand(index int) bool {
+	if index+2 >= len(p.tokens) {
+		return false
+	}
+
+	sp := p.tokens[index+1]
+
+	return p.tokens[index].tokenType == tokenTypeLeftParen &&
+		sp.tokenType == tokenTypeText && sp.value == "sp" &&
+		p.tokens[index+2].tokenType == tokenTypeRightParen
+}
+
 func (p *parser) getLabels() error {
-	for _, t := range p.tokens {
+	for i, t := range p.tokens {
 		switch t.tokenType {
 		case tokenTypeLabel:
 			p.labels[t.value] = uint16(p.currentLableAddress)
 
 		case tokenTypeInstruction:
-			ins := instructions.InstructionByName[t.value]
+			ins := p.instructionAt(i)
 			w := instructions.Width[ins]
 			p.currentLableAddress += uint16(w)
 		}
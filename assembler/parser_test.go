@@ -40,6 +40,22 @@ var movTestCases = []parserTestCase{
 		input:  "mov B, 0xcd",
 		output: []byte{instructions.Mov, instructions.RegisterB, 0xcd},
 	},
+	{
+		input:  "mov C, 1",
+		output: []byte{instructions.Mov, instructions.RegisterC, 1},
+	},
+	{
+		input:  "mov D, 1",
+		output: []byte{instructions.Mov, instructions.RegisterD, 1},
+	},
+	{
+		input:  "mov X, 1",
+		output: []byte{instructions.Mov, instructions.RegisterX, 1},
+	},
+	{
+		input:  "mov Y, 1",
+		output: []byte{instructions.Mov, instructions.RegisterY, 1},
+	},
 }
 
 var loadTestCases = []parserTestCase{
@@ -117,6 +133,13 @@ var loadTestCases = []parserTestCase{
 		input: `
 		test_label: db 1
 
+		load (test_label[X]), D`,
+		output: []byte{1, instructions.Load, 0x00, 0x00, instructions.ImmediatePlusRegister, instructions.RegisterX, instructions.RegisterD},
+	},
+	{
+		input: `
+		test_label: db 1
+
 		load test_label, B`,
 		output: []byte{1, instructions.Load, 0x00, 0x00, instructions.Immediate, 0x0, instructions.RegisterB},
 	},
@@ -239,6 +262,104 @@ var jumpTestCases = []parserTestCase{
 		input:  "jumpnz 0xcdba",
 		output: []byte{instructions.Jumpnz, 0xcd, 0xba},
 	},
+	{
+		input:  "jc 0xcdba",
+		output: []byte{instructions.Jc, 0xcd, 0xba},
+	},
+	{
+		input:  "jnc 0xcdba",
+		output: []byte{instructions.Jnc, 0xcd, 0xba},
+	},
+	{
+		input:  "jn 0xcdba",
+		output: []byte{instructions.Jn, 0xcd, 0xba},
+	},
+	{
+		input:  "je 0xcdba",
+		output: []byte{instructions.Je, 0xcd, 0xba},
+	},
+	{
+		input: `test_label:
+		cmp
+		jne test_label
+		`,
+		output: []byte{instructions.Cmp, instructions.Jne, 0, 0},
+	},
+}
+
+var wordTestCases = []parserTestCase{
+	{
+		input:  "load16 0xaecd",
+		output: []byte{instructions.Load16, 0xae, 0xcd, instructions.Immediate, 0x0},
+	},
+	{
+		input:  "store16 (fp + 7)",
+		output: []byte{instructions.Store16, 0x00, 0x00, instructions.FramePointerWithOffset, 0x7},
+	},
+	{
+		input: `
+		test_label: db 1
+		db 2
+
+		add16 test_label`,
+		output: []byte{1, 2, instructions.Add16, 0x00, 0x00, instructions.Immediate, 0x0},
+	},
+	{
+		input: `
+		test_label: db 1
+
+		sub16 (test_label[B])`,
+		output: []byte{1, instructions.Sub16, 0x00, 0x00, instructions.ImmediatePlusRegister, instructions.RegisterB},
+	},
+	{
+		input:  "cmp16 (fp - A)",
+		output: []byte{instructions.Cmp16, 0x00, 0x00, instructions.FramePointerMinusRegister, instructions.RegisterA},
+	},
+}
+
+var indirectTestCases = []parserTestCase{
+	{
+		input: `
+		handler: dw 0x1234
+
+		jump (handler)`,
+		output: []byte{0x12, 0x34, instructions.JumpIndirect, 0x00, 0x00, instructions.Immediate, 0x0},
+	},
+	// A is a byte offset into the table, not an entry index
+	{
+		input: `
+		table: dw 0x1234
+		dw 0x5678
+
+		jump (table[A])`,
+		output: []byte{0x12, 0x34, 0x56, 0x78, instructions.JumpIndirect, 0x00, 0x00, instructions.ImmediatePlusRegister, instructions.RegisterA},
+	},
+	{
+		input:  "call (fp + 7)",
+		output: []byte{instructions.CallIndirect, 0x00, 0x00, instructions.FramePointerWithOffset, 0x7},
+	},
+	{
+		input:  "call (sp)",
+		output: []byte{instructions.CallStack},
+	},
+	{
+		input: `call (sp)
+		call 0x1234`,
+		output: []byte{instructions.CallStack, instructions.Call, 0x12, 0x34},
+	},
+	// labels after indirect jumps and calls are at the right address
+	{
+		input: `call (fp + 7)
+		call (sp)
+		jump (fp)
+		test_label: jump test_label`,
+		output: []byte{
+			instructions.CallIndirect, 0x00, 0x00, instructions.FramePointerWithOffset, 0x7,
+			instructions.CallStack,
+			instructions.JumpIndirect, 0x00, 0x00, instructions.FramePointerWithOffset, 0x0,
+			instructions.Jump, 0x00, 0x0b,
+		},
+	},
 }
 
 var labelTestCases = []parserTestCase{
@@ -263,6 +384,17 @@ var dbTestCases = []parserTestCase{
 	},
 }
 
+var dwTestCases = []parserTestCase{
+	{
+		input: "dw 0x1234", output: []byte{0x12, 0x34},
+	},
+	{
+		input: `dw test_label
+		test_label: db 1`,
+		output: []byte{0x00, 0x02, 1},
+	},
+}
+
 var testCases = []parserTestCase{
 	// check parser ignores whitespace
 	{
@@ -291,6 +423,91 @@ var pushTestCases = []parserTestCase{
 		input:  "push 0xae",
 		output: []byte{instructions.Push, instructions.Immediate, 0xae},
 	},
+	{
+		input:  "push B",
+		output: []byte{instructions.Push, instructions.Register, instructions.RegisterB},
+	},
+	{
+		input:  "push X",
+		output: []byte{instructions.Push, instructions.Register, instructions.RegisterX},
+	},
+	{
+		input:  "pop Y",
+		output: []byte{instructions.PopRegister, instructions.RegisterY},
+	},
+	// labels after pops into a register are at the right address
+	{
+		input: `pop C
+		pop
+		target: jump target`,
+		output: []byte{instructions.PopRegister, instructions.RegisterC, instructions.Pop, instructions.Jump, 0x00, 0x03},
+	},
+}
+
+var pointerTestCases = []parserTestCase{
+	{
+		input: `
+		ptr: dw 0x0100
+
+		load ((ptr)), A`,
+		output: []byte{0x01, 0x00, instructions.Load, 0x00, 0x00, instructions.PointerWithOffset, 0x0, instructions.RegisterA},
+	},
+	{
+		input: `
+		ptr: dw 0x0100
+
+		load ((ptr)+A), B`,
+		output: []byte{0x01, 0x00, instructions.Load, 0x00, 0x00, instructions.PointerPlusRegister, instructions.RegisterA, instructions.RegisterB},
+	},
+	{
+		input: `
+		ptr: dw 0x0100
+
+		load ((ptr) - 2), B`,
+		output: []byte{0x01, 0x00, instructions.Load, 0x00, 0x00, instructions.PointerWithOffset, 0xfe, instructions.RegisterB},
+	},
+	{
+		input: `
+		ptr: dw 0x0100
+
+		load ((ptr)+), A`,
+		output: []byte{0x01, 0x00, instructions.Load, 0x00, 0x00, instructions.PointerPostIncrement, 0x0, instructions.RegisterA},
+	},
+	{
+		input: `
+		ptr: dw 0x0100
+
+		store A, (-(ptr))`,
+		output: []byte{0x01, 0x00, instructions.Store, instructions.RegisterA, instructions.PointerPreDecrement, 0x0, 0x00, 0x00},
+	},
+	{
+		input:  "load ((0x1234)+2), A",
+		output: []byte{instructions.Load, 0x12, 0x34, instructions.PointerWithOffset, 0x2, instructions.RegisterA},
+	},
+	{
+		input:  "load ((0x1234)+127), A",
+		output: []byte{instructions.Load, 0x12, 0x34, instructions.PointerWithOffset, 0x7f, instructions.RegisterA},
+	},
+	{
+		input:  "load ((0x1234)-128), A",
+		output: []byte{instructions.Load, 0x12, 0x34, instructions.PointerWithOffset, 0x80, instructions.RegisterA},
+	},
+	{
+		input:  "load ((fp + 7)+B), A",
+		output: []byte{instructions.Load, 0x00, 0x07, instructions.PointerPlusRegister | instructions.PointerInFrame, instructions.RegisterB, instructions.RegisterA},
+	},
+	{
+		input:  "store B, (-(fp - 2))",
+		output: []byte{instructions.Store, instructions.RegisterB, instructions.PointerPreDecrement | instructions.PointerInFrame, 0x0, 0xff, 0xfe},
+	},
+	{
+		input:  "load16 ((fp)+)",
+		output: []byte{instructions.Load16, 0x00, 0x00, instructions.PointerPostIncrement | instructions.PointerInFrame, 0x0},
+	},
+	{
+		input:  "jump ((fp + 7)+A)",
+		output: []byte{instructions.JumpIndirect, 0x00, 0x07, instructions.PointerPlusRegister | instructions.PointerInFrame, instructions.RegisterA},
+	},
 }
 
 func TestParser(t *testing.T) {
@@ -301,6 +518,7 @@ func TestParser(t *testing.T) {
 	parserTestCases = append(parserTestCases, parserTestCase{"ret", []byte{instructions.Ret}})
 	parserTestCases = append(parserTestCases, parserTestCase{"reti", []byte{instructions.Reti}})
 	parserTestCases = append(parserTestCases, parserTestCase{"halt", []byte{instructions.Halt}})
+	parserTestCases = append(parserTestCases, parserTestCase{"wait", []byte{instructions.Wait}})
 	parserTestCases = append(parserTestCases, parserTestCase{"add", []byte{instructions.Add}})
 	parserTestCases = append(parserTestCases, parserTestCase{"sub", []byte{instructions.Sub}})
 	parserTestCases = append(parserTestCases, parserTestCase{"mul", []byte{instructions.Mul}})
@@ -308,6 +526,14 @@ func TestParser(t *testing.T) {
 	parserTestCases = append(parserTestCases, parserTestCase{"or", []byte{instructions.Or}})
 	parserTestCases = append(parserTestCases, parserTestCase{"shl", []byte{instructions.Shl}})
 	parserTestCases = append(parserTestCases, parserTestCase{"shr", []byte{instructions.Shr}})
+	parserTestCases = append(parserTestCases, parserTestCase{"xor", []byte{instructions.Xor}})
+	parserTestCases = append(parserTestCases, parserTestCase{"not", []byte{instructions.Not}})
+	parserTestCases = append(parserTestCases, parserTestCase{"mod", []byte{instructions.Mod}})
+	parserTestCases = append(parserTestCases, parserTestCase{"inc", []byte{instructions.Inc}})
+	parserTestCases = append(parserTestCases, parserTestCase{"dec", []byte{instructions.Dec}})
+	parserTestCases = append(parserTestCases, parserTestCase{"neg", []byte{instructions.Neg}})
+	parserTestCases = append(parserTestCases, parserTestCase{"rol", []byte{instructions.Rol}})
+	parserTestCases = append(parserTestCases, parserTestCase{"ror", []byte{instructions.Ror}})
 	parserTestCases = append(parserTestCases, parserTestCase{"rand", []byte{instructions.Rand}})
 	parserTestCases = append(parserTestCases, parserTestCase{"gt", []byte{instructions.GT}})
 	parserTestCases = append(parserTestCases, parserTestCase{"gte", []byte{instructions.GTE}})
@@ -315,14 +541,23 @@ func TestParser(t *testing.T) {
 	parserTestCases = append(parserTestCases, parserTestCase{"lte", []byte{instructions.LTE}})
 	parserTestCases = append(parserTestCases, parserTestCase{"eq", []byte{instructions.Eq}})
 	parserTestCases = append(parserTestCases, parserTestCase{"neq", []byte{instructions.Neq}})
+	parserTestCases = append(parserTestCases, parserTestCase{"cmp", []byte{instructions.Cmp}})
+	parserTestCases = append(parserTestCases, parserTestCase{"adc", []byte{instructions.Adc}})
+	parserTestCases = append(parserTestCases, parserTestCase{"sbb", []byte{instructions.Sbb}})
+	parserTestCases = append(parserTestCases, parserTestCase{"inc16", []byte{instructions.Inc16}})
+	parserTestCases = append(parserTestCases, parserTestCase{"sys 0x3", []byte{instructions.Sys, 0x3}})
 
 	parserTestCases = append(parserTestCases, movTestCases...)
 	parserTestCases = append(parserTestCases, callTestCases...)
 	parserTestCases = append(parserTestCases, jumpTestCases...)
 	parserTestCases = append(parserTestCases, loadTestCases...)
 	parserTestCases = append(parserTestCases, storeTestCases...)
+	parserTestCases = append(parserTestCases, wordTestCases...)
 	parserTestCases = append(parserTestCases, labelTestCases...)
 	parserTestCases = append(parserTestCases, dbTestCases...)
+	parserTestCases = append(parserTestCases, dwTestCases...)
+	parserTestCases = append(parserTestCases, indirectTestCases...)
+	parserTestCases = append(parserTestCases, pointerTestCases...)
 	parserTestCases = append(parserTestCases, testCases...)
 	parserTestCases = append(parserTestCases, pushTestCases...)
 
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/instructions"
+	"github.com/andrewesterhuizen/penpal/midi"
+	"github.com/andrewesterhuizen/penpal/penpal"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// printMidiMessage prints the midi messages sent by a program being debugged instead of sending them to a device
+func printMidiMessage(m midi.MidiMessage) {
+	fmt.Printf("midi: 0x%02x 0x%02x 0x%02x\n", m[0], m[1], m[2])
+}
+
+// debugger steps a program forwards by clock ticks or instructions and backwards through its recorded history
+type debugger struct {
+	vm      *vm.VM
+	runtime *penpal.Runtime
+	info    assembler.ProgramInfo
+}
+
+const debugHelp = `commands:
+  tick [n]      run until n clock ticks have been handled
+  step [n]      execute n instructions
+  back [n]      undo n instructions
+  write <addr>  run back to the last write to an address or label
+  rewind        run back to the start of the last on_tick
+  regs          print the registers
+  mem <addr>    print memory at an address, label, label[n] or start-end
+  quit`
+
+// printLocation prints the next instruction to execute
+func (d *debugger) printLocation() {
+	ip := d.vm.IP()
+
+	switch {
+	case d.vm.Halted:
+		fmt.Printf("halted at %s\n", d.info.Symbolize(ip))
+	case d.vm.Waiting:
+		fmt.Printf("waiting at %s (tick %d)\n", d.info.Symbolize(ip), d.runtime.Ticks())
+	default:
+		fmt.Printf("%s: %s\n", d.info.Symbolize(ip), instructions.Names[d.vm.GetMemory(ip)])
+	}
+}
+
+// count returns the optional count argument of a command, defaulting to 1
+func count(fields []string) (int, error) {
+	if len(fields) < 2 {
+		return 1, nil
+	}
+
+	return strconv.Atoi(fields[1])
+}
+
+func (d *debugger) runCommand(fields []string) error {
+	switch fields[0] {
+	case "tick":
+		n, err := count(fields)
+		if err != nil {
+			return err
+		}
+
+		err = d.runtime.RunTicks(n)
+		if err != nil {
+			printFault(err, d.info)
+		}
+
+	case "step":
+		n, err := count(fields)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < n && !d.vm.Halted && !d.vm.Waiting; i++ {
+			err = d.vm.Tick()
+			if err != nil {
+				printFault(err, d.info)
+			}
+		}
+
+	case "back":
+		n, err := count(fields)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			if !d.vm.StepBack() {
+				fmt.Println("no more recorded instructions")
+				break
+			}
+		}
+
+	case "write", "mem":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: %s <addr>", fields[0])
+		}
+
+		spec, err := parseWatch(fields[1], d.info)
+		if err != nil {
+			return err
+		}
+
+		if fields[0] == "mem" {
+			d.vm.PrintMem(spec.start, spec.end-spec.start)
+			return nil
+		}
+
+		if !d.vm.RunBackToWrite(spec.start) {
+			fmt.Printf("no recorded write to %s\n", d.info.Symbolize(spec.start))
+		}
+
+	case "rewind":
+		if !d.vm.RewindToInterupt(penpal.InteruptTick) {
+			fmt.Println("no recorded on_tick")
+		}
+
+	case "regs":
+		fmt.Printf("ip: %s\n", d.info.Symbolize(d.vm.IP()))
+		d.vm.PrintReg()
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %s", fields[0])
+	}
+
+	d.printLocation()
+	return nil
+}
+
+// debugCommand runs a program in program time under the control of commands read from stdin,
+// the midi messages it sends are printed rather than sent to a device
+func debugCommand(args []string) {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	clockSpeed := flags.Int("clock", penpal.DefaultClockSpeed, "number of cycles executed per second of program time")
+	history := flags.Int("history", 100000, "number of instructions that can be undone")
+	watches := watchFlags{}
+	flags.Var(&watches, "watch", "print the program's accesses to memory, [r|w|c:]label, label[n], addr or start-end, can be repeated")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		log.Fatal("no input file")
+	}
+
+	v, info := newVMFromFile(flags.Arg(0), runOptions{protection: vm.ProtectionFault, watches: watches})
+	v.Record(*history)
+
+	d := debugger{
+		vm:      v,
+		runtime: penpal.NewRuntime(penpal.RuntimeConfig{ClockSpeed: *clockSpeed}, v, &midi.RecordingMidiHandler{OnSend: printMidiMessage}),
+		info:    info,
+	}
+
+	defer d.runtime.ReleaseNotes()
+
+	fmt.Println(debugHelp)
+	d.printLocation()
+
+	scanner := bufio.NewScanner(os.Stdin)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "quit" {
+			return
+		}
+
+		err := d.runCommand(fields)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
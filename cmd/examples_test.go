@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewesterhuizen/penpal/midi"
+	"github.com/andrewesterhuizen/penpal/penpal"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+var update = flag.Bool("update", false, "update the golden files with the output of the examples")
+
+// exampleTicks is the number of clock ticks each example is run for, four bars of stepseq
+const exampleTicks = 64
+
+func TestExamples_MatchGoldenFiles(t *testing.T) {
+	for _, example := range []string{"stepseq", "rand", "test"} {
+		t.Run(example, func(t *testing.T) {
+			v, info := newVMFromFile(example+".asm", runOptions{protection: vm.ProtectionFault})
+			v.Seed(1)
+
+			// each message is written with the number of clock ticks raised before it, scheduled note offs
+			// are sent before the tick that releases them is raised so they have the number of the tick before
+			var out bytes.Buffer
+			var r *penpal.Runtime
+
+			h := &midi.RecordingMidiHandler{OnSend: func(m midi.MidiMessage) {
+				fmt.Fprintf(&out, "tick %3d: 0x%02x 0x%02x 0x%02x\n", r.Ticks(), m[0], m[1], m[2])
+			}}
+			r = penpal.NewRuntime(penpal.RuntimeConfig{}, v, h)
+
+			err := r.RunTicks(exampleTicks)
+			if err != nil {
+				t.Fatalf("fault at %s: %s", info.Symbolize(v.IP()), err)
+			}
+
+			r.ReleaseNotes()
+
+			golden := filepath.Join("testdata", example+".golden")
+
+			if *update {
+				err := ioutil.WriteFile(golden, out.Bytes(), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%s, run go test ./cmd -update to create it", err)
+			}
+
+			if !bytes.Equal(out.Bytes(), expected) {
+				t.Errorf("output of %s.asm doesn't match %s, run go test ./cmd -update if the change is expected:\n%s",
+					example, golden, out.String())
+			}
+		})
+	}
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"time"
+	"os/signal"
+	"strconv"
+	"strings"
 
 	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/coverage"
 	"github.com/andrewesterhuizen/penpal/instructions"
 	"github.com/andrewesterhuizen/penpal/penpal"
+	"github.com/andrewesterhuizen/penpal/profile"
 
 	"github.com/andrewesterhuizen/penpal/midi"
+	"github.com/andrewesterhuizen/penpal/midi/portmidi"
 	"github.com/andrewesterhuizen/penpal/vm"
 )
 
@@ -46,7 +54,7 @@ func printDisasm(program []byte) {
 }
 
 func printMidiDevices() {
-	midiHandler := midi.NewPortMidiMidiHandler()
+	midiHandler := portmidi.NewMidiHandler()
 	inputs, outputs := midiHandler.GetDevices()
 
 	fmt.Println("inputs:")
@@ -71,38 +79,62 @@ func compileFromFile(filename string) {
 		log.Fatal(err)
 	}
 
-	a := assembler.New(assembler.Config{SystemIncludes: systemIncludes})
+	a := assembler.New(assembler.Config{
+		SystemIncludes: systemIncludes,
+		InteruptLabels: penpal.InteruptLabels,
+	})
 
 	program, err := a.GetProgram(filename, string(f))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	header := penpal.GetHeaderBytes()
+	info := a.Info()
+	header := penpal.GetHeaderBytes(penpal.Header{StackSize: info.StackSize, Regions: getRegions(info.Sections)})
 
 	binary.Write(os.Stdout, binary.LittleEndian, header)
 	binary.Write(os.Stdout, binary.LittleEndian, program)
 }
 
-func loadProgramFromFile(filename string) []byte {
+// getRegions returns the memory regions for the sections of an assembled program
+func getRegions(sections []assembler.Section) []vm.Region {
+	regions := []vm.Region{}
+
+	for _, s := range sections {
+		var kind vm.RegionKind
+
+		switch s.Kind {
+		case assembler.SectionCode:
+			kind = vm.RegionCode
+		case assembler.SectionROData:
+			kind = vm.RegionROData
+		case assembler.SectionIO:
+			kind = vm.RegionIO
+		default:
+			kind = vm.RegionData
+		}
+
+		regions = append(regions, vm.Region{Kind: kind, Start: s.Start, End: s.End})
+	}
+
+	return regions
+}
+
+// loadProgramFromFile returns the program and memory regions in a compiled binary or assembly file,
+// labels are only available for programs assembled from source
+func loadProgramFromFile(filename string) ([]byte, []vm.Region, assembler.ProgramInfo) {
 	f, err := ioutil.ReadFile(filename)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// determine if file is compiled binary by checking header
-	header := []byte("PENPAL")
-	binary := true
-
-	for i, c := range header {
-		if f[i] != c {
-			binary = false
-			break
+	if penpal.IsCompiled(f) {
+		header, program, err := penpal.ReadHeader(f)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}
 
-	if binary {
-		return f[penpal.HeaderSize:]
+		return program, header.Regions, assembler.ProgramInfo{StackSize: header.StackSize}
 	}
 
 	systemIncludes, err := penpal.GetSystemIncludes()
@@ -112,7 +144,7 @@ func loadProgramFromFile(filename string) []byte {
 
 	a := assembler.New(assembler.Config{
 		SystemIncludes: systemIncludes,
-		InteruptLabels: [3]string{"on_tick"},
+		InteruptLabels: penpal.InteruptLabels,
 	})
 
 	program, err := a.GetProgram(filename, string(f))
@@ -120,73 +152,266 @@ func loadProgramFromFile(filename string) []byte {
 		log.Fatal(err)
 	}
 
-	return program
+	info := a.Info()
+	return program, getRegions(info.Sections), info
 }
 
-func executeProgramFromFile(filename string) {
-	program := loadProgramFromFile(filename)
+// printFault prints a fault with the call chain that led to it
+func printFault(err error, info assembler.ProgramInfo) {
+	var fault *vm.Fault
+	if !errors.As(err, &fault) {
+		log.Print(err)
+		return
+	}
 
-	midiHandler := midi.NewPortMidiMidiHandler()
-	defer midiHandler.Close()
+	log.Printf("fault at %s: %s", info.Symbolize(fault.IP), fault.Err)
 
-	vm := vm.New()
+	for _, addr := range fault.CallChain {
+		log.Printf("    called from %s", info.Symbolize(addr))
+	}
+}
 
-	msPerMinute := 60 * 1000
+// readTransportCommands controls the runtime's transport with commands read from stdin
+func readTransportCommands(r *penpal.Runtime) {
+	scanner := bufio.NewScanner(os.Stdin)
 
-	// TODO: clock should be enabled according to a flag
-	go func() {
-		for {
-			bpm := vm.GetMemory(0xd)
-			ppqn := vm.GetMemory(0xe)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
 
-			if bpm == 0 || ppqn == 0 {
+		switch fields[0] {
+		case "play":
+			r.Play()
+		case "pause":
+			r.Pause()
+		case "stop":
+			r.Stop()
+		case "locate":
+			if len(fields) < 2 {
+				fmt.Println("usage: locate <bar>")
 				continue
 			}
 
-			interval := (msPerMinute / int(bpm)) / int(ppqn)
-			vm.Interupt(0)
-			time.Sleep(time.Duration(interval) * time.Millisecond)
+			bar, err := strconv.Atoi(fields[1])
+			if err != nil {
+				fmt.Printf("invalid bar %s\n", fields[1])
+				continue
+			}
 
+			r.Locate(bar)
+		case "quit":
+			r.Quit()
+			return
+		default:
+			fmt.Printf("unknown command %s, expected play, pause, stop, locate <bar> or quit\n", fields[0])
 		}
-	}()
+	}
+}
 
-	vm.Load(program)
+// runOptions are the options of the run command
+type runOptions struct {
+	config      penpal.RuntimeConfig
+	inputDevice int
+	protection  vm.Protection
+	watches     []string
+	profile     string
+	profileTop  int
+	cover       string
+}
 
-	clockSpeedMHz := 1
-	clockInterval := (1000 / time.Duration(clockSpeedMHz)) * time.Nanosecond
+// newVMFromFile loads a program into a new VM set up with the stack, memory regions and watches of the options
+func newVMFromFile(filename string, options runOptions) (*vm.VM, assembler.ProgramInfo) {
+	program, regions, info := loadProgramFromFile(filename)
 
-	ticker := time.NewTicker(clockInterval)
-	defer ticker.Stop()
+	v := vm.New()
 
-	done := make(chan bool)
-	messages := make(chan midi.MidiMessage)
+	err := v.SetStack(vm.DefaultStackTop, info.StackSize)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	go func() {
-		for range ticker.C {
-			if vm.Halted {
-				vm.PrintReg()
-				vm.PrintMem(0, 24)
-				done <- true
-				return
-			}
+	v.Load(program)
 
-			vm.Tick()
-			m := vm.GetMemorySection(0x000f, 4)
+	err = v.SetRegions(regions)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			if m[3] > 0 {
-				messages <- midi.MidiMessage{m[0], m[1], m[2]}
-			}
+	v.SetProtection(options.protection)
+	v.OnProtectionViolation(func(p vm.ProtectionViolation) {
+		log.Printf("write of 0x%02x to %s at %s from %s", p.Value, p.Kind, info.Symbolize(p.Addr), info.Symbolize(p.IP))
+	})
+
+	err = addWatches(v, options.watches, info)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return v, info
+}
+
+func executeProgramFromFile(filename string, options runOptions) {
+	v, info := newVMFromFile(filename, options)
+
+	midiHandler := portmidi.NewMidiHandler()
+	defer midiHandler.Close()
+
+	r := penpal.NewRuntime(options.config, v, midiHandler)
+
+	if options.inputDevice >= 0 {
+		messages, err := midiHandler.Listen(options.inputDevice)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+
+		go func() {
+			for m := range messages {
+				r.HandleMidiMessage(m)
+			}
+		}()
+	}
+
+	var p *vm.Profile
+	if options.profile != "" {
+		p = v.StartProfile()
+	}
+
+	var c *vm.Coverage
+	if options.cover != "" {
+		c = v.StartCoverage()
+	}
+
+	go readTransportCommands(r)
+
+	// quit on interupt so that notes that are on are released before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
 
 	go func() {
-		for m := range messages {
-			midiHandler.Send(m[0], m[1], m[2])
-			vm.SetMemory(18, 0x0)
-		}
+		<-signals
+		r.Quit()
 	}()
 
-	<-done
+	err := r.Run()
+	if err != nil {
+		printFault(err, info)
+	}
+
+	stats := r.Stats()
+	fmt.Printf("executed %d instructions (%d cycles) in %s (%.0f instructions/s, %.0f cycles/s)\n",
+		stats.Instructions, stats.Cycles, stats.Elapsed, stats.InstructionRate(), stats.ClockSpeed())
+
+	for n, label := range penpal.InteruptLabels {
+		if stats.MaxInteruptCycles[n] > 0 {
+			fmt.Printf("%s: max %d cycles, %d over budget\n", label, stats.MaxInteruptCycles[n], stats.InteruptOverruns[n])
+		}
+	}
+
+	if p != nil {
+		writeProfile(p, info, options)
+	}
+
+	if c != nil {
+		writeCoverage(c, info, options.cover)
+	}
+
+	if v.Halted {
+		v.PrintReg()
+		v.PrintMem(0, 24)
+	}
+}
+
+// writeProfile prints the labels that used the most cycles and writes the profile for go tool pprof
+func writeProfile(p *vm.Profile, info assembler.ProgramInfo, options runOptions) {
+	profile.WriteReport(os.Stdout, profile.ByLabel(p, info), options.profileTop)
+
+	f, err := os.Create(options.profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer f.Close()
+
+	clockSpeed := options.config.ClockSpeed
+	if clockSpeed == 0 {
+		clockSpeed = penpal.DefaultClockSpeed
+	}
+
+	err = profile.WritePprof(f, p, info, clockSpeed)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeCoverage prints a coverage report and writes the coverage to an lcov file
+func writeCoverage(c *vm.Coverage, info assembler.ProgramInfo, filename string) {
+	files := coverage.Files(c, info)
+	coverage.WriteText(os.Stdout, files)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer f.Close()
+
+	coverage.WriteLcov(f, files)
+}
+
+func runCommand(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	stopped := flags.Bool("stopped", false, "wait for a play command or midi start message before starting the transport")
+	input := flags.Int("input", -1, "id of the midi input device to receive transport messages from")
+	clockSpeed := flags.Int("clock", penpal.DefaultClockSpeed, "target number of cycles executed per second")
+	interuptBudget := flags.Int("interupt-budget", 0, "cycles an interupt handler can use before a warning is logged, defaults to one clock tick")
+	unthrottled := flags.Bool("unthrottled", false, "execute instructions as fast as possible, the clock follows program time")
+	panicMode := flags.Bool("panic", false, "release notes with all notes off and all sound off messages on every channel instead of note offs")
+	protect := flags.String("protect", "fault", "what happens when the program writes to code or read only data: fault, log or off")
+	watches := watchFlags{}
+	flags.Var(&watches, "watch", "print the program's accesses to memory, [r|w|c:]label, label[n], addr or start-end, can be repeated")
+	profilePath := flags.String("profile", "", "count the instructions and cycles executed by each label and write a pprof profile to the file")
+	profileTop := flags.Int("profile-top", 20, "number of labels printed in the profile report")
+	cover := flags.String("cover", "", "record the lines and branches executed, print a report and write an lcov file")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		log.Fatal("no input file")
+	}
+
+	config := penpal.RuntimeConfig{
+		Stopped:             *stopped,
+		ClockSpeed:          *clockSpeed,
+		InteruptCycleBudget: *interuptBudget,
+		Unthrottled:         *unthrottled,
+	}
+
+	if *panicMode {
+		config.NotesOffMode = midi.NotesOffModeControlChange
+	}
+
+	options := runOptions{
+		config:      config,
+		inputDevice: *input,
+		watches:     watches,
+		profile:     *profilePath,
+		profileTop:  *profileTop,
+		cover:       *cover,
+	}
+
+	switch *protect {
+	case "fault":
+		options.protection = vm.ProtectionFault
+	case "log":
+		options.protection = vm.ProtectionLog
+	case "off":
+		options.protection = vm.ProtectionOff
+	default:
+		log.Fatalf("unknown protection mode %s, expected fault, log or off", *protect)
+	}
+
+	executeProgramFromFile(flags.Arg(0), options)
 }
 
 func main() {
@@ -205,8 +430,17 @@ func main() {
 			compileFromFile(args[1])
 			return
 
+		case "run":
+			runCommand(args[1:])
+
+		case "debug":
+			debugCommand(args[1:])
+
+		case "test":
+			testCommand(args[1:])
+
 		default:
-			executeProgramFromFile(args[0])
+			executeProgramFromFile(args[0], runOptions{inputDevice: -1, protection: vm.ProtectionFault})
 		}
 
 		return
@@ -2,6 +2,7 @@
 
 start:
 loop:
+    wait
     jump loop
 
 on_tick: 
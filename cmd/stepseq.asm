@@ -3,6 +3,7 @@
 i: db 0
 length: db 16
 
+.rodata
 notes:
     db 48
     db 49
@@ -38,6 +39,7 @@ steps:
     db 1
     db 0
     db 1
+.data
 
 start:
     mov A, 130
@@ -46,29 +48,20 @@ start:
     mov A, 4
     store A, midi_ppqn
 loop:
+    wait
     jump loop
 
 inc_step:
-    // increment index
+    // increment index and wrap around at length
     load i, A
-    mov B, 1
-    add
-    store A, i
-
-    // check if index == length
+    inc
     load length, B
-    gte
-    jumpz inc_step_end
-
-    // reset
-    mov A, 0
+    mod
     store A, i
-
-    inc_step_end:
     ret
 
 on_tick: 
-    push 1
+    push 0
     call inc_step
     
     // check if step is active
@@ -0,0 +1,55 @@
+#include "stepseq.asm"
+#include <test>
+
+// inc_step moves to the next step
+test_inc_step:
+    mov A, 0
+    store A, i
+
+    push 0
+    call inc_step
+
+    load i, A
+    mov B, 1
+    push 0
+    call assert_eq
+    ret
+
+// inc_step wraps around to the first step after the last one
+test_inc_step_wraps:
+    mov A, 15
+    store A, i
+
+    push 0
+    call inc_step
+
+    load i, A
+    mov B, 0
+    push 0
+    call assert_eq
+    ret
+
+// each tick moves to the next step and plays its note for one tick if the step is active
+test_plays_active_steps:
+    push 0x7f
+    push 49
+    push 0x90
+    push 3
+    call expect_midi
+
+    push 0x00
+    push 49
+    push 0x80
+    push 3
+    call expect_midi
+
+    push 0x7f
+    push 56
+    push 0x90
+    push 3
+    call expect_midi
+
+    mov A, 3
+    push 0
+    call run_ticks
+    ret
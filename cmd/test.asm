@@ -46,29 +46,20 @@ start:
     mov A, 4
     store A, midi_ppqn
 loop:
+    wait
     jump loop
 
 inc_step:
-    // increment index
+    // increment index and wrap around at length
     load i, A
-    mov B, 1
-    add
-    store A, i
-
-    // check if index == length
+    inc
     load length, B
-    gte
-    jumpz inc_step_end
-
-    // reset
-    mov A, 0
+    mod
     store A, i
-
-    inc_step_end:
     ret
 
 on_tick: 
-    push 1
+    push 0
     call inc_step
     
     // check if step is active
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/andrewesterhuizen/penpal/asmtest"
+	"github.com/andrewesterhuizen/penpal/penpal"
+)
+
+// testCommand runs the tests in the *_test.asm files matched by its arguments, see package asmtest
+func testCommand(args []string) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "print each test as it runs and passes")
+	run := flags.String("run", "", "only run the tests with names matching the regular expression")
+	budget := flags.Int("budget", asmtest.DefaultBudget, "number of instructions a test routine can execute before it fails")
+	clockSpeed := flags.Int("clock", penpal.DefaultClockSpeed, "number of cycles executed per second of program time")
+	seed := flags.Int64("seed", 1, "seed of the random number generator")
+	flags.Parse(args)
+
+	config := asmtest.Config{
+		Verbose:    *verbose,
+		Budget:     *budget,
+		ClockSpeed: *clockSpeed,
+		Seed:       *seed,
+	}
+
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		config.Run = re
+	}
+
+	patterns := flags.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+
+	passed, err := asmtest.Run(os.Stdout, patterns, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !passed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// watchFlags collects the -watch flags of the run command
+type watchFlags []string
+
+func (w *watchFlags) String() string {
+	return strings.Join(*w, ",")
+}
+
+func (w *watchFlags) Set(s string) error {
+	*w = append(*w, s)
+	return nil
+}
+
+// watchSpec is a parsed -watch flag
+type watchSpec struct {
+	name  string
+	kind  vm.WatchKind
+	start uint16
+	end   uint16
+}
+
+var watchKindsByLetter = map[rune]vm.WatchKind{
+	'r': vm.WatchRead,
+	'w': vm.WatchWrite,
+	'c': vm.WatchChange,
+}
+
+// parseWatch parses [kinds:]target where kinds is any of r (read), w (write) and c (change), defaulting to w.
+// target is a label, which watches up to the next label, label[n] for n bytes from a label,
+// an address or a range of addresses start-end where end is exclusive.
+func parseWatch(s string, info assembler.ProgramInfo) (watchSpec, error) {
+	spec := watchSpec{name: s, kind: vm.WatchWrite}
+	target := s
+
+	if i := strings.Index(s, ":"); i >= 0 {
+		spec.kind = 0
+		target = s[i+1:]
+
+		for _, r := range s[:i] {
+			kind, exists := watchKindsByLetter[r]
+			if !exists {
+				return spec, fmt.Errorf("unknown watch kind %c in %s, expected r, w or c", r, s)
+			}
+
+			spec.kind |= kind
+		}
+	}
+
+	spec.name = target
+
+	// label[n]
+	if i := strings.Index(target, "["); i >= 0 && strings.HasSuffix(target, "]") {
+		start, exists := info.Labels[target[:i]]
+		if !exists {
+			return spec, fmt.Errorf("no definition found for label %s", target[:i])
+		}
+
+		n, err := strconv.ParseUint(target[i+1:len(target)-1], 0, 16)
+		if err != nil {
+			return spec, err
+		}
+
+		spec.start, spec.end = start, start+uint16(n)
+		return spec, nil
+	}
+
+	// start-end
+	if i := strings.Index(target, "-"); i >= 0 {
+		start, err := strconv.ParseUint(target[:i], 0, 16)
+		if err != nil {
+			return spec, err
+		}
+
+		end, err := strconv.ParseUint(target[i+1:], 0, 16)
+		if err != nil {
+			return spec, err
+		}
+
+		spec.start, spec.end = uint16(start), uint16(end)
+		return spec, nil
+	}
+
+	if addr, err := strconv.ParseUint(target, 0, 16); err == nil {
+		spec.start, spec.end = uint16(addr), uint16(addr)+1
+		return spec, nil
+	}
+
+	start, end, exists := info.LabelRange(target)
+	if !exists {
+		return spec, fmt.Errorf("no definition found for label %s", target)
+	}
+
+	spec.start, spec.end = start, end
+	return spec, nil
+}
+
+// addWatches adds a watchpoint for each -watch flag that prints its hits with symbolized addresses
+func addWatches(v *vm.VM, watches []string, info assembler.ProgramInfo) error {
+	for _, w := range watches {
+		spec, err := parseWatch(w, info)
+		if err != nil {
+			return err
+		}
+
+		name := spec.name
+
+		v.Watch(spec.start, spec.end, spec.kind, func(hit vm.WatchHit) {
+			if hit.Kind == vm.WatchRead {
+				fmt.Printf("watch %s: read 0x%02x from %s at %s\n", name, hit.New, info.Symbolize(hit.Addr), info.Symbolize(hit.IP))
+				return
+			}
+
+			fmt.Printf("watch %s: %s 0x%02x -> 0x%02x to %s at %s\n", name, hit.Kind, hit.Old, hit.New, info.Symbolize(hit.Addr), info.Symbolize(hit.IP))
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+// Package coverage maps the instructions and branches executed by a program, recorded with vm.StartCoverage,
+// to the lines of its source
+package coverage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/instructions"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// Line is the coverage of a line of source that assembled to an instruction, Taken and NotTaken
+// are only counted for conditional jumps
+type Line struct {
+	Line        int
+	Instruction byte
+	Count       uint64
+	Taken       uint64
+	NotTaken    uint64
+}
+
+// IsBranch returns true if the line is a conditional jump, which has a taken and a not taken branch
+func (l Line) IsBranch() bool {
+	return instructions.ConditionalJumps[l.Instruction]
+}
+
+// File is the coverage of the lines of a source file in line order
+type File struct {
+	Name  string
+	Lines []Line
+}
+
+// LinesHit returns the number of lines that were executed and the number of lines
+func (f File) LinesHit() (hit int, total int) {
+	for _, l := range f.Lines {
+		if l.Count > 0 {
+			hit++
+		}
+	}
+
+	return hit, len(f.Lines)
+}
+
+// BranchesHit returns the number of branches that were taken and the number of branches
+func (f File) BranchesHit() (hit int, total int) {
+	for _, l := range f.Lines {
+		if !l.IsBranch() {
+			continue
+		}
+
+		total += 2
+
+		if l.Taken > 0 {
+			hit++
+		}
+
+		if l.NotTaken > 0 {
+			hit++
+		}
+	}
+
+	return hit, total
+}
+
+// Files returns the coverage of each source file of the program in name order, lines of data are left out
+func Files(c *vm.Coverage, info assembler.ProgramInfo) []File {
+	type key struct {
+		file string
+		line int
+	}
+
+	lines := map[key]*Line{}
+	names := map[string][]int{}
+
+	for _, s := range info.Lines {
+		if s.Instruction == instructions.Db || s.Instruction == instructions.Dw {
+			continue
+		}
+
+		k := key{s.File, s.Line}
+
+		l, exists := lines[k]
+		if !exists {
+			l = &Line{Line: s.Line, Instruction: s.Instruction}
+			lines[k] = l
+			names[s.File] = append(names[s.File], s.Line)
+		}
+
+		l.Count += c.Executed[s.Start]
+		l.Taken += c.Taken[s.Start]
+		l.NotTaken += c.NotTaken[s.Start]
+	}
+
+	files := []File{}
+
+	for name, numbers := range names {
+		sort.Ints(numbers)
+
+		f := File{Name: name}
+		for _, n := range numbers {
+			f.Lines = append(f.Lines, *lines[key{name, n}])
+		}
+
+		files = append(files, f)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	return files
+}
+
+func percent(hit int, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+
+	return float64(hit) * 100 / float64(total)
+}
+
+// WriteText writes a summary of each file followed by the lines that were not executed
+// and the branches that were never or always taken
+func WriteText(w io.Writer, files []File) {
+	for _, f := range files {
+		hit, total := f.LinesHit()
+		branchesHit, branches := f.BranchesHit()
+
+		fmt.Fprintf(w, "%s: %d of %d lines (%.1f%%)", f.Name, hit, total, percent(hit, total))
+
+		if branches > 0 {
+			fmt.Fprintf(w, ", %d of %d branches (%.1f%%)", branchesHit, branches, percent(branchesHit, branches))
+		}
+
+		fmt.Fprintln(w)
+
+		for _, l := range f.Lines {
+			name := instructions.Names[l.Instruction]
+
+			switch {
+			case l.Count == 0:
+				fmt.Fprintf(w, "    %s:%d: %s not executed\n", f.Name, l.Line, name)
+			case l.IsBranch() && l.Taken == 0:
+				fmt.Fprintf(w, "    %s:%d: %s never taken\n", f.Name, l.Line, name)
+			case l.IsBranch() && l.NotTaken == 0:
+				fmt.Fprintf(w, "    %s:%d: %s always taken\n", f.Name, l.Line, name)
+			}
+		}
+	}
+}
+
+// WriteLcov writes the coverage in the lcov tracefile format read by genhtml and most editors
+func WriteLcov(w io.Writer, files []File) {
+	for _, f := range files {
+		fmt.Fprintln(w, "TN:")
+		fmt.Fprintf(w, "SF:%s\n", f.Name)
+
+		for _, l := range f.Lines {
+			if !l.IsBranch() {
+				continue
+			}
+
+			// branches of lines that were never executed are written as - rather than 0
+			if l.Count == 0 {
+				fmt.Fprintf(w, "BRDA:%d,0,0,-\nBRDA:%d,0,1,-\n", l.Line, l.Line)
+				continue
+			}
+
+			fmt.Fprintf(w, "BRDA:%d,0,0,%d\nBRDA:%d,0,1,%d\n", l.Line, l.Taken, l.Line, l.NotTaken)
+		}
+
+		branchesHit, branches := f.BranchesHit()
+		fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", branches, branchesHit)
+
+		for _, l := range f.Lines {
+			fmt.Fprintf(w, "DA:%d,%d\n", l.Line, l.Count)
+		}
+
+		hit, total := f.LinesHit()
+		fmt.Fprintf(w, "LF:%d\nLH:%d\n", total, hit)
+		fmt.Fprintln(w, "end_of_record")
+	}
+}
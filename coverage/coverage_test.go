@@ -0,0 +1,83 @@
+package coverage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+const testProgram = `start:
+	mov A, 0
+	jumpz skip
+	halt
+skip:
+	mov A, 1
+	jumpz start
+	halt
+`
+
+func runTestProgram(t *testing.T) []File {
+	a := assembler.New(assembler.Config{InteruptLabels: [3]string{"on_tick", "on_start", "on_stop"}})
+
+	program, err := a.GetProgram("test.asm", testProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := vm.New()
+	v.Load(program)
+	c := v.StartCoverage()
+
+	_, err = v.Run(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Files(c, a.Info())
+}
+
+func TestFiles(t *testing.T) {
+	files := runTestProgram(t)
+
+	if len(files) != 1 || files[0].Name != "test.asm" {
+		t.Fatalf("expected coverage of test.asm, got %v", files)
+	}
+
+	if hit, total := files[0].LinesHit(); hit != 5 || total != 6 {
+		t.Errorf("expected 5 of 6 lines to be hit, got %d of %d", hit, total)
+	}
+
+	if hit, total := files[0].BranchesHit(); hit != 2 || total != 4 {
+		t.Errorf("expected 2 of 4 branches to be hit, got %d of %d", hit, total)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	buf := bytes.Buffer{}
+	WriteText(&buf, runTestProgram(t))
+
+	expected := `test.asm: 5 of 6 lines (83.3%), 2 of 4 branches (50.0%)
+    test.asm:3: jumpz always taken
+    test.asm:4: halt not executed
+    test.asm:7: jumpz never taken
+`
+
+	if buf.String() != expected {
+		t.Errorf("expected report:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestWriteLcov(t *testing.T) {
+	buf := bytes.Buffer{}
+	WriteLcov(&buf, runTestProgram(t))
+
+	for _, line := range []string{"SF:test.asm", "BRDA:3,0,0,1", "BRDA:3,0,1,0", "BRDA:7,0,0,0", "BRDA:7,0,1,1",
+		"BRF:4", "BRH:2", "DA:4,0", "DA:8,1", "LF:6", "LH:5", "end_of_record"} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, buf.String())
+		}
+	}
+}
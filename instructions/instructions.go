@@ -29,7 +29,41 @@ const (
 	Ret
 	Reti
 	Rand
+	Sys
+	Wait
+	Cmp
+	Adc
+	Sbb
+	Jc
+	Jnc
+	Jn
+	Je
+	Jne
+	Load16
+	Store16
+	Add16
+	Sub16
+	Cmp16
+	Inc16
+	Xor
+	Not
+	Mod
+	Inc
+	Dec
+	Neg
+	Rol
+	Ror
+	// jump and call to the address in a word in memory, and call the address popped from the stack.
+	// The register in a table lookup such as (table[A]) is a byte offset, so an index into a table of
+	// words has to be doubled first.
+	JumpIndirect
+	CallIndirect
+	CallStack
+	// pop into a register other than A
+	PopRegister
+	// db and dw declare a byte and a word of data, they aren't executed
 	Db
+	Dw
 
 	Immediate                 = 0x0
 	ImmediatePlusRegister     = 0x1
@@ -39,110 +73,289 @@ const (
 	FramePointerPlusRegister  = 0x5
 	FramePointerMinusRegister = 0x6
 
+	// pointer modes address memory through a word stored at the address, post increment and pre decrement
+	// step the stored pointer by the size of the operand
+	PointerWithOffset    = 0x10
+	PointerPlusRegister  = 0x11
+	PointerPostIncrement = 0x12
+	PointerPreDecrement  = 0x13
+	// PointerInFrame is a flag OR'd into a pointer mode when the pointer is stored at an offset from the frame
+	// pointer, the offset is encoded as a signed word in place of the address. It has the same value as
+	// FramePointerWithOffset but is only ever combined with the pointer modes, which are all 0x10 or above,
+	// so the combined modes 0x14 to 0x17 can't be mistaken for any other mode.
+	PointerInFrame = 0x4
+
 	AddressingModeImmediate  = 0x7
 	AddressingModeFPRelative = 0x8
 
+	// A is the accumulator and return value, B is the operand of the arithmetic instructions and is saved by call.
+	// C and D can be changed by any subroutine so callers save them if they need them, X and Y must be saved by
+	// the subroutines that change them with push and pop. Interupts save every register.
 	RegisterA = 0xa
 	RegisterB = 0xb
+	RegisterC = 0xc
+	RegisterD = 0xd
+	RegisterX = 0xe
+	RegisterY = 0xf
 )
 
 var Names = map[uint8]string{
-	Mov:    "mov",
-	Swap:   "swap",
-	Halt:   "halt",
-	Load:   "load",
-	Store:  "store",
-	Add:    "add",
-	Sub:    "sub",
-	Mul:    "mul",
-	Div:    "div",
-	Shl:    "shl",
-	Shr:    "shr",
-	And:    "and",
-	Or:     "or",
-	GT:     "gt",
-	GTE:    "gte",
-	LT:     "lt",
-	LTE:    "lte",
-	Eq:     "eq",
-	Neq:    "neq",
-	Jump:   "jump",
-	Jumpz:  "jumpz",
-	Jumpnz: "jumpnz",
-	Push:   "push",
-	Pop:    "pop",
-	Call:   "call",
-	Ret:    "ret",
-	Reti:   "reti",
-	Rand:   "rand",
-	Db:     "db",
+	Mov:          "mov",
+	Swap:         "swap",
+	Halt:         "halt",
+	Load:         "load",
+	Store:        "store",
+	Add:          "add",
+	Sub:          "sub",
+	Mul:          "mul",
+	Div:          "div",
+	Shl:          "shl",
+	Shr:          "shr",
+	And:          "and",
+	Or:           "or",
+	GT:           "gt",
+	GTE:          "gte",
+	LT:           "lt",
+	LTE:          "lte",
+	Eq:           "eq",
+	Neq:          "neq",
+	Jump:         "jump",
+	Jumpz:        "jumpz",
+	Jumpnz:       "jumpnz",
+	Push:         "push",
+	Pop:          "pop",
+	Call:         "call",
+	Ret:          "ret",
+	Reti:         "reti",
+	Rand:         "rand",
+	Sys:          "sys",
+	Wait:         "wait",
+	Cmp:          "cmp",
+	Adc:          "adc",
+	Sbb:          "sbb",
+	Jc:           "jc",
+	Jnc:          "jnc",
+	Jn:           "jn",
+	Je:           "je",
+	Jne:          "jne",
+	Load16:       "load16",
+	Store16:      "store16",
+	Add16:        "add16",
+	Sub16:        "sub16",
+	Cmp16:        "cmp16",
+	Inc16:        "inc16",
+	Xor:          "xor",
+	Not:          "not",
+	Mod:          "mod",
+	Inc:          "inc",
+	Dec:          "dec",
+	Neg:          "neg",
+	Rol:          "rol",
+	Ror:          "ror",
+	JumpIndirect: "jump",
+	CallIndirect: "call",
+	CallStack:    "call",
+	PopRegister:  "pop",
+	Db:           "db",
+	Dw:           "dw",
 }
 
 var InstructionByName = map[string]uint8{
-	"mov":    Mov,
-	"swap":   Swap,
-	"halt":   Halt,
-	"load":   Load,
-	"store":  Store,
-	"add":    Add,
-	"sub":    Sub,
-	"mul":    Mul,
-	"div":    Div,
-	"shl":    Shl,
-	"shr":    Shr,
-	"and":    And,
-	"or":     Or,
-	"gt":     GT,
-	"gte":    GTE,
-	"lt":     LT,
-	"lte":    LTE,
-	"eq":     Eq,
-	"neq":    Neq,
-	"jump":   Jump,
-	"jumpz":  Jumpz,
-	"jumpnz": Jumpnz,
-	"push":   Push,
-	"pop":    Pop,
-	"call":   Call,
-	"ret":    Ret,
-	"reti":   Reti,
-	"rand":   Rand,
-	"db":     Db,
+	"mov":     Mov,
+	"swap":    Swap,
+	"halt":    Halt,
+	"load":    Load,
+	"store":   Store,
+	"add":     Add,
+	"sub":     Sub,
+	"mul":     Mul,
+	"div":     Div,
+	"shl":     Shl,
+	"shr":     Shr,
+	"and":     And,
+	"or":      Or,
+	"gt":      GT,
+	"gte":     GTE,
+	"lt":      LT,
+	"lte":     LTE,
+	"eq":      Eq,
+	"neq":     Neq,
+	"jump":    Jump,
+	"jumpz":   Jumpz,
+	"jumpnz":  Jumpnz,
+	"push":    Push,
+	"pop":     Pop,
+	"call":    Call,
+	"ret":     Ret,
+	"reti":    Reti,
+	"rand":    Rand,
+	"sys":     Sys,
+	"wait":    Wait,
+	"cmp":     Cmp,
+	"adc":     Adc,
+	"sbb":     Sbb,
+	"jc":      Jc,
+	"jnc":     Jnc,
+	"jn":      Jn,
+	"je":      Je,
+	"jne":     Jne,
+	"load16":  Load16,
+	"store16": Store16,
+	"add16":   Add16,
+	"sub16":   Sub16,
+	"cmp16":   Cmp16,
+	"inc16":   Inc16,
+	"xor":     Xor,
+	"not":     Not,
+	"mod":     Mod,
+	"inc":     Inc,
+	"dec":     Dec,
+	"neg":     Neg,
+	"rol":     Rol,
+	"ror":     Ror,
+	"db":      Db,
+	"dw":      Dw,
 }
 
 var Width = map[uint8]int{
-	Mov:    3,
-	Swap:   1,
-	Halt:   1,
-	Load:   6,
-	Store:  6,
-	Add:    1,
-	Sub:    1,
-	Mul:    1,
-	Div:    1,
-	Shl:    1,
-	Shr:    1,
-	And:    1,
-	Or:     1,
-	GT:     1,
-	GTE:    1,
-	LT:     1,
-	LTE:    1,
-	Eq:     1,
-	Neq:    1,
-	Jump:   3,
-	Jumpz:  3,
-	Jumpnz: 3,
-	Push:   3,
-	Pop:    1,
-	Call:   3,
-	Ret:    1,
-	Reti:   1,
-	Rand:   1,
-	Db:     1,
+	Mov:          3,
+	Swap:         1,
+	Halt:         1,
+	Load:         6,
+	Store:        6,
+	Add:          1,
+	Sub:          1,
+	Mul:          1,
+	Div:          1,
+	Shl:          1,
+	Shr:          1,
+	And:          1,
+	Or:           1,
+	GT:           1,
+	GTE:          1,
+	LT:           1,
+	LTE:          1,
+	Eq:           1,
+	Neq:          1,
+	Jump:         3,
+	Jumpz:        3,
+	Jumpnz:       3,
+	Push:         3,
+	Pop:          1,
+	Call:         3,
+	Ret:          1,
+	Reti:         1,
+	Rand:         1,
+	Sys:          2,
+	Wait:         1,
+	Cmp:          1,
+	Adc:          1,
+	Sbb:          1,
+	Jc:           3,
+	Jnc:          3,
+	Jn:           3,
+	Je:           3,
+	Jne:          3,
+	Load16:       5,
+	Store16:      5,
+	Add16:        5,
+	Sub16:        5,
+	Cmp16:        5,
+	Inc16:        1,
+	Xor:          1,
+	Not:          1,
+	Mod:          1,
+	Inc:          1,
+	Dec:          1,
+	Neg:          1,
+	Rol:          1,
+	Ror:          1,
+	JumpIndirect: 5,
+	CallIndirect: 5,
+	CallStack:    1,
+	PopRegister:  2,
+	Db:           1,
+	Dw:           2,
+}
+
+// Cycles is the number of cycles taken to execute each instruction
+var Cycles = map[uint8]int{
+	Mov:          2,
+	Swap:         1,
+	Halt:         1,
+	Load:         4,
+	Store:        4,
+	Add:          1,
+	Sub:          1,
+	Mul:          4,
+	Div:          8,
+	Shl:          1,
+	Shr:          1,
+	And:          1,
+	Or:           1,
+	GT:           1,
+	GTE:          1,
+	LT:           1,
+	LTE:          1,
+	Eq:           1,
+	Neq:          1,
+	Jump:         3,
+	Jumpz:        3,
+	Jumpnz:       3,
+	Push:         3,
+	Pop:          2,
+	Call:         8,
+	Ret:          8,
+	Reti:         9,
+	Rand:         2,
+	Sys:          10,
+	Wait:         1,
+	Cmp:          1,
+	Adc:          1,
+	Sbb:          1,
+	Jc:           3,
+	Jnc:          3,
+	Jn:           3,
+	Je:           3,
+	Jne:          3,
+	Load16:       5,
+	Store16:      5,
+	Add16:        5,
+	Sub16:        5,
+	Cmp16:        5,
+	Inc16:        2,
+	Xor:          1,
+	Not:          1,
+	Mod:          8,
+	Inc:          1,
+	Dec:          1,
+	Neg:          1,
+	Rol:          1,
+	Ror:          1,
+	JumpIndirect: 5,
+	CallIndirect: 10,
+	CallStack:    10,
+	PopRegister:  2,
+	Db:           1,
+	Dw:           1,
+}
+
+// ConditionalJumps are the jumps that either jump or continue with the next instruction depending on the registers or flags
+var ConditionalJumps = map[uint8]bool{
+	Jumpz:  true,
+	Jumpnz: true,
+	Jc:     true,
+	Jnc:    true,
+	Jn:     true,
+	Je:     true,
+	Jne:    true,
 }
 
 var RegistersByName = map[string]uint8{
 	"A": RegisterA,
 	"B": RegisterB,
+	"C": RegisterC,
+	"D": RegisterD,
+	"X": RegisterX,
+	"Y": RegisterY,
 }
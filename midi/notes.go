@@ -0,0 +1,99 @@
+package midi
+
+import "sync"
+
+const (
+	NoteOff       = 0x80
+	NoteOn        = 0x90
+	ControlChange = 0xb0
+
+	AllSoundOff = 120
+	AllNotesOff = 123
+)
+
+// NotesOffMode selects how a TrackingMidiHandler releases notes
+type NotesOffMode int
+
+const (
+	// NotesOffModeNoteOff sends a note off for each note that is on
+	NotesOffModeNoteOff NotesOffMode = iota
+	// NotesOffModeControlChange sends all notes off (CC 123) and all sound off (CC 120) on every channel,
+	// for synths that might have missed note messages
+	NotesOffModeControlChange
+)
+
+// TrackingMidiHandler wraps a MidiHandler and keeps track of the notes that are on for each channel
+// so that they can be released when the program stops
+type TrackingMidiHandler struct {
+	MidiHandler
+
+	mode  NotesOffMode
+	mutex sync.Mutex
+	notes [16][128]bool
+}
+
+func NewTrackingMidiHandler(h MidiHandler, mode NotesOffMode) *TrackingMidiHandler {
+	return &TrackingMidiHandler{MidiHandler: h, mode: mode}
+}
+
+func (t *TrackingMidiHandler) Send(status byte, data1 byte, data2 byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	channel := status & 0x0f
+	note := data1 & 0x7f
+
+	switch status & 0xf0 {
+	case NoteOn:
+		// a note on with a velocity of 0 is a note off
+		t.notes[channel][note] = data2 > 0
+	case NoteOff:
+		t.notes[channel][note] = false
+	}
+
+	t.MidiHandler.Send(status, data1, data2)
+}
+
+// AllNotesOff releases every note that is on
+func (t *TrackingMidiHandler) AllNotesOff() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for channel := range t.notes {
+		status := byte(channel)
+
+		if t.mode == NotesOffModeControlChange {
+			t.MidiHandler.Send(ControlChange|status, AllNotesOff, 0)
+			t.MidiHandler.Send(ControlChange|status, AllSoundOff, 0)
+		}
+
+		for note, on := range t.notes[channel] {
+			if !on {
+				continue
+			}
+
+			if t.mode == NotesOffModeNoteOff {
+				t.MidiHandler.Send(NoteOff|status, byte(note), 0)
+			}
+
+			t.notes[channel][note] = false
+		}
+	}
+}
+
+// ActiveNotes returns the number of notes that are on
+func (t *TrackingMidiHandler) ActiveNotes() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := 0
+	for channel := range t.notes {
+		for _, on := range t.notes[channel] {
+			if on {
+				n++
+			}
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,56 @@
+package midi
+
+import "testing"
+
+func TestTrackingMidiHandler_AllNotesOff_SendsNoteOffs(t *testing.T) {
+	h := &RecordingMidiHandler{}
+	tracker := NewTrackingMidiHandler(h, NotesOffModeNoteOff)
+
+	tracker.Send(NoteOn|0x0, 60, 100)
+	tracker.Send(NoteOn|0x0, 62, 100)
+	tracker.Send(NoteOn|0x3, 64, 100)
+	tracker.Send(NoteOff|0x0, 60, 0)
+	// a note on with a velocity of 0 is a note off
+	tracker.Send(NoteOn|0x0, 62, 0)
+
+	if n := tracker.ActiveNotes(); n != 1 {
+		t.Errorf("expected 1 active note, got %d", n)
+	}
+
+	h.Messages = nil
+	tracker.AllNotesOff()
+
+	if len(h.Messages) != 1 || h.Messages[0] != (MidiMessage{NoteOff | 0x3, 64, 0}) {
+		t.Errorf("expected a single note off for note 64 on channel 4, got %v", h.Messages)
+	}
+
+	if n := tracker.ActiveNotes(); n != 0 {
+		t.Errorf("expected no active notes after AllNotesOff, got %d", n)
+	}
+}
+
+func TestTrackingMidiHandler_AllNotesOff_ControlChangeMode(t *testing.T) {
+	h := &RecordingMidiHandler{}
+	tracker := NewTrackingMidiHandler(h, NotesOffModeControlChange)
+
+	tracker.Send(NoteOn, 60, 100)
+
+	h.Messages = nil
+	tracker.AllNotesOff()
+
+	if len(h.Messages) != 32 {
+		t.Fatalf("expected all notes off and all sound off for 16 channels, got %d messages", len(h.Messages))
+	}
+
+	for channel := 0; channel < 16; channel++ {
+		status := byte(ControlChange | channel)
+
+		if h.Messages[channel*2] != (MidiMessage{status, AllNotesOff, 0}) {
+			t.Errorf("expected all notes off on channel %d, got %v", channel+1, h.Messages[channel*2])
+		}
+
+		if h.Messages[channel*2+1] != (MidiMessage{status, AllSoundOff, 0}) {
+			t.Errorf("expected all sound off on channel %d, got %v", channel+1, h.Messages[channel*2+1])
+		}
+	}
+}
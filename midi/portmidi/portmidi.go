@@ -0,0 +1,85 @@
+// Package portmidi sends and receives midi messages through the PortMidi library
+package portmidi
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/andrewesterhuizen/penpal/midi"
+	pm "github.com/rakyll/portmidi"
+)
+
+// MidiHandler is a midi.MidiHandler for the devices available to PortMidi
+type MidiHandler struct {
+	midi             *pm.Stream
+	input            *pm.Stream
+	bpm              int
+	ppqn             int
+	clockRunning     bool
+	getMidiClockData *func() (uint8, uint8)
+	tick             *func()
+}
+
+// NewMidiHandler opens the default output device
+func NewMidiHandler() midi.MidiHandler {
+	pm.Initialize()
+
+	out, err := pm.NewOutputStream(1, 1024, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return &MidiHandler{midi: out}
+}
+
+func (m *MidiHandler) GetDevices() (inputs []midi.Device, outputs []midi.Device) {
+	n := pm.CountDevices()
+
+	inputs = []midi.Device{}
+	outputs = []midi.Device{}
+
+	for i := 0; i < n; i++ {
+		device := pm.Info(pm.DeviceID(i))
+		if device.IsInputAvailable {
+			inputs = append(inputs, midi.Device{Id: i, Name: device.Name})
+		}
+		if device.IsOutputAvailable {
+			outputs = append(outputs, midi.Device{Id: i, Name: device.Name})
+		}
+	}
+
+	return inputs, outputs
+}
+
+func (m *MidiHandler) Send(status byte, data1 byte, data2 byte) {
+	m.midi.WriteShort(int64(status), int64(data1), int64(data2))
+	fmt.Printf("SEND %02x|%02x|%02x\n", status, data1, data2)
+}
+
+// Listen opens the input device and returns a channel that receives its messages
+func (m *MidiHandler) Listen(deviceId int) (<-chan midi.MidiMessage, error) {
+	in, err := pm.NewInputStream(pm.DeviceID(deviceId), 1024)
+	if err != nil {
+		return nil, err
+	}
+
+	m.input = in
+
+	messages := make(chan midi.MidiMessage)
+
+	go func() {
+		for e := range in.Listen() {
+			messages <- midi.MidiMessage{byte(e.Status), byte(e.Data1), byte(e.Data2)}
+		}
+	}()
+
+	return messages, nil
+}
+
+func (m *MidiHandler) Close() {
+	m.midi.Close()
+
+	if m.input != nil {
+		m.input.Close()
+	}
+}
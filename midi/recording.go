@@ -0,0 +1,28 @@
+package midi
+
+// RecordingMidiHandler records the messages sent to it instead of sending them to a device,
+// it is used to run programs in tests and by the test runner
+type RecordingMidiHandler struct {
+	Messages []MidiMessage
+	// OnSend is called with each message after it is recorded if it is set
+	OnSend func(m MidiMessage)
+}
+
+func (h *RecordingMidiHandler) Send(status byte, data1 byte, data2 byte) {
+	m := MidiMessage{status, data1, data2}
+	h.Messages = append(h.Messages, m)
+
+	if h.OnSend != nil {
+		h.OnSend(m)
+	}
+}
+
+func (h *RecordingMidiHandler) Listen(deviceId int) (<-chan MidiMessage, error) {
+	return make(chan MidiMessage), nil
+}
+
+func (h *RecordingMidiHandler) Close() {}
+
+func (h *RecordingMidiHandler) GetDevices() (inputs []Device, outputs []Device) {
+	return nil, nil
+}
@@ -0,0 +1,173 @@
+package penpal
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// timeSlice is the host time between checks of the clock, commands and throttling
+const timeSlice = time.Millisecond
+
+// cycleTime returns the program time taken to execute n cycles
+func (r *Runtime) cycleTime(n uint64) time.Duration {
+	return time.Duration(float64(n) * float64(time.Second) / float64(r.config.ClockSpeed))
+}
+
+// budget returns the number of cycles to execute before the runtime next checks the clock
+func (r *Runtime) budget() uint64 {
+	budget := uint64(float64(r.config.ClockSpeed) * timeSlice.Seconds())
+
+	if d, ok := r.untilNextTick(); ok {
+		untilTick := uint64(math.Ceil(d.Seconds() * float64(r.config.ClockSpeed)))
+		if untilTick < budget {
+			budget = untilTick
+		}
+	}
+
+	if budget < 1 {
+		budget = 1
+	}
+
+	return budget
+}
+
+// advance moves program time forward by the time taken to execute n cycles
+func (r *Runtime) advance(n uint64) {
+	r.now += r.cycleTime(n)
+}
+
+// tickCycles returns the number of cycles in one clock tick at the current tempo
+func (r *Runtime) tickCycles() uint64 {
+	bpm := uint64(r.vm.GetMemory(midiBPMAddress))
+	ppqn := uint64(r.vm.GetMemory(midiPPQNAddress))
+
+	if bpm == 0 || ppqn == 0 {
+		return 0
+	}
+
+	return uint64(r.config.ClockSpeed) * 60 / (bpm * ppqn)
+}
+
+// checkInteruptCycles warns when an interupt handler uses more cycles than its budget,
+// an on_tick handler that takes longer than a clock tick delays the ticks that follow it
+func (r *Runtime) checkInteruptCycles(n int, cycles uint64) {
+	if cycles > r.stats.MaxInteruptCycles[n] {
+		r.stats.MaxInteruptCycles[n] = cycles
+	}
+
+	budget := uint64(r.config.InteruptCycleBudget)
+	if budget == 0 {
+		budget = r.tickCycles()
+	}
+
+	if budget == 0 || cycles <= budget {
+		return
+	}
+
+	if r.stats.InteruptOverruns[n] == 0 {
+		log.Printf("warning: %s took %d cycles, which is more than the budget of %d cycles", InteruptLabels[n], cycles, budget)
+	}
+
+	r.stats.InteruptOverruns[n]++
+}
+
+// throttle keeps program time in step with host time, sleeping if the program is ahead.
+// If the host can't keep up program time is moved forward so that the clock isn't delayed.
+func (r *Runtime) throttle() {
+	if r.config.Unthrottled {
+		return
+	}
+
+	ahead := r.now - time.Since(r.start)
+
+	if ahead > 0 {
+		time.Sleep(ahead)
+	} else {
+		r.now -= ahead
+	}
+}
+
+// waitForInterupt parks the runtime until the next clock tick is due or a command is received
+func (r *Runtime) waitForInterupt() {
+	d, ok := r.untilNextTick()
+
+	// nothing can wake the VM until the next tick, so in unthrottled mode there is nothing to wait for
+	if ok && r.config.Unthrottled {
+		r.now += d
+		return
+	}
+
+	idleStart := time.Now()
+	defer func() { r.stats.Idle += time.Since(idleStart) }()
+
+	var tick <-chan time.Time
+
+	if ok {
+		timer := time.NewTimer(time.Until(r.start.Add(r.now + d)))
+		defer timer.Stop()
+
+		tick = timer.C
+	}
+
+	select {
+	case command := <-r.commands:
+		command()
+
+	case <-tick:
+	}
+
+	if !r.config.Unthrottled {
+		r.now = time.Since(r.start)
+	}
+}
+
+// untilNextTick returns the program time until the next clock tick, ok is false if the clock is not running
+func (r *Runtime) untilNextTick() (d time.Duration, ok bool) {
+	if r.state != TransportPlaying {
+		return 0, false
+	}
+
+	if r.vm.GetMemory(midiBPMAddress) == 0 || r.vm.GetMemory(midiPPQNAddress) == 0 {
+		return 0, false
+	}
+
+	if !r.clockStarted || r.nextTick <= r.now {
+		return 0, true
+	}
+
+	return r.nextTick - r.now, true
+}
+
+// clock raises the tick interupt at the rate set by the program's bpm and ppqn
+func (r *Runtime) clock() {
+	if r.state != TransportPlaying {
+		return
+	}
+
+	bpm := int(r.vm.GetMemory(midiBPMAddress))
+	ppqn := int(r.vm.GetMemory(midiPPQNAddress))
+
+	if bpm == 0 || ppqn == 0 {
+		return
+	}
+
+	if !r.clockStarted {
+		r.nextTick = r.now
+		r.clockStarted = true
+	}
+
+	if r.now < r.nextTick {
+		return
+	}
+
+	r.releaseScheduledNotes()
+
+	// the song position register holds the position of the tick being handled
+	r.setSongPosition(r.position)
+	r.vm.Interupt(InteruptTick)
+	r.position++
+	r.ticks++
+
+	r.nextTick += time.Minute / time.Duration(bpm*ppqn)
+}
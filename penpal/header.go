@@ -1,18 +1,105 @@
 package penpal
 
-import "bytes"
+import (
+	"bytes"
+	"fmt"
 
-// HeaderSize is the size of the binary header in bytes
-const HeaderSize = 8
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// HeaderSize is the size of the fixed part of the binary header in bytes,
+// it's followed by 2 bytes with the number of regions and 5 bytes for each region
+const HeaderSize = 10
+
+// regionSize is the size of each region in the header: kind, start and end
+const regionSize = 5
+
+// legacyHeaderSize is the size of the version 0.1 header, which has no stack size
+const legacyHeaderSize = 8
+
+const headerMagic = "PENPAL"
+
+// Header is the information stored with a compiled program
+type Header struct {
+	// StackSize is the size of the stack declared by the program, 0 if it wasn't declared
+	StackSize uint16
+	// Regions is the kind of each range of the program's bytes
+	Regions []vm.Region
+}
 
 // GetHeaderBytes returns bytes of the header to be added to the start of a penpal program
-func GetHeaderBytes() []byte {
+func GetHeaderBytes(header Header) []byte {
 	buf := bytes.Buffer{}
 
-	buf.WriteString("PENPAL") // program
+	buf.WriteString(headerMagic) // program
 
 	buf.WriteByte(0) // version major
-	buf.WriteByte(1) // version minor
+	buf.WriteByte(2) // version minor
+
+	writeUint16(&buf, header.StackSize)
+	writeUint16(&buf, uint16(len(header.Regions)))
+
+	for _, r := range header.Regions {
+		buf.WriteByte(byte(r.Kind))
+		writeUint16(&buf, r.Start)
+		writeUint16(&buf, r.End)
+	}
 
 	return buf.Bytes()
 }
+
+func writeUint16(buf *bytes.Buffer, n uint16) {
+	buf.WriteByte(byte(n >> 8))
+	buf.WriteByte(byte(n & 0xff))
+}
+
+func readUint16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// IsCompiled returns true if b starts with a penpal header
+func IsCompiled(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(headerMagic))
+}
+
+// ReadHeader returns the header of a compiled program and the program that follows it
+func ReadHeader(b []byte) (Header, []byte, error) {
+	if !IsCompiled(b) || len(b) < legacyHeaderSize {
+		return Header{}, nil, fmt.Errorf("program does not have a penpal header")
+	}
+
+	major, minor := b[6], b[7]
+
+	switch {
+	case major == 0 && minor == 1:
+		return Header{}, b[legacyHeaderSize:], nil
+
+	case major == 0 && minor == 2:
+		if len(b) < HeaderSize+2 {
+			return Header{}, nil, fmt.Errorf("header is truncated")
+		}
+
+		header := Header{StackSize: readUint16(b[8:])}
+		n := int(readUint16(b[HeaderSize:]))
+		pos := HeaderSize + 2
+
+		if len(b) < pos+n*regionSize {
+			return Header{}, nil, fmt.Errorf("header is truncated")
+		}
+
+		for i := 0; i < n; i++ {
+			header.Regions = append(header.Regions, vm.Region{
+				Kind:  vm.RegionKind(b[pos]),
+				Start: readUint16(b[pos+1:]),
+				End:   readUint16(b[pos+3:]),
+			})
+
+			pos += regionSize
+		}
+
+		return header, b[pos:], nil
+
+	default:
+		return Header{}, nil, fmt.Errorf("unsupported program version %d.%d", major, minor)
+	}
+}
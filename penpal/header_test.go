@@ -0,0 +1,63 @@
+package penpal
+
+import (
+	"testing"
+
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+func TestHeader_RoundTrip(t *testing.T) {
+	regions := []vm.Region{
+		{Kind: vm.RegionCode, Start: 0x0000, End: 0x000c},
+		{Kind: vm.RegionROData, Start: 0x000c, End: 0x0010},
+	}
+
+	compiled := append(GetHeaderBytes(Header{StackSize: 0x0120, Regions: regions}), 0x01, 0x02)
+
+	header, program, err := ReadHeader(compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.StackSize != 0x0120 {
+		t.Errorf("expected stack size 0x0120 and got 0x%04x", header.StackSize)
+	}
+
+	if len(header.Regions) != len(regions) {
+		t.Fatalf("expected %d regions and got %d", len(regions), len(header.Regions))
+	}
+
+	for i, r := range regions {
+		if header.Regions[i] != r {
+			t.Errorf("expected region %v and got %v", r, header.Regions[i])
+		}
+	}
+
+	if len(program) != 2 || program[0] != 0x01 || program[1] != 0x02 {
+		t.Errorf("expected program [1 2] and got %v", program)
+	}
+}
+
+func TestHeader_ReadsVersion01(t *testing.T) {
+	compiled := []byte{'P', 'E', 'N', 'P', 'A', 'L', 0, 1, 0x01}
+
+	header, program, err := ReadHeader(compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.StackSize != 0 {
+		t.Errorf("expected no stack size and got 0x%04x", header.StackSize)
+	}
+
+	if len(program) != 1 || program[0] != 0x01 {
+		t.Errorf("expected program [1] and got %v", program)
+	}
+}
+
+func TestHeader_UnsupportedVersion_ReturnsError(t *testing.T) {
+	_, _, err := ReadHeader([]byte{'P', 'E', 'N', 'P', 'A', 'L', 1, 0, 0, 0})
+	if err == nil {
+		t.Error("expected error for unsupported version")
+	}
+}
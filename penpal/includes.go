@@ -6,9 +6,11 @@ import (
 )
 
 var midiNoteIncludeTemplateText = `
+.rodata
 {{ range $key, $value := . }}
 midi_note_{{ $key }}: db {{ $value -}}
 {{ end }}
+.data
 `
 var midiNoteIncludeTemplateData = map[string]int{
 	"C1":   24,
@@ -26,6 +28,8 @@ var midiNoteIncludeTemplateData = map[string]int{
 }
 
 var midiIncludeTemplateText = `
+// registers shared with the runtime
+.io
 midi_clock_enable: db 1
 midi_bpm: db 120
 midi_ppqn: db 2
@@ -34,16 +38,30 @@ midi_data1: db 0
 midi_data2: db 0
 midi_send_bit: db 0
 
+// transport state: 0 = stopped, 1 = playing, 2 = paused
+midi_transport_state: db 0
+// song position in clock ticks since the start of bar 0 (high byte, low byte)
+midi_song_position: db 0
+	db 0
+
+// note scheduler: setting midi_schedule_bit sends a note on and
+// the matching note off is sent after midi_schedule_length clock ticks
+midi_schedule_note: db 0
+midi_schedule_velocity: db 0
+midi_schedule_channel: db 0
+midi_schedule_length: db 0
+midi_schedule_bit: db 0
+.data
+
 // args: (status, data1, data2)
 midi_send_message:
-	load (fp+7), A
-	store A, midi_status
-	load (fp+8), A
-	store A, midi_data1
 	load (fp+9), A
-	store A, midi_data2
-	mov A, 1
-	store A, midi_send_bit
+	push
+	load (fp+8), A
+	push
+	load (fp+7), A
+	push
+	sys 0x01
 	ret
 
 // args: (note, velocity)
@@ -62,26 +80,39 @@ midi_note_off:
 	load (fp+8), A
 	push
 	load (fp+7), A
+	push
 	push 0x80
 	push 0x3
 	call midi_send_message
 	ret
 
+// sends a note on and schedules the note off after length clock ticks
+// args: (note, velocity, channel, length)
+midi_play:
+	load (fp+10), A
+	push
+	load (fp+9), A
+	push
+	load (fp+8), A
+	push
+	load (fp+7), A
+	push
+	sys 0x02
+	ret
+
+// plays a note for one clock tick
 // args: (note)
 midi_trig:
 	load (fp+7), A
 
+	push 1
+	push 0
 	push 0x7f
 	push
-	push 2
-	call midi_note_on
+	push 4
+	call midi_play
 
-	push 0x7f
-	push
-	push 2
-	call midi_note_off
-
-    ret
+	ret
 `
 
 func getIncludeTemplate(name string, templateText string, data interface{}) (string, error) {
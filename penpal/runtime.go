@@ -0,0 +1,294 @@
+package penpal
+
+import (
+	"time"
+
+	"github.com/andrewesterhuizen/penpal/midi"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// addresses of the memory mapped registers at the start of the <midi> system include,
+// these assume that <midi> is the first include in the program
+const (
+	midiBPMAddress            = 0x0d
+	midiPPQNAddress           = 0x0e
+	midiStatusAddress         = 0x0f
+	midiSendBitAddress        = 0x12
+	midiTransportStateAddress = 0x13
+	midiSongPositionAddress   = 0x14
+	midiScheduleNoteAddress   = 0x16
+	midiScheduleBitAddress    = 0x1a
+)
+
+// interupts raised by the runtime
+const (
+	InteruptTick = iota
+	InteruptStart
+	InteruptStop
+)
+
+// InteruptLabels are the labels of the handlers for the interupts raised by the runtime
+var InteruptLabels = [3]string{"on_tick", "on_start", "on_stop"}
+
+type RuntimeConfig struct {
+	// Stopped leaves the transport stopped when the runtime starts instead of starting playback
+	Stopped bool
+	// NotesOffMode selects how notes that are still on are released when the transport stops or the program ends
+	NotesOffMode midi.NotesOffMode
+	// ClockSpeed is the target number of cycles executed per second, DefaultClockSpeed is used if it is 0
+	ClockSpeed int
+	// Unthrottled executes instructions as fast as possible. The clock follows the time the program would have
+	// taken at ClockSpeed, so the output is the same as a throttled run, which is useful for offline rendering and tests.
+	Unthrottled bool
+	// InteruptCycleBudget is the number of cycles an interupt handler can use before a warning is logged,
+	// if it is 0 the number of cycles in one clock tick at the program's tempo is used
+	InteruptCycleBudget int
+}
+
+// DefaultClockSpeed is the clock speed used when none is configured
+const DefaultClockSpeed = 1000000
+
+// RuntimeStats describes the execution of a program
+type RuntimeStats struct {
+	Instructions uint64
+	Cycles       uint64
+	// Elapsed is the host time spent in Run
+	Elapsed time.Duration
+	// Idle is the host time spent parked while the VM waited for an interupt
+	Idle time.Duration
+	// MaxInteruptCycles is the largest number of cycles used by each interupt handler
+	MaxInteruptCycles [3]uint64
+	// InteruptOverruns is the number of times each interupt handler went over its cycle budget
+	InteruptOverruns [3]uint64
+}
+
+// InstructionRate returns the number of instructions executed per second while the VM was not waiting for an interupt
+func (s RuntimeStats) InstructionRate() float64 {
+	busy := s.Elapsed - s.Idle
+	if busy <= 0 {
+		return 0
+	}
+
+	return float64(s.Instructions) / busy.Seconds()
+}
+
+// ClockSpeed returns the number of cycles executed per second while the VM was not waiting for an interupt
+func (s RuntimeStats) ClockSpeed() float64 {
+	busy := s.Elapsed - s.Idle
+	if busy <= 0 {
+		return 0
+	}
+
+	return float64(s.Cycles) / busy.Seconds()
+}
+
+// Runtime runs a program on a VM, generating clock interupts while the transport is playing
+// and sending the midi messages written by the program to a midi handler.
+// The transport methods are safe to call from other goroutines while Run is executing.
+type Runtime struct {
+	config   RuntimeConfig
+	vm       *vm.VM
+	midi     *midi.TrackingMidiHandler
+	commands chan func()
+	quit     bool
+
+	state        TransportState
+	position     uint16
+	ticks        uint16
+	clockStarted bool
+	started      bool
+
+	// now is the time of the program, which advances with the number of cycles executed,
+	// nextTick is the program time of the next clock tick
+	now      time.Duration
+	nextTick time.Duration
+	start    time.Time
+	stats    RuntimeStats
+
+	scheduledNotes []scheduledNote
+}
+
+func NewRuntime(config RuntimeConfig, v *vm.VM, midiHandler midi.MidiHandler) *Runtime {
+	if config.ClockSpeed <= 0 {
+		config.ClockSpeed = DefaultClockSpeed
+	}
+
+	r := &Runtime{
+		config:   config,
+		vm:       v,
+		midi:     midi.NewTrackingMidiHandler(midiHandler, config.NotesOffMode),
+		commands: make(chan func(), 64),
+	}
+
+	r.registerSyscalls()
+
+	v.OnInteruptReturn(r.checkInteruptCycles)
+	v.MapWrite(midiSendBitAddress, func(addr uint16, value uint8) { r.sendMidi() })
+	v.MapWrite(midiScheduleBitAddress, func(addr uint16, value uint8) { r.pollScheduler() })
+
+	return r
+}
+
+// Play starts the transport from the current song position
+func (r *Runtime) Play() {
+	r.commands <- r.play
+}
+
+// Pause stops the transport and keeps the current song position
+func (r *Runtime) Pause() {
+	r.commands <- r.pause
+}
+
+// Stop stops the transport and returns to the start of the song
+func (r *Runtime) Stop() {
+	r.commands <- r.stop
+}
+
+// Locate moves the song position to the start of the bar
+func (r *Runtime) Locate(bar int) {
+	r.commands <- func() { r.locate(bar) }
+}
+
+// HandleMidiMessage handles midi transport messages (start, continue, stop and song position pointer)
+func (r *Runtime) HandleMidiMessage(m midi.MidiMessage) {
+	r.commands <- func() { r.handleMidiMessage(m) }
+}
+
+// Quit stops Run
+func (r *Runtime) Quit() {
+	r.commands <- func() { r.quit = true }
+}
+
+// Stats returns statistics about the execution of the program, it should be called after Run returns
+func (r *Runtime) Stats() RuntimeStats {
+	return r.stats
+}
+
+// Run executes the program loaded in the VM until it halts, faults or Quit is called.
+// Notes that are still on when Run returns are released.
+func (r *Runtime) Run() error {
+	defer r.allNotesOff()
+
+	r.begin()
+
+	defer func() {
+		r.stats.Elapsed = time.Since(r.start)
+		r.stats.Instructions = r.vm.Instructions()
+		r.stats.Cycles = r.vm.Cycles()
+	}()
+
+	for !r.quit && !r.vm.Halted {
+		r.handleCommands()
+		r.clock()
+
+		if r.vm.Waiting {
+			r.waitForInterupt()
+			continue
+		}
+
+		n, err := r.vm.RunCycles(r.budget())
+		r.advance(n)
+
+		if err != nil {
+			return err
+		}
+
+		r.throttle()
+	}
+
+	return nil
+}
+
+// RunTicks executes the program in program time, without waiting for host time, until n more clock ticks have
+// been raised and the VM is waiting for the next one or it is due. It returns early if the program halts or faults
+// and returns once the VM waits if the clock isn't running. It can be called repeatedly to step through a program,
+// notes that are still on are left on until ReleaseNotes is called.
+func (r *Runtime) RunTicks(n int) error {
+	r.begin()
+
+	defer func() {
+		r.stats.Instructions = r.vm.Instructions()
+		r.stats.Cycles = r.vm.Cycles()
+	}()
+
+	start := r.ticks
+
+	for !r.quit && !r.vm.Halted {
+		r.handleCommands()
+
+		d, ok := r.untilNextTick()
+
+		if !ok && r.vm.Waiting {
+			return nil
+		}
+
+		if int(r.ticks-start) >= n && (r.vm.Waiting || ok && d == 0) {
+			return nil
+		}
+
+		r.clock()
+
+		if r.vm.Waiting {
+			r.now += d
+			continue
+		}
+
+		c, err := r.vm.RunCycles(r.budget())
+		r.advance(c)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReleaseNotes releases the notes that are still on, Run does this when it returns
+func (r *Runtime) ReleaseNotes() {
+	r.allNotesOff()
+}
+
+// Ticks returns the number of clock ticks raised since the runtime started
+func (r *Runtime) Ticks() uint16 {
+	return r.ticks
+}
+
+// begin sets up the transport the first time the runtime is run
+func (r *Runtime) begin() {
+	if r.started {
+		return
+	}
+
+	r.started = true
+	r.setTransportState(TransportStopped)
+	r.setSongPosition(0)
+
+	if !r.config.Stopped {
+		r.play()
+	}
+
+	r.start = time.Now()
+}
+
+func (r *Runtime) handleCommands() {
+	for {
+		select {
+		case command := <-r.commands:
+			command()
+		default:
+			return
+		}
+	}
+}
+
+// sendMidi sends a message written to the <midi> message registers,
+// these are kept for programs that write them directly rather than using SyscallSendMidi
+func (r *Runtime) sendMidi() {
+	m := r.vm.GetMemorySection(midiStatusAddress, 4)
+
+	if m[3] > 0 {
+		r.midi.Send(m[0], m[1], m[2])
+		r.vm.SetMemory(midiSendBitAddress, 0x0)
+	}
+}
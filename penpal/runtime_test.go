@@ -0,0 +1,596 @@
+package penpal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/instructions"
+	"github.com/andrewesterhuizen/penpal/midi"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+const transportTestProgram = `
+#include <midi>
+
+start:
+loop:
+	jump loop
+
+on_start:
+	push 0
+	push 0
+	push 0xfa
+	push 3
+	call midi_send_message
+	reti
+
+on_stop:
+	push 0
+	push 0
+	push 0xfc
+	push 3
+	call midi_send_message
+	reti
+`
+
+func newTestRuntime(t *testing.T, source string) (*Runtime, *vm.VM, *midi.RecordingMidiHandler) {
+	return newTestRuntimeWithConfig(t, RuntimeConfig{}, source)
+}
+
+func newTestRuntimeWithConfig(t *testing.T, config RuntimeConfig, source string) (*Runtime, *vm.VM, *midi.RecordingMidiHandler) {
+	systemIncludes, err := GetSystemIncludes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := assembler.New(assembler.Config{
+		SystemIncludes: systemIncludes,
+		InteruptLabels: InteruptLabels,
+	})
+
+	program, err := a.GetProgram("test.asm", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := vm.New()
+	v.Load(program)
+
+	h := &midi.RecordingMidiHandler{}
+
+	return NewRuntime(config, v, h), v, h
+}
+
+func tickN(r *Runtime, n int) {
+	for i := 0; i < n; i++ {
+		r.vm.Tick()
+	}
+}
+
+// clockTick raises the next clock tick without waiting for it
+func clockTick(r *Runtime) {
+	if r.clockStarted {
+		r.now = r.nextTick
+	}
+
+	r.clock()
+}
+
+func expectMessages(t *testing.T, h *midi.RecordingMidiHandler, expected []midi.MidiMessage) {
+	t.Helper()
+
+	if len(h.Messages) != len(expected) {
+		t.Fatalf("expected %d midi messages and got %d: %v", len(expected), len(h.Messages), h.Messages)
+	}
+
+	for i, m := range expected {
+		if h.Messages[i] != m {
+			t.Errorf("expected message %d to be %v, got %v", i, m, h.Messages[i])
+		}
+	}
+}
+
+func TestRuntime_Transport_RaisesStartAndStopInterupts(t *testing.T) {
+	r, v, h := newTestRuntime(t, transportTestProgram)
+
+	tickN(r, 50)
+
+	r.play()
+	tickN(r, 50)
+
+	r.pause()
+	tickN(r, 50)
+
+	r.play()
+	tickN(r, 50)
+
+	r.stop()
+	tickN(r, 50)
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.Start, 0, 0},
+		{midi.Stop, 0, 0},
+		{midi.Start, 0, 0},
+		{midi.Stop, 0, 0},
+	})
+
+	if state := TransportState(v.GetMemory(midiTransportStateAddress)); state != TransportStopped {
+		t.Errorf("expected transport state register to be %s, got %s", TransportStopped, state)
+	}
+}
+
+func TestRuntime_Transport_StopFromStoppedDoesNotRaiseInterupt(t *testing.T) {
+	r, _, h := newTestRuntime(t, transportTestProgram)
+
+	r.stop()
+	tickN(r, 50)
+
+	expectMessages(t, h, []midi.MidiMessage{})
+}
+
+func TestRuntime_Transport_RestartRunsStartLast(t *testing.T) {
+	r, _, h := newTestRuntime(t, transportTestProgram)
+
+	r.handleMidiMessage(midi.MidiMessage{midi.Start})
+	tickN(r, 50)
+
+	// a start while playing stops and starts the transport before the VM runs either handler
+	r.handleMidiMessage(midi.MidiMessage{midi.Start})
+	tickN(r, 50)
+
+	// as does a pause followed by a continue
+	r.handleMidiMessage(midi.MidiMessage{midi.Stop})
+	r.handleMidiMessage(midi.MidiMessage{midi.Continue})
+	tickN(r, 50)
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.Start, 0, 0},
+		{midi.Start, 0, 0},
+		{midi.Start, 0, 0},
+	})
+
+	if r.state != TransportPlaying {
+		t.Errorf("expected transport to be playing, got %s", r.state)
+	}
+}
+
+func TestRuntime_Locate_SetsSongPosition(t *testing.T) {
+	r, v, _ := newTestRuntime(t, transportTestProgram)
+
+	// <midi> defaults to a ppqn of 2, so there are 8 ticks in a bar
+	r.locate(3)
+
+	h := uint16(v.GetMemory(midiSongPositionAddress))
+	l := uint16(v.GetMemory(midiSongPositionAddress + 1))
+
+	if position := h<<8 | l; position != 24 {
+		t.Errorf("expected song position to be 24, got %d", position)
+	}
+}
+
+func TestRuntime_HandleMidiMessage(t *testing.T) {
+	r, _, _ := newTestRuntime(t, transportTestProgram)
+
+	r.handleMidiMessage(midi.MidiMessage{midi.Start})
+	if r.state != TransportPlaying {
+		t.Errorf("expected transport to be playing after start message, got %s", r.state)
+	}
+
+	r.handleMidiMessage(midi.MidiMessage{midi.Stop})
+	if r.state != TransportPaused {
+		t.Errorf("expected transport to be paused after stop message, got %s", r.state)
+	}
+
+	// 130 sixteenth notes, split into 7 bit bytes
+	r.handleMidiMessage(midi.MidiMessage{midi.SongPositionPointer, 130 & 0x7f, 130 >> 7})
+	if r.position != 65 {
+		t.Errorf("expected song position to be 65 ticks, got %d", r.position)
+	}
+
+	r.handleMidiMessage(midi.MidiMessage{midi.Continue})
+	if r.state != TransportPlaying {
+		t.Errorf("expected transport to be playing after continue message, got %s", r.state)
+	}
+
+	if r.position != 65 {
+		t.Errorf("expected continue to keep song position 65, got %d", r.position)
+	}
+}
+
+func TestRuntime_MidiTrig_ReleasesNoteAfterOneTick(t *testing.T) {
+	r, _, h := newTestRuntime(t, `
+#include <midi>
+
+start:
+	push 0x3c
+	push 1
+	call midi_trig
+loop:
+	jump loop
+`)
+
+	tickN(r, 100)
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.NoteOn, 0x3c, 0x7f},
+	})
+
+	r.play()
+	clockTick(r)
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.NoteOn, 0x3c, 0x7f},
+		{midi.NoteOff, 0x3c, 0},
+	})
+}
+
+func TestRuntime_ScheduleNote_ReleasesAfterLength(t *testing.T) {
+	r, _, h := newTestRuntime(t, transportTestProgram)
+
+	r.scheduleNote(2, 60, 100, 3)
+	r.scheduleNote(2, 64, 100, 1)
+	r.scheduleNote(2, 67, 100, 0)
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.NoteOn | 2, 60, 100},
+		{midi.NoteOn | 2, 64, 100},
+		{midi.NoteOn | 2, 67, 100},
+		{midi.NoteOff | 2, 67, 0},
+	})
+
+	h.Messages = nil
+	r.releaseScheduledNotes()
+	expectMessages(t, h, []midi.MidiMessage{{midi.NoteOff | 2, 64, 0}})
+
+	h.Messages = nil
+	r.releaseScheduledNotes()
+	expectMessages(t, h, []midi.MidiMessage{})
+
+	r.releaseScheduledNotes()
+	expectMessages(t, h, []midi.MidiMessage{{midi.NoteOff | 2, 60, 0}})
+}
+
+func TestRuntime_ScheduleNote_RetriggerReleasesPreviousNote(t *testing.T) {
+	r, _, h := newTestRuntime(t, transportTestProgram)
+
+	r.scheduleNote(0, 60, 100, 4)
+	r.scheduleNote(0, 60, 90, 1)
+
+	r.releaseScheduledNotes()
+	r.releaseScheduledNotes()
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.NoteOn, 60, 100},
+		{midi.NoteOff, 60, 0},
+		{midi.NoteOn, 60, 90},
+		{midi.NoteOff, 60, 0},
+	})
+}
+
+func TestRuntime_ReleasesNotesOnHaltAndStop(t *testing.T) {
+	source := `
+#include <midi>
+
+start:
+	push 0x64
+	push 0x3c
+	push 2
+	call midi_note_on
+	halt
+`
+
+	r, _, h := newTestRuntime(t, source)
+	r.config.Stopped = true
+
+	err := r.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.NoteOn, 0x3c, 0x64},
+		{midi.NoteOff, 0x3c, 0},
+	})
+
+	r, _, h = newTestRuntime(t, source)
+	tickN(r, 100)
+	r.stop()
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.NoteOn, 0x3c, 0x64},
+		{midi.NoteOff, 0x3c, 0},
+	})
+}
+
+func TestRuntime_ReleasesNotesOnFault(t *testing.T) {
+	r, _, h := newTestRuntime(t, `
+#include <midi>
+
+start:
+	push 0x64
+	push 0x3c
+	push 2
+	call midi_note_on
+	db 0xee
+`)
+	r.config.Stopped = true
+
+	err := r.Run()
+	if err == nil {
+		t.Fatal("expected Run to return fault for unknown instruction")
+	}
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.NoteOn, 0x3c, 0x64},
+		{midi.NoteOff, 0x3c, 0},
+	})
+}
+
+func TestRuntime_Syscalls(t *testing.T) {
+	r, v, h := newTestRuntime(t, `
+#include <midi>
+
+start:
+	// send a control change
+	push 0x40
+	push 0x07
+	push 0xb0
+	sys 0x01
+
+	// schedule a note
+	push 2
+	push 1
+	push 0x50
+	push 0x3c
+	sys 0x02
+
+	sys 0x03
+	halt
+`)
+
+	r.ticks = 0x1234
+
+	tickN(r, 100)
+
+	if !v.Halted {
+		t.Fatal("expected program to halt")
+	}
+
+	expectMessages(t, h, []midi.MidiMessage{
+		{midi.ControlChange, 0x07, 0x40},
+		{midi.NoteOn | 1, 0x3c, 0x50},
+	})
+
+	a, _ := v.GetRegister(instructions.RegisterA)
+	b, _ := v.GetRegister(instructions.RegisterB)
+
+	if a != 0x34 || b != 0x12 {
+		t.Errorf("expected ticks syscall to return A=0x34 B=0x12, got A=0x%02x B=0x%02x", a, b)
+	}
+}
+
+func TestRuntime_UnknownSyscall_Faults(t *testing.T) {
+	r, _, _ := newTestRuntime(t, `
+start:
+	sys 0xee
+	halt
+`)
+	r.config.Stopped = true
+
+	err := r.Run()
+
+	var fault *vm.Fault
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected Run to return a fault, got %v", err)
+	}
+}
+
+func TestRuntime_Wait_RunsInteruptsUntilHalt(t *testing.T) {
+	r, v, h := newTestRuntimeWithConfig(t, RuntimeConfig{Unthrottled: true}, `
+#include <midi>
+
+count: db 0
+
+start:
+	mov A, 250
+	store A, midi_bpm
+	mov A, 24
+	store A, midi_ppqn
+loop:
+	wait
+	load count, A
+	mov B, 3
+	gte
+	jumpz loop
+	halt
+
+on_tick:
+	push 0
+	push 0
+	push 0xf8
+	push 3
+	call midi_send_message
+
+	load count, A
+	mov B, 1
+	add
+	store A, count
+	reti
+`)
+
+	err := r.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.Halted {
+		t.Error("expected program to halt")
+	}
+
+	expectMessages(t, h, []midi.MidiMessage{{0xf8}, {0xf8}, {0xf8}})
+}
+
+func TestRuntime_Unthrottled_FollowsProgramTime(t *testing.T) {
+	// at 1000 cycles per second with the <midi> defaults of 120 bpm and a ppqn of 2
+	// there is a clock tick every 250 cycles
+	config := RuntimeConfig{ClockSpeed: 1000, Unthrottled: true}
+
+	r, v, _ := newTestRuntimeWithConfig(t, config, `
+#include <midi>
+
+count: db 0
+
+start:
+loop:
+	load count, A
+	mov B, 4
+	gte
+	jumpz loop
+	halt
+
+on_tick:
+	load count, A
+	mov B, 1
+	add
+	store A, count
+	reti
+`)
+
+	err := r.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.Halted {
+		t.Fatal("expected program to halt")
+	}
+
+	stats := r.Stats()
+
+	// the 4th tick happens after 750ms of program time, the program then needs a few cycles to halt
+	if stats.Cycles < 750 || stats.Cycles > 790 {
+		t.Errorf("expected around 750 cycles to be executed, got %d", stats.Cycles)
+	}
+
+	if stats.Elapsed > time.Second {
+		t.Errorf("expected unthrottled run to take less than 1s, took %s", stats.Elapsed)
+	}
+}
+
+func TestRuntime_InteruptCycleBudget(t *testing.T) {
+	config := RuntimeConfig{ClockSpeed: 1000, Unthrottled: true, InteruptCycleBudget: 20}
+
+	r, v, _ := newTestRuntimeWithConfig(t, config, `
+#include <midi>
+
+count: db 0
+
+start:
+loop:
+	load count, A
+	mov B, 2
+	gte
+	jumpz loop
+	halt
+
+on_tick:
+	mul
+	mul
+	mul
+	mul
+	mul
+	mul
+	load count, A
+	mov B, 1
+	add
+	store A, count
+	reti
+`)
+
+	err := r.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.Halted {
+		t.Fatal("expected program to halt")
+	}
+
+	stats := r.Stats()
+
+	// the jump from the interupt vector, 6 muls, load, mov, add, store and reti
+	expected := uint64(3 + 6*4 + 4 + 2 + 1 + 4 + 9)
+	if stats.MaxInteruptCycles[InteruptTick] != expected {
+		t.Errorf("expected on_tick to take %d cycles, got %d", expected, stats.MaxInteruptCycles[InteruptTick])
+	}
+
+	if stats.InteruptOverruns[InteruptTick] != 2 {
+		t.Errorf("expected 2 overruns, got %d", stats.InteruptOverruns[InteruptTick])
+	}
+}
+
+func TestRuntime_SyscallCycles(t *testing.T) {
+	r, v, _ := newTestRuntime(t, `
+start:
+	mul
+	mul
+	sys 0x06
+	halt
+`)
+
+	tickN(r, 4)
+
+	a, _ := v.GetRegister(instructions.RegisterA)
+	b, _ := v.GetRegister(instructions.RegisterB)
+
+	// the entry jump, 2 muls and the sys instruction itself
+	if a != 3+4+4+10 || b != 0 {
+		t.Errorf("expected A=21 B=0, got A=%d B=%d", a, b)
+	}
+}
+
+func TestRuntime_RunTicks(t *testing.T) {
+	r, v, h := newTestRuntimeWithConfig(t, RuntimeConfig{ClockSpeed: 1000}, `
+#include <midi>
+
+start:
+loop:
+	wait
+	jump loop
+
+on_tick:
+	push 0
+	push 0
+	push 0xf8
+	push 3
+	call midi_send_message
+	reti
+`)
+
+	err := r.RunTicks(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Ticks() != 2 || !v.Waiting {
+		t.Fatalf("expected to stop waiting after 2 ticks, got %d ticks, waiting %v", r.Ticks(), v.Waiting)
+	}
+
+	expectMessages(t, h, []midi.MidiMessage{{0xf8}, {0xf8}})
+
+	err = r.RunTicks(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Ticks() != 5 {
+		t.Errorf("expected 5 ticks, got %d", r.Ticks())
+	}
+
+	// each tick is 250 cycles at 1000 cycles per second, stepping doesn't wait for host time
+	if v.Cycles() > 5*250 {
+		t.Errorf("expected less than 5 ticks of cycles to be executed, got %d", v.Cycles())
+	}
+}
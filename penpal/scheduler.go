@@ -0,0 +1,72 @@
+package penpal
+
+import "github.com/andrewesterhuizen/penpal/midi"
+
+// scheduledNote is a note that is on and will be released after a number of clock ticks
+type scheduledNote struct {
+	channel   byte
+	note      byte
+	remaining int
+}
+
+// pollScheduler sends the note on for a note submitted through the <midi> scheduler registers
+func (r *Runtime) pollScheduler() {
+	if r.vm.GetMemory(midiScheduleBitAddress) == 0 {
+		return
+	}
+
+	registers := r.vm.GetMemorySection(midiScheduleNoteAddress, 4)
+	note := registers[0] & 0x7f
+	velocity := registers[1] & 0x7f
+	channel := registers[2] & 0x0f
+	length := int(registers[3])
+
+	r.vm.SetMemory(midiScheduleBitAddress, 0x0)
+
+	r.scheduleNote(channel, note, velocity, length)
+}
+
+// scheduleNote sends a note on and schedules the note off after length clock ticks,
+// a note with a length of 0 is released immediately
+func (r *Runtime) scheduleNote(channel byte, note byte, velocity byte, length int) {
+	// retriggering a note that is still on releases it first so that the note off isn't sent early
+	for i, n := range r.scheduledNotes {
+		if n.channel == channel && n.note == note {
+			r.midi.Send(midi.NoteOff|channel, note, 0)
+			r.scheduledNotes = append(r.scheduledNotes[:i], r.scheduledNotes[i+1:]...)
+			break
+		}
+	}
+
+	r.midi.Send(midi.NoteOn|channel, note, velocity)
+
+	if length == 0 {
+		r.midi.Send(midi.NoteOff|channel, note, 0)
+		return
+	}
+
+	r.scheduledNotes = append(r.scheduledNotes, scheduledNote{channel: channel, note: note, remaining: length})
+}
+
+// releaseScheduledNotes advances scheduled notes by one clock tick and sends the note offs that are due
+func (r *Runtime) releaseScheduledNotes() {
+	remaining := r.scheduledNotes[:0]
+
+	for _, n := range r.scheduledNotes {
+		n.remaining--
+
+		if n.remaining <= 0 {
+			r.midi.Send(midi.NoteOff|n.channel, n.note, 0)
+			continue
+		}
+
+		remaining = append(remaining, n)
+	}
+
+	r.scheduledNotes = remaining
+}
+
+func (r *Runtime) allNotesOff() {
+	r.scheduledNotes = nil
+	r.midi.AllNotesOff()
+}
@@ -0,0 +1,83 @@
+package penpal
+
+import (
+	"fmt"
+
+	"github.com/andrewesterhuizen/penpal/instructions"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// system calls registered by the runtime, numbers from 0x80 are free for embedders to register their own
+const (
+	// SyscallSendMidi pops status, data1 and data2 from the stack and sends them as a midi message
+	SyscallSendMidi = 0x01
+	// SyscallScheduleNote pops note, velocity, channel and length from the stack,
+	// sends a note on and schedules the note off after length clock ticks
+	SyscallScheduleNote = 0x02
+	// SyscallTicks returns the number of clock ticks since the runtime started, low byte in A and high byte in B
+	SyscallTicks = 0x03
+	// SyscallDebug prints the values of the A and B registers
+	SyscallDebug = 0x04
+	// SyscallSeed seeds the random number generator with A (low byte) and B (high byte)
+	SyscallSeed = 0x05
+	// SyscallCycles returns the low 16 bits of the VM's cycle counter, low byte in A and high byte in B
+	SyscallCycles = 0x06
+)
+
+func (r *Runtime) registerSyscalls() {
+	r.vm.RegisterSyscall(SyscallSendMidi, r.sysSendMidi)
+	r.vm.RegisterSyscall(SyscallScheduleNote, r.sysScheduleNote)
+	r.vm.RegisterSyscall(SyscallTicks, r.sysTicks)
+	r.vm.RegisterSyscall(SyscallDebug, r.sysDebug)
+	r.vm.RegisterSyscall(SyscallSeed, r.sysSeed)
+	r.vm.RegisterSyscall(SyscallCycles, r.sysCycles)
+}
+
+func (r *Runtime) sysSendMidi(v *vm.VM) error {
+	status := v.Pop()
+	data1 := v.Pop()
+	data2 := v.Pop()
+
+	r.midi.Send(status, data1, data2)
+	return nil
+}
+
+func (r *Runtime) sysScheduleNote(v *vm.VM) error {
+	note := v.Pop() & 0x7f
+	velocity := v.Pop() & 0x7f
+	channel := v.Pop() & 0x0f
+	length := int(v.Pop())
+
+	r.scheduleNote(channel, note, velocity, length)
+	return nil
+}
+
+func (r *Runtime) sysTicks(v *vm.VM) error {
+	v.SetRegister(instructions.RegisterA, uint8(r.ticks&0xff))
+	v.SetRegister(instructions.RegisterB, uint8((r.ticks&0xff00)>>8))
+	return nil
+}
+
+func (r *Runtime) sysDebug(v *vm.VM) error {
+	a, _ := v.GetRegister(instructions.RegisterA)
+	b, _ := v.GetRegister(instructions.RegisterB)
+
+	fmt.Printf("DEBUG A: 0x%02x (%d) | B: 0x%02x (%d)\n", a, a, b, b)
+	return nil
+}
+
+func (r *Runtime) sysSeed(v *vm.VM) error {
+	a, _ := v.GetRegister(instructions.RegisterA)
+	b, _ := v.GetRegister(instructions.RegisterB)
+
+	v.Seed(int64(b)<<8 | int64(a))
+	return nil
+}
+
+func (r *Runtime) sysCycles(v *vm.VM) error {
+	cycles := v.Cycles()
+
+	v.SetRegister(instructions.RegisterA, uint8(cycles&0xff))
+	v.SetRegister(instructions.RegisterB, uint8((cycles&0xff00)>>8))
+	return nil
+}
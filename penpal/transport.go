@@ -0,0 +1,114 @@
+package penpal
+
+import (
+	"fmt"
+
+	"github.com/andrewesterhuizen/penpal/midi"
+)
+
+// TransportState is the play state of the runtime's transport
+type TransportState uint8
+
+const (
+	TransportStopped TransportState = iota
+	TransportPlaying
+	TransportPaused
+)
+
+func (s TransportState) String() string {
+	switch s {
+	case TransportStopped:
+		return "stopped"
+	case TransportPlaying:
+		return "playing"
+	case TransportPaused:
+		return "paused"
+	default:
+		return fmt.Sprintf("TransportState(%d)", s)
+	}
+}
+
+// beatsPerBar is the number of quarter notes in a bar, only 4/4 is supported for now
+const beatsPerBar = 4
+
+func (r *Runtime) ticksPerBar() int {
+	return int(r.vm.GetMemory(midiPPQNAddress)) * beatsPerBar
+}
+
+func (r *Runtime) setTransportState(s TransportState) {
+	r.state = s
+	r.vm.SetMemory(midiTransportStateAddress, uint8(s))
+}
+
+func (r *Runtime) setSongPosition(position uint16) {
+	r.position = position
+	r.vm.SetMemory(midiSongPositionAddress, uint8((position&0xff00)>>8))
+	r.vm.SetMemory(midiSongPositionAddress+1, uint8(position&0xff))
+}
+
+// play starts the transport from the current song position and raises the on_start interupt
+func (r *Runtime) play() {
+	if r.state == TransportPlaying {
+		return
+	}
+
+	r.setTransportState(TransportPlaying)
+	r.clockStarted = false
+
+	// on_start has priority over on_stop, so an on_stop raised by a restart or a pause that the VM
+	// hasn't serviced yet would run after on_start and leave the program stopped
+	r.vm.CancelInterupt(InteruptStop)
+	r.vm.Interupt(InteruptStart)
+}
+
+// pause stops the transport, keeping the current song position, releases any notes that are on
+// and raises the on_stop interupt
+func (r *Runtime) pause() {
+	if r.state != TransportPlaying {
+		return
+	}
+
+	r.setTransportState(TransportPaused)
+	r.allNotesOff()
+	r.vm.Interupt(InteruptStop)
+}
+
+// stop stops the transport, returns to the start of the song and releases any notes that are on,
+// on_stop is only raised if the transport was playing
+func (r *Runtime) stop() {
+	wasPlaying := r.state == TransportPlaying
+
+	r.setTransportState(TransportStopped)
+	r.setSongPosition(0)
+	r.allNotesOff()
+
+	if wasPlaying {
+		r.vm.Interupt(InteruptStop)
+	}
+}
+
+// locate moves the song position to the start of the bar
+func (r *Runtime) locate(bar int) {
+	r.setSongPosition(uint16(bar * r.ticksPerBar()))
+}
+
+func (r *Runtime) handleMidiMessage(m midi.MidiMessage) {
+	switch m[0] {
+	case midi.Start:
+		r.stop()
+		r.play()
+
+	case midi.Continue:
+		r.play()
+
+	case midi.Stop:
+		// a midi stop keeps the song position so that continue can resume from it
+		r.pause()
+
+	case midi.SongPositionPointer:
+		// song position is a 14 bit count of midi beats (sixteenth notes) since the start of the song
+		beats := int(m[2])<<7 | int(m[1])
+		ppqn := int(r.vm.GetMemory(midiPPQNAddress))
+		r.setSongPosition(uint16(beats * ppqn / 4))
+	}
+}
@@ -0,0 +1,196 @@
+package profile
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// field numbers of the messages in pprof's profile.proto
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileDurationNanos     = 10
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID      = 1
+	locationAddress = 3
+	locationLine    = 4
+
+	lineFunctionID = 1
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+)
+
+// protoBuffer encodes protocol buffer messages, only the wire types used by profile.proto are supported
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(n uint64) {
+	for n >= 0x80 {
+		b.data = append(b.data, byte(n)|0x80)
+		n >>= 7
+	}
+
+	b.data = append(b.data, byte(n))
+}
+
+func (b *protoBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// uint64 writes a varint field, zero values are left out as they are the default
+func (b *protoBuffer) uint64(field int, n uint64) {
+	if n == 0 {
+		return
+	}
+
+	b.key(field, 0)
+	b.varint(n)
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+// packed writes a repeated varint field
+func (b *protoBuffer) packed(field int, values ...uint64) {
+	p := protoBuffer{}
+	for _, v := range values {
+		p.varint(v)
+	}
+
+	b.bytes(field, p.data)
+}
+
+// message writes the message encoded by encode as a field
+func (b *protoBuffer) message(field int, encode func(m *protoBuffer)) {
+	m := protoBuffer{}
+	encode(&m)
+	b.bytes(field, m.data)
+}
+
+// stringTable assigns each string an index in the profile's string table, the first string must be empty
+type stringTable struct {
+	strings []string
+	indexes map[string]uint64
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{strings: []string{""}, indexes: map[string]uint64{"": 0}}
+}
+
+func (t *stringTable) index(s string) uint64 {
+	i, exists := t.indexes[s]
+	if !exists {
+		i = uint64(len(t.strings))
+		t.strings = append(t.strings, s)
+		t.indexes[s] = i
+	}
+
+	return i
+}
+
+// WritePprof writes the profile in the gzipped protocol buffer format read by go tool pprof.
+// Each executed address is a location in the function named after its enclosing label, with the
+// number of instructions and cycles executed there as sample values. clockSpeed is used to
+// convert the total number of cycles to the duration of the profile.
+func WritePprof(w io.Writer, p *vm.Profile, info assembler.ProgramInfo, clockSpeed int) error {
+	b := protoBuffer{}
+	table := newStringTable()
+
+	valueType := func(field int, typ string, unit string) {
+		b.message(field, func(m *protoBuffer) {
+			m.uint64(valueTypeType, table.index(typ))
+			m.uint64(valueTypeUnit, table.index(unit))
+		})
+	}
+
+	valueType(profileSampleType, "instructions", "count")
+	valueType(profileSampleType, "cycles", "count")
+
+	functionIDs := map[string]uint64{}
+	functions := []string{}
+	var totalCycles uint64
+
+	for addr, n := range p.Instructions {
+		if n == 0 {
+			continue
+		}
+
+		label := labelFor(uint16(addr), info)
+
+		fn, exists := functionIDs[label]
+		if !exists {
+			functions = append(functions, label)
+			fn = uint64(len(functions))
+			functionIDs[label] = fn
+		}
+
+		// location ids can't be 0 so they are offset by one from the address
+		id := uint64(addr) + 1
+
+		b.message(profileLocation, func(m *protoBuffer) {
+			m.uint64(locationID, id)
+			m.uint64(locationAddress, uint64(addr))
+			m.message(locationLine, func(l *protoBuffer) {
+				l.uint64(lineFunctionID, fn)
+			})
+		})
+
+		b.message(profileSample, func(m *protoBuffer) {
+			m.packed(sampleLocationID, id)
+			m.packed(sampleValue, n, p.Cycles[addr])
+		})
+
+		totalCycles += p.Cycles[addr]
+	}
+
+	for i, label := range functions {
+		b.message(profileFunction, func(m *protoBuffer) {
+			m.uint64(functionID, uint64(i+1))
+			m.uint64(functionName, table.index(label))
+			m.uint64(functionSystemName, table.index(label))
+		})
+	}
+
+	if clockSpeed > 0 {
+		b.uint64(profileDurationNanos, uint64(float64(totalCycles)*1e9/float64(clockSpeed)))
+	}
+
+	valueType(profilePeriodType, "cycles", "count")
+	b.uint64(profilePeriod, 1)
+	b.uint64(profileDefaultSampleType, table.index("cycles"))
+
+	// the string table is written last as the other fields add to it
+	for _, s := range table.strings {
+		b.bytes(profileStringTable, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+
+	_, err := gz.Write(b.data)
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
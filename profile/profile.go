@@ -0,0 +1,92 @@
+// Package profile reports where a program spends its time using the counts collected by vm.StartProfile
+package profile
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// NoLabel is the name used for addresses that are not after any label, such as the entry point table
+const NoLabel = "(no label)"
+
+// Entry is the number of instructions and cycles executed between a label and the next one
+type Entry struct {
+	Label        string
+	Instructions uint64
+	Cycles       uint64
+}
+
+// labelFor returns the label enclosing addr
+func labelFor(addr uint16, info assembler.ProgramInfo) string {
+	label, _, ok := info.Label(addr)
+	if !ok {
+		return NoLabel
+	}
+
+	return label
+}
+
+// ByLabel returns the counts in the profile summed by the label enclosing each address,
+// ordered from the most cycles to the least
+func ByLabel(p *vm.Profile, info assembler.ProgramInfo) []Entry {
+	byLabel := map[string]*Entry{}
+
+	for addr, n := range p.Instructions {
+		if n == 0 {
+			continue
+		}
+
+		label := labelFor(uint16(addr), info)
+
+		e, exists := byLabel[label]
+		if !exists {
+			e = &Entry{Label: label}
+			byLabel[label] = e
+		}
+
+		e.Instructions += n
+		e.Cycles += p.Cycles[addr]
+	}
+
+	entries := []Entry{}
+	for _, e := range byLabel {
+		entries = append(entries, *e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Cycles != entries[j].Cycles {
+			return entries[i].Cycles > entries[j].Cycles
+		}
+
+		return entries[i].Label < entries[j].Label
+	})
+
+	return entries
+}
+
+// WriteReport writes the first n entries as a table with the share of the total cycles used by each
+func WriteReport(w io.Writer, entries []Entry, n int) {
+	var total uint64
+	for _, e := range entries {
+		total += e.Cycles
+	}
+
+	fmt.Fprintf(w, "%12s %6s %12s  %s\n", "cycles", "%", "instructions", "label")
+
+	for i, e := range entries {
+		if i >= n {
+			break
+		}
+
+		share := 0.0
+		if total > 0 {
+			share = float64(e.Cycles) * 100 / float64(total)
+		}
+
+		fmt.Fprintf(w, "%12d %5.1f%% %12d  %s\n", e.Cycles, share, e.Instructions, e.Label)
+	}
+}
@@ -0,0 +1,167 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+var testInfo = assembler.ProgramInfo{Labels: map[string]uint16{"start": 0x0c, "loop": 0x10, "sub": 0x20}}
+
+func testProfile() *vm.Profile {
+	p := &vm.Profile{}
+
+	counts := []struct {
+		addr         uint16
+		instructions uint64
+		cycles       uint64
+	}{
+		{0x00, 1, 3},
+		{0x0c, 1, 2},
+		{0x10, 10, 20},
+		{0x13, 10, 30},
+		{0x20, 5, 50},
+	}
+
+	for _, c := range counts {
+		p.Instructions[c.addr] = c.instructions
+		p.Cycles[c.addr] = c.cycles
+	}
+
+	return p
+}
+
+func TestByLabel(t *testing.T) {
+	expected := []Entry{
+		{Label: "loop", Instructions: 20, Cycles: 50},
+		{Label: "sub", Instructions: 5, Cycles: 50},
+		{Label: NoLabel, Instructions: 1, Cycles: 3},
+		{Label: "start", Instructions: 1, Cycles: 2},
+	}
+
+	entries := ByLabel(testProfile(), testInfo)
+
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries and got %d: %v", len(expected), len(entries), entries)
+	}
+
+	for i, e := range expected {
+		if entries[i] != e {
+			t.Errorf("expected entry %d to be %v and got %v", i, e, entries[i])
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	buf := bytes.Buffer{}
+	WriteReport(&buf, ByLabel(testProfile(), testInfo), 2)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and 2 entries, got %q", buf.String())
+	}
+
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "50 47.6% 20 loop" {
+		t.Errorf("expected the loop entry first, got %q", lines[1])
+	}
+}
+
+// readFields decodes the top level fields of a protocol buffer message, varints are returned as their value
+func readFields(t *testing.T, data []byte) map[int][]interface{} {
+	fields := map[int][]interface{}{}
+
+	varint := func() uint64 {
+		var n uint64
+		for shift := uint(0); ; shift += 7 {
+			if len(data) == 0 {
+				t.Fatal("unexpected end of message")
+			}
+
+			b := data[0]
+			data = data[1:]
+			n |= uint64(b&0x7f) << shift
+
+			if b < 0x80 {
+				return n
+			}
+		}
+	}
+
+	for len(data) > 0 {
+		key := varint()
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case 0:
+			fields[field] = append(fields[field], varint())
+		case 2:
+			n := varint()
+			fields[field] = append(fields[field], data[:n])
+			data = data[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+
+	return fields
+}
+
+func TestWritePprof(t *testing.T) {
+	buf := bytes.Buffer{}
+
+	err := WritePprof(&buf, testProfile(), testInfo, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := readFields(t, data)
+
+	if n := len(fields[profileSample]); n != 5 {
+		t.Errorf("expected a sample for each of the 5 addresses, got %d", n)
+	}
+
+	if n := len(fields[profileFunction]); n != 4 {
+		t.Errorf("expected a function for each of the 4 labels, got %d", n)
+	}
+
+	stringTable := []string{}
+	for _, s := range fields[profileStringTable] {
+		stringTable = append(stringTable, string(s.([]byte)))
+	}
+
+	if len(stringTable) == 0 || stringTable[0] != "" {
+		t.Fatalf("expected the string table to start with an empty string, got %q", stringTable)
+	}
+
+	for _, s := range []string{"instructions", "cycles", "loop", "sub", NoLabel} {
+		if !strings.Contains(strings.Join(stringTable, "\n"), s) {
+			t.Errorf("expected %s in the string table %q", s, stringTable)
+		}
+	}
+
+	// 105 cycles at 1000 cycles per second
+	if d := fields[profileDurationNanos]; len(d) != 1 || d[0].(uint64) != 105000000 {
+		t.Errorf("expected a duration of 105ms, got %v", d)
+	}
+
+	// the values of the sample for 0x10 are packed varints of its instructions and cycles
+	sample := readFields(t, fields[profileSample][2].([]byte))
+	if values := sample[sampleValue][0].([]byte); !bytes.Equal(values, []byte{10, 20}) {
+		t.Errorf("expected the sample for 0x10 to have 10 instructions and 20 cycles, got %v", values)
+	}
+}
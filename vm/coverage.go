@@ -0,0 +1,35 @@
+package vm
+
+import "github.com/andrewesterhuizen/penpal/instructions"
+
+// Coverage is the number of times the instruction at each address was executed while recording coverage and,
+// for conditional jumps, the number of times the jump was taken and the number of times it continued to the next instruction
+type Coverage struct {
+	Executed [memorySize + 1]uint64
+	Taken    [memorySize + 1]uint64
+	NotTaken [memorySize + 1]uint64
+}
+
+// StartCoverage records the instructions executed and the branches taken in the returned coverage until StopCoverage is called
+func (vm *VM) StartCoverage() *Coverage {
+	vm.coverage = &Coverage{}
+	return vm.coverage
+}
+
+// StopCoverage stops updating the coverage returned by StartCoverage
+func (vm *VM) StopCoverage() {
+	vm.coverage = nil
+}
+
+// recordBranch records whether the conditional jump at ip, which has been executed, jumped
+func (c *Coverage) recordBranch(ip uint16, in *decodedInstruction, next uint16) {
+	if !instructions.ConditionalJumps[in.opcode] {
+		return
+	}
+
+	if next == ip+uint16(in.width) {
+		c.NotTaken[ip]++
+	} else {
+		c.Taken[ip]++
+	}
+}
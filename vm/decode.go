@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/andrewesterhuizen/penpal/instructions"
+)
+
+// decodedInstruction is an instruction with its operands read from memory so that they
+// don't have to be fetched byte by byte each time the instruction is executed.
+// A width of 0 means the instruction at that address hasn't been decoded.
+type decodedInstruction struct {
+	opcode   uint8
+	width    uint8
+	cycles   uint8
+	register uint8
+	mode     uint8
+	arg      uint8
+	addr     uint16
+}
+
+// maxWidth is the width of the widest instruction, a write can change the operands of an instruction
+// that starts up to maxWidth-1 bytes before it
+var maxWidth = func() uint16 {
+	max := 1
+	for _, w := range instructions.Width {
+		if w > max {
+			max = w
+		}
+	}
+
+	return uint16(max)
+}()
+
+func (vm *VM) read16(addr uint16) uint16 {
+	return uint16(vm.memory[addr])<<8 | uint16(vm.memory[addr+1])
+}
+
+// decode reads the instruction at addr into the decoded instruction cache
+func (vm *VM) decode(addr uint16) error {
+	opcode := vm.memory[addr]
+
+	width, known := instructions.Width[opcode]
+	if !known {
+		width = 1
+	}
+
+	if int(addr)+width > memorySize {
+		return fmt.Errorf("instruction 0x%02x runs past the end of memory", opcode)
+	}
+
+	in := decodedInstruction{opcode: opcode, width: uint8(width), cycles: uint8(instructions.Cycles[opcode])}
+
+	switch opcode {
+	case instructions.Mov:
+		in.register = vm.memory[addr+1]
+		in.arg = vm.memory[addr+2]
+
+	case instructions.Store:
+		in.register = vm.memory[addr+1]
+		in.mode = vm.memory[addr+2]
+		in.arg = vm.memory[addr+3]
+		in.addr = vm.read16(addr + 4)
+
+	case instructions.Load:
+		in.addr = vm.read16(addr + 1)
+		in.mode = vm.memory[addr+3]
+		in.arg = vm.memory[addr+4]
+		in.register = vm.memory[addr+5]
+
+	// word instructions operate on the A:B pair and a word in memory, their operand is encoded like load's
+	// as are indirect jumps and calls, which read their target from the word
+	case instructions.Load16, instructions.Store16, instructions.Add16, instructions.Sub16, instructions.Cmp16,
+		instructions.JumpIndirect, instructions.CallIndirect:
+		in.addr = vm.read16(addr + 1)
+		in.mode = vm.memory[addr+3]
+		in.arg = vm.memory[addr+4]
+
+	case instructions.Jump, instructions.Jumpz, instructions.Jumpnz, instructions.Call,
+		instructions.Jc, instructions.Jnc, instructions.Jn, instructions.Je, instructions.Jne:
+		in.addr = vm.read16(addr + 1)
+
+	case instructions.Push:
+		in.mode = vm.memory[addr+1]
+		in.arg = vm.memory[addr+2]
+
+	case instructions.Sys:
+		in.arg = vm.memory[addr+1]
+
+	case instructions.PopRegister:
+		in.register = vm.memory[addr+1]
+	}
+
+	vm.decoded[addr] = in
+
+	if end := addr + uint16(width) - 1; end > vm.decodedEnd {
+		vm.decodedEnd = end
+	}
+
+	return nil
+}
+
+// invalidate removes the decoded instructions that include the byte at addr so that
+// programs that modify their own code execute the new instructions
+func (vm *VM) invalidate(addr uint16) {
+	start := uint16(0)
+	if addr >= maxWidth {
+		start = addr - maxWidth + 1
+	}
+
+	for a := start; a <= addr; a++ {
+		in := &vm.decoded[a]
+		if a+uint16(in.width) > addr {
+			in.width = 0
+		}
+	}
+}
+
+// write stores value at addr and invalidates any decoded instructions it changes
+func (vm *VM) write(addr uint16, value uint8) {
+	if vm.history != nil {
+		vm.history.recordWrite(addr, vm.memory[addr])
+	}
+
+	vm.memory[addr] = value
+
+	if addr <= vm.decodedEnd {
+		vm.invalidate(addr)
+	}
+}
+
+// resetDecoded clears the decoded instruction cache
+func (vm *VM) resetDecoded() {
+	vm.decoded = [len(vm.decoded)]decodedInstruction{}
+	vm.decodedEnd = 0
+}
@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/andrewesterhuizen/penpal/instructions"
+)
+
+// FuzzVM_Run executes arbitrary bytes as a program, the VM should only ever return faults.
+// If protect is set the program is marked as code and writes to it fault.
+func FuzzVM_Run(f *testing.F) {
+	f.Add([]byte{instructions.Halt}, false)
+	f.Add(watchProgram, false)
+	f.Add([]byte{instructions.Div}, false)
+	f.Add([]byte{instructions.Load, 0xff, 0xff, instructions.Immediate, 0x00, instructions.RegisterA}, false)
+	f.Add([]byte{instructions.Push, instructions.FramePointerWithOffset, 0x80, instructions.Ret}, false)
+	f.Add([]byte{instructions.Call, 0x00, 0x00}, false)
+	f.Add([]byte{instructions.Store, instructions.RegisterA, instructions.Immediate, 0x00, 0xff, 0xff}, true)
+	f.Add([]byte{instructions.Store, instructions.RegisterA, instructions.Immediate, 0x00, 0x00, 0x00}, true)
+
+	f.Fuzz(func(t *testing.T, program []byte, protect bool) {
+		vm := New()
+		vm.Seed(1)
+		vm.Load(program)
+
+		if protect {
+			end := len(program)
+			if end > memorySize {
+				end = memorySize
+			}
+
+			err := vm.SetRegions([]Region{{Kind: RegionCode, Start: 0, End: uint16(end)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			vm.SetProtection(ProtectionFault)
+		}
+
+		vm.Record(64)
+
+		check := func(err error) {
+			var fault *Fault
+			if err != nil && !errors.As(err, &fault) {
+				t.Fatalf("expected a fault and got %v", err)
+			}
+		}
+
+		_, err := vm.Run(1000)
+		check(err)
+
+		// run an interupt handler if the program set one
+		vm.Interupt(0)
+		_, err = vm.Run(1000)
+		check(err)
+
+		for vm.StepBack() {
+		}
+	})
+}
@@ -0,0 +1,243 @@
+package vm
+
+// state is the part of the VM that an instruction or interupt entry can change, other than memory
+type state struct {
+	ip, sp, fp uint16
+	a, b, c, d uint8
+	x, y       uint8
+	flags      uint8
+
+	halted              bool
+	waiting             bool
+	inInterupt          bool
+	pendingInterupts    [interuptCount]bool
+	interuptPending     bool
+	interupt            int
+	interuptStartCycles uint64
+	cycles              uint64
+	instructionCount    uint64
+	stackErr            error
+}
+
+// step is the state before an instruction or the entry to an interupt was executed,
+// interupt is the number of the interupt entered or -1 for an instruction.
+// writeStart is the number of the first write made by the step, the step's writes
+// end at the next step's writeStart.
+type step struct {
+	state      state
+	interupt   int
+	writeStart uint64
+}
+
+// memoryWrite is the value at addr before it was overwritten
+type memoryWrite struct {
+	addr uint16
+	old  uint8
+}
+
+// history records the steps executed by the VM so that they can be undone. Steps and
+// the memory they overwrite are kept in ring buffers, writes are numbered from the start
+// of recording so that a step's writes can be found after the ring has wrapped.
+type history struct {
+	steps     []step
+	firstStep int
+	stepCount int
+
+	writes     []memoryWrite
+	writeCount uint64
+}
+
+// writesPerStep is the number of writes recorded for each step that can be undone, most
+// instructions write at most a few bytes but a syscall can write any number
+const writesPerStep = 4
+
+func (vm *VM) saveRegisters() state {
+	return state{
+		ip:                  vm.ip,
+		sp:                  vm.sp,
+		fp:                  vm.fp,
+		a:                   vm.a,
+		b:                   vm.b,
+		c:                   vm.c,
+		d:                   vm.d,
+		x:                   vm.x,
+		y:                   vm.y,
+		flags:               vm.flags,
+		halted:              vm.Halted,
+		waiting:             vm.Waiting,
+		inInterupt:          vm.inInterupt,
+		pendingInterupts:    vm.pendingInterupts,
+		interuptPending:     vm.interuptPending,
+		interupt:            vm.interupt,
+		interuptStartCycles: vm.interuptStartCycles,
+		cycles:              vm.cycles,
+		instructionCount:    vm.instructionCount,
+		stackErr:            vm.stackErr,
+	}
+}
+
+func (vm *VM) restoreRegisters(s state) {
+	vm.ip = s.ip
+	vm.sp = s.sp
+	vm.fp = s.fp
+	vm.a = s.a
+	vm.b = s.b
+	vm.c = s.c
+	vm.d = s.d
+	vm.x = s.x
+	vm.y = s.y
+	vm.flags = s.flags
+	vm.Halted = s.halted
+	vm.Waiting = s.waiting
+	vm.inInterupt = s.inInterupt
+	vm.pendingInterupts = s.pendingInterupts
+	vm.interuptPending = s.interuptPending
+	vm.interupt = s.interupt
+	vm.interuptStartCycles = s.interuptStartCycles
+	vm.cycles = s.cycles
+	vm.instructionCount = s.instructionCount
+	vm.stackErr = s.stackErr
+}
+
+// Record keeps the state before each of the last n instructions and interupt entries
+// so that they can be undone with StepBack, RunBackToWrite and RewindToInterupt.
+// Recording starts from the current state, n of 0 stops recording.
+// Only the VM is rewound: the random number generator and anything done by syscalls,
+// write handlers or the host are not undone.
+func (vm *VM) Record(n int) {
+	if n <= 0 {
+		vm.history = nil
+		return
+	}
+
+	vm.history = &history{
+		steps:  make([]step, n),
+		writes: make([]memoryWrite, n*writesPerStep),
+	}
+}
+
+// Recorded returns the number of steps that can be undone
+func (vm *VM) Recorded() int {
+	if vm.history == nil {
+		return 0
+	}
+
+	return vm.history.stepCount
+}
+
+// beginStep records the state before an instruction or the entry to interupt n
+func (vm *VM) beginStep(interupt int) {
+	h := vm.history
+
+	i := (h.firstStep + h.stepCount) % len(h.steps)
+	if h.stepCount == len(h.steps) {
+		h.firstStep = (h.firstStep + 1) % len(h.steps)
+	} else {
+		h.stepCount++
+	}
+
+	h.steps[i] = step{state: vm.saveRegisters(), interupt: interupt, writeStart: h.writeCount}
+}
+
+// recordWrite records the value at addr before it is overwritten by the current step
+func (h *history) recordWrite(addr uint16, old uint8) {
+	if h.stepCount == 0 {
+		return
+	}
+
+	// drop the oldest steps whose writes would be overwritten
+	for h.stepCount > 0 && h.writeCount-h.steps[h.firstStep].writeStart >= uint64(len(h.writes)) {
+		h.firstStep = (h.firstStep + 1) % len(h.steps)
+		h.stepCount--
+	}
+
+	// the current step has written more than can be recorded so nothing before it can be undone
+	if h.stepCount == 0 {
+		return
+	}
+
+	h.writes[h.writeCount%uint64(len(h.writes))] = memoryWrite{addr: addr, old: old}
+	h.writeCount++
+}
+
+// stepAt returns the step i steps before the most recent one and the end of its writes
+func (h *history) stepAt(i int) (*step, uint64) {
+	n := (h.firstStep + h.stepCount - 1 - i) % len(h.steps)
+
+	end := h.writeCount
+	if i > 0 {
+		end = h.steps[(n+1)%len(h.steps)].writeStart
+	}
+
+	return &h.steps[n], end
+}
+
+// undo undoes the last n steps
+func (vm *VM) undo(n int) {
+	h := vm.history
+
+	for ; n > 0; n-- {
+		s, end := h.stepAt(0)
+
+		// the restored writes are written directly so that they are not recorded
+		for w := end; w > s.writeStart; w-- {
+			mw := h.writes[(w-1)%uint64(len(h.writes))]
+			vm.memory[mw.addr] = mw.old
+
+			if mw.addr <= vm.decodedEnd {
+				vm.invalidate(mw.addr)
+			}
+		}
+
+		vm.restoreRegisters(s.state)
+		h.writeCount = s.writeStart
+		h.stepCount--
+	}
+}
+
+// StepBack undoes the last instruction or interupt entry, it returns false if there is nothing recorded to undo
+func (vm *VM) StepBack() bool {
+	if vm.Recorded() == 0 {
+		return false
+	}
+
+	vm.undo(1)
+	return true
+}
+
+// RunBackToWrite undoes steps until the last write to addr has been undone, leaving the instruction that
+// wrote it as the next to execute. It returns false and leaves the VM unchanged if no recorded step wrote to addr.
+func (vm *VM) RunBackToWrite(addr uint16) bool {
+	h := vm.history
+
+	for i := 0; i < vm.Recorded(); i++ {
+		s, end := h.stepAt(i)
+
+		for w := s.writeStart; w < end; w++ {
+			if h.writes[w%uint64(len(h.writes))].addr == addr {
+				vm.undo(i + 1)
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RewindToInterupt undoes steps back to the start of the last recorded entry to interupt n, leaving the
+// first instruction of its handler as the next to execute. It returns false and leaves the VM unchanged
+// if the entry to interupt n is not recorded.
+func (vm *VM) RewindToInterupt(n int) bool {
+	h := vm.history
+
+	for i := 0; i < vm.Recorded(); i++ {
+		s, _ := h.stepAt(i)
+
+		if s.interupt == n {
+			vm.undo(i)
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,773 @@
+package vm
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/andrewesterhuizen/penpal/instructions"
+)
+
+// operation executes a decoded instruction, operations are responsible for moving the instruction pointer
+type operation func(vm *VM, in *decodedInstruction) error
+
+// operations is the dispatch table indexed by opcode, halt is handled by Tick and unknown opcodes are nil
+var operations = [256]operation{
+	instructions.Swap:         opSwap,
+	instructions.Mov:          opMov,
+	instructions.Store:        opStore,
+	instructions.Load:         opLoad,
+	instructions.Add:          opAdd,
+	instructions.Sub:          opSub,
+	instructions.Mul:          opMul,
+	instructions.Div:          opDiv,
+	instructions.Shl:          opShl,
+	instructions.Shr:          opShr,
+	instructions.And:          opAnd,
+	instructions.Or:           opOr,
+	instructions.GT:           opGT,
+	instructions.GTE:          opGTE,
+	instructions.LT:           opLT,
+	instructions.LTE:          opLTE,
+	instructions.Eq:           opEq,
+	instructions.Neq:          opNeq,
+	instructions.Jump:         opJump,
+	instructions.Jumpz:        opJumpz,
+	instructions.Jumpnz:       opJumpnz,
+	instructions.Push:         opPush,
+	instructions.Pop:          opPop,
+	instructions.Call:         opCall,
+	instructions.Ret:          opRet,
+	instructions.Reti:         opReti,
+	instructions.Rand:         opRand,
+	instructions.Wait:         opWait,
+	instructions.Sys:          opSys,
+	instructions.Cmp:          opCmp,
+	instructions.Adc:          opAdc,
+	instructions.Sbb:          opSbb,
+	instructions.Jc:           opJc,
+	instructions.Jnc:          opJnc,
+	instructions.Jn:           opJn,
+	instructions.Je:           opJe,
+	instructions.Jne:          opJne,
+	instructions.Load16:       opLoad16,
+	instructions.Store16:      opStore16,
+	instructions.Add16:        opAdd16,
+	instructions.Sub16:        opSub16,
+	instructions.Cmp16:        opCmp16,
+	instructions.Inc16:        opInc16,
+	instructions.Xor:          opXor,
+	instructions.Not:          opNot,
+	instructions.Mod:          opMod,
+	instructions.Inc:          opInc,
+	instructions.Dec:          opDec,
+	instructions.Neg:          opNeg,
+	instructions.Rol:          opRol,
+	instructions.Ror:          opRor,
+	instructions.JumpIndirect: opJumpIndirect,
+	instructions.CallIndirect: opCallIndirect,
+	instructions.CallStack:    opCallStack,
+	instructions.PopRegister:  opPopRegister,
+}
+
+func (vm *VM) next(in *decodedInstruction) {
+	vm.ip += uint16(in.width)
+}
+
+// setResultFlags sets the zero and negative flags for result and clears carry and overflow
+func (vm *VM) setResultFlags(result uint8) {
+	vm.flags = 0
+
+	if result == 0 {
+		vm.flags |= FlagZero
+	}
+
+	if result&0x80 != 0 {
+		vm.flags |= FlagNegative
+	}
+}
+
+// add returns a + b + carry and sets the flags for the addition
+func (vm *VM) add(a uint8, b uint8, carry uint8) uint8 {
+	sum := uint16(a) + uint16(b) + uint16(carry)
+	result := uint8(sum)
+
+	vm.setResultFlags(result)
+
+	if sum > 0xff {
+		vm.flags |= FlagCarry
+	}
+
+	// the signed result overflows when both operands have the same sign and the result has the other
+	if (a^result)&(b^result)&0x80 != 0 {
+		vm.flags |= FlagOverflow
+	}
+
+	return result
+}
+
+// subtract returns a - b - borrow and sets the flags for the subtraction, carry is set when it borrows
+func (vm *VM) subtract(a uint8, b uint8, borrow uint8) uint8 {
+	difference := int(a) - int(b) - int(borrow)
+	result := uint8(difference)
+
+	vm.setResultFlags(result)
+
+	if difference < 0 {
+		vm.flags |= FlagCarry
+	}
+
+	// the signed result overflows when the operands have different signs and the result has the sign of b
+	if (a^b)&(a^result)&0x80 != 0 {
+		vm.flags |= FlagOverflow
+	}
+
+	return result
+}
+
+// carry returns the carry flag as 0 or 1
+func (vm *VM) carry() uint8 {
+	if vm.flags&FlagCarry != 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// jumpIf jumps to the address of a conditional jump if condition is true, otherwise it continues with the next instruction
+func (vm *VM) jumpIf(in *decodedInstruction, condition bool) {
+	if condition {
+		vm.ip = in.addr
+	} else {
+		vm.next(in)
+	}
+}
+
+func opSwap(vm *VM, in *decodedInstruction) error {
+	vm.a, vm.b = vm.b, vm.a
+	vm.next(in)
+	return nil
+}
+
+func opMov(vm *VM, in *decodedInstruction) error {
+	dest, err := vm.getRegister(in.register)
+	if err != nil {
+		return err
+	}
+
+	*dest = in.arg
+	vm.next(in)
+	return nil
+}
+
+func opStore(vm *VM, in *decodedInstruction) error {
+	value, err := vm.getValueInRegister(in.register)
+	if err != nil {
+		return err
+	}
+
+	addr, err := vm.getAddress(in.addr, in.mode, in.arg, 1)
+	if err != nil {
+		return err
+	}
+
+	if vm.protection != ProtectionOff {
+		err := vm.checkWrite(addr, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = vm.updatePointer(in.addr, in.mode, 1)
+	if err != nil {
+		return err
+	}
+
+	ip := vm.ip
+	vm.next(in)
+	vm.store(ip, addr, value)
+	return nil
+}
+
+// store writes a value stored by the instruction at ip, once its protection has been checked
+func (vm *VM) store(ip uint16, addr uint16, value uint8) {
+	if vm.isWatched(addr) {
+		vm.watchWrite(ip, addr, value)
+	}
+
+	vm.write(addr, value)
+
+	if vm.mappedWrites[addr/64]&(1<<(addr%64)) != 0 {
+		vm.writeHandlers[addr](addr, value)
+	}
+}
+
+func opLoad(vm *VM, in *decodedInstruction) error {
+	dest, err := vm.getRegister(in.register)
+	if err != nil {
+		return err
+	}
+
+	addr, err := vm.getAddress(in.addr, in.mode, in.arg, 1)
+	if err != nil {
+		return err
+	}
+
+	if vm.isWatched(addr) {
+		vm.watchRead(vm.ip, addr)
+	}
+
+	value := vm.memory[addr]
+
+	err = vm.updatePointer(in.addr, in.mode, 1)
+	if err != nil {
+		return err
+	}
+
+	*dest = value
+	vm.next(in)
+	return nil
+}
+
+// ab returns the A:B pair as a word, A is the high byte
+func (vm *VM) ab() uint16 {
+	return uint16(vm.a)<<8 | uint16(vm.b)
+}
+
+func (vm *VM) setAB(value uint16) {
+	vm.a = uint8(value >> 8)
+	vm.b = uint8(value)
+}
+
+// setWordResultFlags sets the zero and negative flags for a word result and clears carry and overflow
+func (vm *VM) setWordResultFlags(result uint16) {
+	vm.setResultFlags(uint8(result >> 8))
+
+	if result&0xff != 0 {
+		vm.flags &^= FlagZero
+	}
+}
+
+// addWord returns a + b and sets the flags for the addition
+func (vm *VM) addWord(a uint16, b uint16) uint16 {
+	sum := uint32(a) + uint32(b)
+	result := uint16(sum)
+
+	vm.setWordResultFlags(result)
+
+	if sum > 0xffff {
+		vm.flags |= FlagCarry
+	}
+
+	if (a^result)&(b^result)&0x8000 != 0 {
+		vm.flags |= FlagOverflow
+	}
+
+	return result
+}
+
+// subtractWord returns a - b and sets the flags for the subtraction, carry is set when it borrows
+func (vm *VM) subtractWord(a uint16, b uint16) uint16 {
+	result := a - b
+
+	vm.setWordResultFlags(result)
+
+	if b > a {
+		vm.flags |= FlagCarry
+	}
+
+	if (a^b)&(a^result)&0x8000 != 0 {
+		vm.flags |= FlagOverflow
+	}
+
+	return result
+}
+
+// loadWord returns the word operand of a word instruction
+func (vm *VM) loadWord(in *decodedInstruction) (uint16, error) {
+	addr, err := vm.getAddress(in.addr, in.mode, in.arg, 2)
+	if err != nil {
+		return 0, err
+	}
+
+	if vm.isWatched(addr) {
+		vm.watchRead(vm.ip, addr)
+	}
+
+	if vm.isWatched(addr + 1) {
+		vm.watchRead(vm.ip, addr+1)
+	}
+
+	value := vm.read16(addr)
+
+	err = vm.updatePointer(in.addr, in.mode, 2)
+	if err != nil {
+		return 0, err
+	}
+
+	return value, nil
+}
+
+func opLoad16(vm *VM, in *decodedInstruction) error {
+	value, err := vm.loadWord(in)
+	if err != nil {
+		return err
+	}
+
+	vm.setAB(value)
+	vm.next(in)
+	return nil
+}
+
+func opStore16(vm *VM, in *decodedInstruction) error {
+	addr, err := vm.getAddress(in.addr, in.mode, in.arg, 2)
+	if err != nil {
+		return err
+	}
+
+	// both bytes are checked before either is written so that a fault doesn't leave half of the word stored
+	if vm.protection != ProtectionOff {
+		err := vm.checkWrite(addr, vm.a)
+		if err == nil {
+			err = vm.checkWrite(addr+1, vm.b)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = vm.updatePointer(in.addr, in.mode, 2)
+	if err != nil {
+		return err
+	}
+
+	ip := vm.ip
+	vm.next(in)
+	vm.store(ip, addr, vm.a)
+	vm.store(ip, addr+1, vm.b)
+	return nil
+}
+
+func opAdd16(vm *VM, in *decodedInstruction) error {
+	value, err := vm.loadWord(in)
+	if err != nil {
+		return err
+	}
+
+	vm.setAB(vm.addWord(vm.ab(), value))
+	vm.next(in)
+	return nil
+}
+
+func opSub16(vm *VM, in *decodedInstruction) error {
+	value, err := vm.loadWord(in)
+	if err != nil {
+		return err
+	}
+
+	vm.setAB(vm.subtractWord(vm.ab(), value))
+	vm.next(in)
+	return nil
+}
+
+// opCmp16 sets the flags for A:B minus the word operand without changing A:B
+func opCmp16(vm *VM, in *decodedInstruction) error {
+	value, err := vm.loadWord(in)
+	if err != nil {
+		return err
+	}
+
+	vm.subtractWord(vm.ab(), value)
+	vm.next(in)
+	return nil
+}
+
+func opInc16(vm *VM, in *decodedInstruction) error {
+	vm.setAB(vm.addWord(vm.ab(), 1))
+	vm.next(in)
+	return nil
+}
+
+func opAdd(vm *VM, in *decodedInstruction) error {
+	vm.a = vm.add(vm.a, vm.b, 0)
+	vm.next(in)
+	return nil
+}
+
+func opSub(vm *VM, in *decodedInstruction) error {
+	vm.a = vm.subtract(vm.a, vm.b, 0)
+	vm.next(in)
+	return nil
+}
+
+func opMul(vm *VM, in *decodedInstruction) error {
+	product := uint16(vm.a) * uint16(vm.b)
+	vm.a = uint8(product)
+	vm.setResultFlags(vm.a)
+
+	// carry is set when the product doesn't fit in a byte
+	if product > 0xff {
+		vm.flags |= FlagCarry
+	}
+
+	vm.next(in)
+	return nil
+}
+
+func opDiv(vm *VM, in *decodedInstruction) error {
+	if vm.b == 0 {
+		return ErrDivisionByZero
+	}
+
+	vm.a /= vm.b
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opShl(vm *VM, in *decodedInstruction) error {
+	shifted := uint16(vm.a) << vm.b
+	vm.a = uint8(shifted)
+	vm.setResultFlags(vm.a)
+
+	if shifted&0x100 != 0 {
+		vm.flags |= FlagCarry
+	}
+
+	vm.next(in)
+	return nil
+}
+
+func opShr(vm *VM, in *decodedInstruction) error {
+	// the last bit shifted out is bit b-1, a shift of more than 8 only shifts out zeros
+	carry := vm.b > 0 && vm.b <= 8 && vm.a>>(vm.b-1)&1 != 0
+
+	vm.a = vm.a >> vm.b
+	vm.setResultFlags(vm.a)
+
+	if carry {
+		vm.flags |= FlagCarry
+	}
+
+	vm.next(in)
+	return nil
+}
+
+func opAnd(vm *VM, in *decodedInstruction) error {
+	vm.a = vm.a & vm.b
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opOr(vm *VM, in *decodedInstruction) error {
+	vm.a = vm.a | vm.b
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+// opCmp sets the flags for A - B without changing A
+func opCmp(vm *VM, in *decodedInstruction) error {
+	vm.subtract(vm.a, vm.b, 0)
+	vm.next(in)
+	return nil
+}
+
+func opAdc(vm *VM, in *decodedInstruction) error {
+	vm.a = vm.add(vm.a, vm.b, vm.carry())
+	vm.next(in)
+	return nil
+}
+
+func opSbb(vm *VM, in *decodedInstruction) error {
+	vm.a = vm.subtract(vm.a, vm.b, vm.carry())
+	vm.next(in)
+	return nil
+}
+
+func opXor(vm *VM, in *decodedInstruction) error {
+	vm.a = vm.a ^ vm.b
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opNot(vm *VM, in *decodedInstruction) error {
+	vm.a = ^vm.a
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opMod(vm *VM, in *decodedInstruction) error {
+	if vm.b == 0 {
+		return ErrDivisionByZero
+	}
+
+	vm.a %= vm.b
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+// opInc adds 1 to A, the carry flag is left unchanged so that inc and dec can be used to count
+// the bytes of a multi-byte addition without losing the carry between them
+func opInc(vm *VM, in *decodedInstruction) error {
+	carry := vm.flags & FlagCarry
+	vm.a = vm.add(vm.a, 1, 0)
+	vm.flags = vm.flags&^FlagCarry | carry
+	vm.next(in)
+	return nil
+}
+
+// opDec subtracts 1 from A, the carry flag is left unchanged like inc
+func opDec(vm *VM, in *decodedInstruction) error {
+	carry := vm.flags & FlagCarry
+	vm.a = vm.subtract(vm.a, 1, 0)
+	vm.flags = vm.flags&^FlagCarry | carry
+	vm.next(in)
+	return nil
+}
+
+func opNeg(vm *VM, in *decodedInstruction) error {
+	vm.a = vm.subtract(0, vm.a, 0)
+	vm.next(in)
+	return nil
+}
+
+// opRol rotates A left by B bits, carry is set to the last bit rotated around to bit 0
+func opRol(vm *VM, in *decodedInstruction) error {
+	vm.a = bits.RotateLeft8(vm.a, int(vm.b))
+	vm.setResultFlags(vm.a)
+
+	if vm.b > 0 && vm.a&0x01 != 0 {
+		vm.flags |= FlagCarry
+	}
+
+	vm.next(in)
+	return nil
+}
+
+// opRor rotates A right by B bits, carry is set to the last bit rotated around to bit 7
+func opRor(vm *VM, in *decodedInstruction) error {
+	vm.a = bits.RotateLeft8(vm.a, -int(vm.b))
+	vm.setResultFlags(vm.a)
+
+	if vm.b > 0 && vm.a&0x80 != 0 {
+		vm.flags |= FlagCarry
+	}
+
+	vm.next(in)
+	return nil
+}
+
+func opGT(vm *VM, in *decodedInstruction) error {
+	vm.a = boolToByte(vm.a > vm.b)
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opGTE(vm *VM, in *decodedInstruction) error {
+	vm.a = boolToByte(vm.a >= vm.b)
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opLT(vm *VM, in *decodedInstruction) error {
+	vm.a = boolToByte(vm.a < vm.b)
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opLTE(vm *VM, in *decodedInstruction) error {
+	vm.a = boolToByte(vm.a <= vm.b)
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opEq(vm *VM, in *decodedInstruction) error {
+	vm.a = boolToByte(vm.a == vm.b)
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opNeq(vm *VM, in *decodedInstruction) error {
+	vm.a = boolToByte(vm.a != vm.b)
+	vm.setResultFlags(vm.a)
+	vm.next(in)
+	return nil
+}
+
+func opJump(vm *VM, in *decodedInstruction) error {
+	vm.ip = in.addr
+	return nil
+}
+
+func opJumpz(vm *VM, in *decodedInstruction) error {
+	vm.jumpIf(in, vm.a == 0)
+	return nil
+}
+
+func opJumpnz(vm *VM, in *decodedInstruction) error {
+	vm.jumpIf(in, vm.a != 0)
+	return nil
+}
+
+func opJc(vm *VM, in *decodedInstruction) error {
+	vm.jumpIf(in, vm.flags&FlagCarry != 0)
+	return nil
+}
+
+func opJnc(vm *VM, in *decodedInstruction) error {
+	vm.jumpIf(in, vm.flags&FlagCarry == 0)
+	return nil
+}
+
+func opJn(vm *VM, in *decodedInstruction) error {
+	vm.jumpIf(in, vm.flags&FlagNegative != 0)
+	return nil
+}
+
+func opJe(vm *VM, in *decodedInstruction) error {
+	vm.jumpIf(in, vm.flags&FlagZero != 0)
+	return nil
+}
+
+func opJne(vm *VM, in *decodedInstruction) error {
+	vm.jumpIf(in, vm.flags&FlagZero == 0)
+	return nil
+}
+
+// opJumpIndirect jumps to the address in the word at the operand's address, with ImmediatePlusRegister
+// the register is added to the address as a byte offset and isn't scaled to the size of a word
+func opJumpIndirect(vm *VM, in *decodedInstruction) error {
+	addr, err := vm.loadWord(in)
+	if err != nil {
+		return err
+	}
+
+	vm.ip = addr
+	return nil
+}
+
+func opCallIndirect(vm *VM, in *decodedInstruction) error {
+	addr, err := vm.loadWord(in)
+	if err != nil {
+		return err
+	}
+
+	vm.next(in)
+	vm.call(addr)
+	return nil
+}
+
+// opCallStack pops the address to call from the stack, the frame is the same as a call to
+// an immediate address once the address has been popped
+func opCallStack(vm *VM, in *decodedInstruction) error {
+	addr := vm.pop16()
+	if vm.stackErr != nil {
+		return vm.stackErr
+	}
+
+	vm.next(in)
+	vm.call(addr)
+	return nil
+}
+
+func opPush(vm *VM, in *decodedInstruction) error {
+	switch in.mode {
+	case instructions.Register:
+		value, err := vm.getValueInRegister(in.arg)
+		if err != nil {
+			return err
+		}
+
+		vm.push(value)
+
+	case instructions.FramePointerWithOffset:
+		addr := vm.getFramePointerRelativeAddress(int8(in.arg))
+
+		if vm.isWatched(addr) {
+			vm.watchRead(vm.ip, addr)
+		}
+
+		vm.push(vm.memory[addr])
+
+	case instructions.Immediate:
+		vm.push(in.arg)
+
+	default:
+		return fmt.Errorf("push: encountered unknown mode 0x%02x", in.mode)
+	}
+
+	vm.next(in)
+	return nil
+}
+
+func opPop(vm *VM, in *decodedInstruction) error {
+	vm.a = vm.pop()
+	vm.next(in)
+	return nil
+}
+
+func opPopRegister(vm *VM, in *decodedInstruction) error {
+	dest, err := vm.getRegister(in.register)
+	if err != nil {
+		return err
+	}
+
+	*dest = vm.pop()
+	vm.next(in)
+	return nil
+}
+
+func opCall(vm *VM, in *decodedInstruction) error {
+	// the return address saved in the frame is the instruction after the call
+	vm.next(in)
+	vm.call(in.addr)
+	return nil
+}
+
+func opRet(vm *VM, in *decodedInstruction) error {
+	vm.ret()
+	return nil
+}
+
+func opReti(vm *VM, in *decodedInstruction) error {
+	vm.retFromInterupt()
+	return nil
+}
+
+func opRand(vm *VM, in *decodedInstruction) error {
+	vm.a = uint8(vm.rand.Intn(255))
+	vm.next(in)
+	return nil
+}
+
+func opWait(vm *VM, in *decodedInstruction) error {
+	vm.Waiting = true
+	vm.next(in)
+	return nil
+}
+
+func opSys(vm *VM, in *decodedInstruction) error {
+	vm.next(in)
+
+	syscall := vm.syscalls[in.arg]
+	if syscall == nil {
+		return fmt.Errorf("no system call registered for 0x%02x", in.arg)
+	}
+
+	err := syscall(vm)
+	if err != nil {
+		return fmt.Errorf("system call 0x%02x: %w", in.arg, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,862 @@
+package vm
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/andrewesterhuizen/penpal/instructions"
+)
+
+// operationTestCase executes the first instruction of program in a VM with its registers set to a, b and flags
+type operationTestCase struct {
+	name    string
+	program []byte
+	a, b    uint8
+	flags   uint8
+	// setup prepares memory, the stack and the frame pointer before the instruction is executed
+	setup func(vm *VM)
+
+	expectedA     uint8
+	expectedB     uint8
+	expectedFlags uint8
+	expectedIP    uint16
+	// fault is part of the error expected in the fault, the registers aren't checked if the instruction faults
+	fault string
+	// check makes any other assertions about the VM after the instruction is executed
+	check func(t *testing.T, vm *VM)
+}
+
+// the addresses used by the operation tests for data and for the frame pointer
+const (
+	testData  = 0x0100
+	testFrame = 0x0200
+)
+
+// operationTestSeed seeds the VM of each operation test so that rand is repeatable
+const operationTestSeed = 1
+
+func expectMemory(addr uint16, value uint8) func(t *testing.T, vm *VM) {
+	return func(t *testing.T, vm *VM) {
+		if vm.memory[addr] != value {
+			t.Errorf("expected 0x%02x at 0x%04x, got 0x%02x", value, addr, vm.memory[addr])
+		}
+	}
+}
+
+// expectPushed checks that values were pushed to an empty stack in order
+func expectPushed(values ...uint8) func(t *testing.T, vm *VM) {
+	return func(t *testing.T, vm *VM) {
+		if vm.sp != DefaultStackTop-uint16(len(values)) {
+			t.Errorf("expected %d bytes on the stack, sp is 0x%04x", len(values), vm.sp)
+		}
+
+		for i, value := range values {
+			addr := DefaultStackTop - uint16(i)
+			if vm.memory[addr] != value {
+				t.Errorf("expected 0x%02x to be pushed at 0x%04x, got 0x%02x", value, addr, vm.memory[addr])
+			}
+		}
+	}
+}
+
+// expectRegister checks a register other than A and B
+func expectRegister(r uint8, value uint8) func(t *testing.T, vm *VM) {
+	return func(t *testing.T, vm *VM) {
+		got, err := vm.GetRegister(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != value {
+			t.Errorf("expected 0x%02x in register 0x%02x, got 0x%02x", value, r, got)
+		}
+	}
+}
+
+// setRegister sets a register other than A and B
+func setRegister(r uint8, value uint8) func(vm *VM) {
+	return func(vm *VM) {
+		vm.SetRegister(r, value)
+	}
+}
+
+func setMemory(addr uint16, values ...uint8) func(vm *VM) {
+	return func(vm *VM) {
+		copy(vm.memory[addr:], values)
+	}
+}
+
+func load(mode uint8, arg uint8, register uint8) []byte {
+	return []byte{instructions.Load, testData >> 8, testData & 0xff, mode, arg, register}
+}
+
+func store(register uint8, mode uint8, arg uint8) []byte {
+	return []byte{instructions.Store, register, mode, arg, testData >> 8, testData & 0xff}
+}
+
+// word encodes a word instruction with its operand at testData
+func word(opcode uint8, mode uint8, arg uint8) []byte {
+	return []byte{opcode, testData >> 8, testData & 0xff, mode, arg}
+}
+
+// wordCase executes a word instruction with A:B set to ab and the word at testData set to operand
+func wordCase(name string, opcode uint8, ab uint16, operand uint16, expected uint16, expectedFlags uint8) operationTestCase {
+	return operationTestCase{
+		name:    name,
+		program: word(opcode, instructions.Immediate, 0x00),
+		a:       uint8(ab >> 8), b: uint8(ab),
+		setup:     setMemory(testData, uint8(operand>>8), uint8(operand)),
+		expectedA: uint8(expected >> 8), expectedB: uint8(expected), expectedFlags: expectedFlags, expectedIP: 5,
+	}
+}
+
+func aluCase(name string, opcode uint8, a uint8, b uint8, expected uint8, expectedFlags uint8) operationTestCase {
+	return operationTestCase{
+		name:    name,
+		program: []byte{opcode},
+		a:       a, b: b,
+		expectedA: expected, expectedB: b, expectedFlags: expectedFlags, expectedIP: 1,
+	}
+}
+
+// carryCase is an aluCase with the carry flag set before the instruction
+func carryCase(name string, opcode uint8, a uint8, b uint8, expected uint8, expectedFlags uint8) operationTestCase {
+	tc := aluCase(name, opcode, a, b, expected, expectedFlags)
+	tc.flags = FlagCarry
+	return tc
+}
+
+func jumpCase(name string, opcode uint8, a uint8, expectedIP uint16) operationTestCase {
+	return operationTestCase{name: name, program: []byte{opcode, 0x12, 0x34}, a: a, expectedA: a, expectedIP: expectedIP}
+}
+
+func flagJumpCase(name string, opcode uint8, flags uint8, expectedIP uint16) operationTestCase {
+	return operationTestCase{name: name, program: []byte{opcode, 0x12, 0x34}, flags: flags, expectedFlags: flags, expectedIP: expectedIP}
+}
+
+var operationTestCases = []operationTestCase{
+	{
+		name:    "halt",
+		program: []byte{instructions.Halt},
+		check: func(t *testing.T, vm *VM) {
+			if !vm.Halted {
+				t.Error("expected the VM to halt")
+			}
+		},
+	},
+	{name: "mov A", program: []byte{instructions.Mov, instructions.RegisterA, 0x12}, expectedA: 0x12, expectedIP: 3},
+	{
+		name:    "mov preserves flags",
+		program: []byte{instructions.Mov, instructions.RegisterA, 0x00},
+		flags:   FlagCarry | FlagNegative, expectedFlags: FlagCarry | FlagNegative, expectedIP: 3,
+	},
+	{name: "mov B", program: []byte{instructions.Mov, instructions.RegisterB, 0x12}, expectedB: 0x12, expectedIP: 3},
+	{name: "mov C", program: []byte{instructions.Mov, instructions.RegisterC, 0x12}, expectedIP: 3, check: expectRegister(instructions.RegisterC, 0x12)},
+	{name: "mov D", program: []byte{instructions.Mov, instructions.RegisterD, 0x12}, expectedIP: 3, check: expectRegister(instructions.RegisterD, 0x12)},
+	{name: "mov X", program: []byte{instructions.Mov, instructions.RegisterX, 0x12}, expectedIP: 3, check: expectRegister(instructions.RegisterX, 0x12)},
+	{name: "mov Y", program: []byte{instructions.Mov, instructions.RegisterY, 0x12}, expectedIP: 3, check: expectRegister(instructions.RegisterY, 0x12)},
+	{name: "mov unknown register", program: []byte{instructions.Mov, 0x10, 0x12}, fault: "unknown register 0x10"},
+	{name: "swap", program: []byte{instructions.Swap}, a: 1, b: 2, expectedA: 2, expectedB: 1, expectedIP: 1},
+
+	// load reads a value relative to testData or to the frame pointer for each addressing mode
+	{
+		name:      "load immediate",
+		program:   load(instructions.Immediate, 0x00, instructions.RegisterA),
+		setup:     setMemory(testData, 0x12),
+		expectedA: 0x12, expectedIP: 6,
+	},
+	{
+		name:      "load immediate with offset",
+		program:   load(instructions.Immediate, 0x01, instructions.RegisterA),
+		setup:     setMemory(testData+1, 0x12),
+		expectedA: 0x12, expectedIP: 6,
+	},
+	{
+		name:      "load immediate with negative offset",
+		program:   load(instructions.Immediate, 0xff, instructions.RegisterA),
+		setup:     setMemory(testData-1, 0x12),
+		expectedA: 0x12, expectedIP: 6,
+	},
+	{
+		name:      "load immediate plus register",
+		program:   load(instructions.ImmediatePlusRegister, instructions.RegisterB, instructions.RegisterA),
+		b:         0x81,
+		setup:     setMemory(testData+0x81, 0x12),
+		expectedA: 0x12, expectedB: 0x81, expectedIP: 6,
+	},
+	{
+		name:    "load immediate plus register X",
+		program: load(instructions.ImmediatePlusRegister, instructions.RegisterX, instructions.RegisterY),
+		setup: func(vm *VM) {
+			setRegister(instructions.RegisterX, 0x03)(vm)
+			setMemory(testData+3, 0x12)(vm)
+		},
+		expectedIP: 6,
+		check:      expectRegister(instructions.RegisterY, 0x12),
+	},
+	{
+		name:      "load immediate minus register",
+		program:   load(instructions.ImmediateMinusRegister, instructions.RegisterA, instructions.RegisterB),
+		a:         0x02,
+		setup:     setMemory(testData-2, 0x12),
+		expectedA: 0x02, expectedB: 0x12, expectedIP: 6,
+	},
+	{
+		name:      "load frame pointer with offset",
+		program:   load(instructions.FramePointerWithOffset, 0x07, instructions.RegisterA),
+		setup:     setMemory(testFrame+7, 0x12),
+		expectedA: 0x12, expectedIP: 6,
+	},
+	{
+		name:      "load frame pointer with negative offset",
+		program:   load(instructions.FramePointerWithOffset, 0xfe, instructions.RegisterA),
+		setup:     setMemory(testFrame-2, 0x12),
+		expectedA: 0x12, expectedIP: 6,
+	},
+	{
+		name:      "load frame pointer plus register",
+		program:   load(instructions.FramePointerPlusRegister, instructions.RegisterB, instructions.RegisterA),
+		b:         0x03,
+		setup:     setMemory(testFrame+3, 0x12),
+		expectedA: 0x12, expectedB: 0x03, expectedIP: 6,
+	},
+	{
+		name:      "load frame pointer minus register",
+		program:   load(instructions.FramePointerMinusRegister, instructions.RegisterB, instructions.RegisterA),
+		b:         0x03,
+		setup:     setMemory(testFrame-3, 0x12),
+		expectedA: 0x12, expectedB: 0x03, expectedIP: 6,
+	},
+	{
+		name:    "load register mode",
+		program: load(instructions.Register, instructions.RegisterA, instructions.RegisterA),
+		fault:   "unknown addressing mode 0x03",
+	},
+	{
+		name:    "load unknown offset register",
+		program: load(instructions.ImmediatePlusRegister, 0x10, instructions.RegisterA),
+		fault:   "unknown register 0x10",
+	},
+	{
+		name:    "load unknown register",
+		program: load(instructions.Immediate, 0x00, 0x10),
+		fault:   "unknown register 0x10",
+	},
+
+	// store writes A, or B where A is the offset, for each addressing mode
+	{
+		name:    "store immediate",
+		program: store(instructions.RegisterA, instructions.Immediate, 0x00),
+		a:       0x12, expectedA: 0x12, expectedIP: 6,
+		check: expectMemory(testData, 0x12),
+	},
+	{
+		name:    "store immediate with negative offset",
+		program: store(instructions.RegisterA, instructions.Immediate, 0xff),
+		a:       0x12, expectedA: 0x12, expectedIP: 6,
+		check: expectMemory(testData-1, 0x12),
+	},
+	{
+		name:    "store immediate plus register",
+		program: store(instructions.RegisterB, instructions.ImmediatePlusRegister, instructions.RegisterA),
+		a:       0x02, b: 0x12, expectedA: 0x02, expectedB: 0x12, expectedIP: 6,
+		check: expectMemory(testData+2, 0x12),
+	},
+	{
+		name:    "store immediate minus register",
+		program: store(instructions.RegisterB, instructions.ImmediateMinusRegister, instructions.RegisterA),
+		a:       0x02, b: 0x12, expectedA: 0x02, expectedB: 0x12, expectedIP: 6,
+		check: expectMemory(testData-2, 0x12),
+	},
+	{
+		name:    "store frame pointer with offset",
+		program: store(instructions.RegisterA, instructions.FramePointerWithOffset, 0x07),
+		a:       0x12, expectedA: 0x12, expectedIP: 6,
+		check: expectMemory(testFrame+7, 0x12),
+	},
+	{
+		name:    "store frame pointer with negative offset",
+		program: store(instructions.RegisterA, instructions.FramePointerWithOffset, 0xfe),
+		a:       0x12, expectedA: 0x12, expectedIP: 6,
+		check: expectMemory(testFrame-2, 0x12),
+	},
+	{
+		name:    "store frame pointer plus register",
+		program: store(instructions.RegisterB, instructions.FramePointerPlusRegister, instructions.RegisterA),
+		a:       0x03, b: 0x12, expectedA: 0x03, expectedB: 0x12, expectedIP: 6,
+		check: expectMemory(testFrame+3, 0x12),
+	},
+	{
+		name:       "store D",
+		program:    store(instructions.RegisterD, instructions.Immediate, 0x00),
+		setup:      setRegister(instructions.RegisterD, 0x12),
+		expectedIP: 6,
+		check:      expectMemory(testData, 0x12),
+	},
+	{
+		name:    "store frame pointer minus register",
+		program: store(instructions.RegisterB, instructions.FramePointerMinusRegister, instructions.RegisterA),
+		a:       0x03, b: 0x12, expectedA: 0x03, expectedB: 0x12, expectedIP: 6,
+		check: expectMemory(testFrame-3, 0x12),
+	},
+	{
+		name:    "store unknown mode",
+		program: store(instructions.RegisterA, 0x0e, 0x00),
+		fault:   "unknown addressing mode 0x0e",
+	},
+	{
+		name:    "store unknown register",
+		program: store(0x10, instructions.Immediate, 0x00),
+		fault:   "unknown register 0x10",
+	},
+
+	aluCase("add", instructions.Add, 0x12, 0x34, 0x46, 0),
+	aluCase("add carry", instructions.Add, 0xff, 0x02, 0x01, FlagCarry),
+	aluCase("add zero", instructions.Add, 0xff, 0x01, 0x00, FlagZero|FlagCarry),
+	aluCase("add signed overflow", instructions.Add, 0x7f, 0x01, 0x80, FlagNegative|FlagOverflow),
+	aluCase("add negative overflow", instructions.Add, 0x80, 0x80, 0x00, FlagZero|FlagCarry|FlagOverflow),
+	carryCase("add ignores carry", instructions.Add, 0x12, 0x34, 0x46, 0),
+	aluCase("sub", instructions.Sub, 0x34, 0x12, 0x22, 0),
+	aluCase("sub borrow", instructions.Sub, 0x01, 0x02, 0xff, FlagCarry|FlagNegative),
+	aluCase("sub zero", instructions.Sub, 0x12, 0x12, 0x00, FlagZero),
+	aluCase("sub signed overflow", instructions.Sub, 0x80, 0x01, 0x7f, FlagOverflow),
+	carryCase("sub ignores borrow", instructions.Sub, 0x34, 0x12, 0x22, 0),
+	aluCase("mul", instructions.Mul, 0x03, 0x04, 0x0c, 0),
+	aluCase("mul overflow", instructions.Mul, 0x10, 0x11, 0x10, FlagCarry),
+	aluCase("mul zero", instructions.Mul, 0x10, 0x10, 0x00, FlagZero|FlagCarry),
+	aluCase("div", instructions.Div, 0x0c, 0x04, 0x03, 0),
+	aluCase("div truncates", instructions.Div, 0x0d, 0x04, 0x03, 0),
+	aluCase("div negative", instructions.Div, 0xff, 0x01, 0xff, FlagNegative),
+	{name: "div by zero", program: []byte{instructions.Div}, a: 0x0c, fault: ErrDivisionByZero.Error()},
+	aluCase("shl", instructions.Shl, 0x03, 0x02, 0x0c, 0),
+	aluCase("shl carry", instructions.Shl, 0x81, 0x01, 0x02, FlagCarry),
+	aluCase("shl by 8", instructions.Shl, 0xff, 0x08, 0x00, FlagZero|FlagCarry),
+	aluCase("shl by 9", instructions.Shl, 0xff, 0x09, 0x00, FlagZero),
+	aluCase("shr", instructions.Shr, 0x0c, 0x02, 0x03, 0),
+	aluCase("shr carry", instructions.Shr, 0x03, 0x01, 0x01, FlagCarry),
+	aluCase("shr by 0", instructions.Shr, 0x81, 0x00, 0x81, FlagNegative),
+	aluCase("shr by 8", instructions.Shr, 0xff, 0x08, 0x00, FlagZero|FlagCarry),
+	aluCase("and", instructions.And, 0x0c, 0x0a, 0x08, 0),
+	aluCase("and zero", instructions.And, 0x0c, 0x03, 0x00, FlagZero),
+	carryCase("and clears carry", instructions.And, 0x0c, 0x0a, 0x08, 0),
+	aluCase("or", instructions.Or, 0x0c, 0x0a, 0x0e, 0),
+	aluCase("or negative", instructions.Or, 0x80, 0x01, 0x81, FlagNegative),
+	aluCase("xor", instructions.Xor, 0x0c, 0x0a, 0x06, 0),
+	aluCase("xor zero", instructions.Xor, 0x5a, 0x5a, 0x00, FlagZero),
+	carryCase("xor clears carry", instructions.Xor, 0x0c, 0x0a, 0x06, 0),
+	aluCase("not", instructions.Not, 0x0f, 0x00, 0xf0, FlagNegative),
+	aluCase("not zero", instructions.Not, 0xff, 0x00, 0x00, FlagZero),
+	aluCase("mod", instructions.Mod, 0x0d, 0x04, 0x01, 0),
+	aluCase("mod zero", instructions.Mod, 0x10, 0x10, 0x00, FlagZero),
+	{name: "mod by zero", program: []byte{instructions.Mod}, a: 0x0c, fault: ErrDivisionByZero.Error()},
+	aluCase("inc", instructions.Inc, 0x12, 0x00, 0x13, 0),
+	aluCase("inc wraps", instructions.Inc, 0xff, 0x00, 0x00, FlagZero),
+	aluCase("inc signed overflow", instructions.Inc, 0x7f, 0x00, 0x80, FlagNegative|FlagOverflow),
+	carryCase("inc keeps carry", instructions.Inc, 0x12, 0x00, 0x13, FlagCarry),
+	aluCase("dec", instructions.Dec, 0x12, 0x00, 0x11, 0),
+	aluCase("dec zero", instructions.Dec, 0x01, 0x00, 0x00, FlagZero),
+	aluCase("dec wraps", instructions.Dec, 0x00, 0x00, 0xff, FlagNegative),
+	carryCase("dec keeps carry", instructions.Dec, 0x12, 0x00, 0x11, FlagCarry),
+	aluCase("neg", instructions.Neg, 0x01, 0x00, 0xff, FlagCarry|FlagNegative),
+	aluCase("neg zero", instructions.Neg, 0x00, 0x00, 0x00, FlagZero),
+	aluCase("neg signed overflow", instructions.Neg, 0x80, 0x00, 0x80, FlagCarry|FlagNegative|FlagOverflow),
+	aluCase("rol", instructions.Rol, 0x81, 0x01, 0x03, FlagCarry),
+	aluCase("rol by 4", instructions.Rol, 0x12, 0x04, 0x21, FlagCarry),
+	aluCase("rol by 8", instructions.Rol, 0x12, 0x08, 0x12, 0),
+	carryCase("rol by 0", instructions.Rol, 0x81, 0x00, 0x81, FlagNegative),
+	aluCase("ror", instructions.Ror, 0x81, 0x01, 0xc0, FlagCarry|FlagNegative),
+	aluCase("ror by 4", instructions.Ror, 0x12, 0x04, 0x21, 0),
+	aluCase("ror by 9", instructions.Ror, 0x02, 0x09, 0x01, 0),
+	aluCase("gt true", instructions.GT, 0x02, 0x01, 1, 0),
+	aluCase("gt false", instructions.GT, 0x01, 0x01, 0, FlagZero),
+	aluCase("gte true", instructions.GTE, 0x01, 0x01, 1, 0),
+	aluCase("gte false", instructions.GTE, 0x01, 0x02, 0, FlagZero),
+	aluCase("lt true", instructions.LT, 0x01, 0x02, 1, 0),
+	aluCase("lt false", instructions.LT, 0x01, 0x01, 0, FlagZero),
+	aluCase("lte true", instructions.LTE, 0x01, 0x01, 1, 0),
+	aluCase("lte false", instructions.LTE, 0x02, 0x01, 0, FlagZero),
+	aluCase("eq true", instructions.Eq, 0x01, 0x01, 1, 0),
+	aluCase("eq false", instructions.Eq, 0x01, 0x02, 0, FlagZero),
+	aluCase("neq true", instructions.Neq, 0x01, 0x02, 1, 0),
+	aluCase("neq false", instructions.Neq, 0x01, 0x01, 0, FlagZero),
+
+	// cmp sets the flags for A - B and leaves A unchanged
+	aluCase("cmp equal", instructions.Cmp, 0x12, 0x12, 0x12, FlagZero),
+	aluCase("cmp below", instructions.Cmp, 0x01, 0x02, 0x01, FlagCarry|FlagNegative),
+	aluCase("cmp above", instructions.Cmp, 0x02, 0x01, 0x02, 0),
+	aluCase("cmp signed overflow", instructions.Cmp, 0x80, 0x01, 0x80, FlagOverflow),
+	aluCase("adc", instructions.Adc, 0x12, 0x34, 0x46, 0),
+	carryCase("adc with carry", instructions.Adc, 0x12, 0x34, 0x47, 0),
+	carryCase("adc carry out", instructions.Adc, 0xff, 0x00, 0x00, FlagZero|FlagCarry),
+	aluCase("sbb", instructions.Sbb, 0x34, 0x12, 0x22, 0),
+	carryCase("sbb with borrow", instructions.Sbb, 0x34, 0x12, 0x21, 0),
+	carryCase("sbb borrow out", instructions.Sbb, 0x00, 0x00, 0xff, FlagCarry|FlagNegative),
+
+	// word instructions use A:B as a word with A as the high byte
+	{
+		name:      "load16 immediate",
+		program:   word(instructions.Load16, instructions.Immediate, 0x00),
+		setup:     setMemory(testData, 0x12, 0x34),
+		expectedA: 0x12, expectedB: 0x34, expectedIP: 5,
+	},
+	{
+		name:      "load16 immediate plus register",
+		program:   word(instructions.Load16, instructions.ImmediatePlusRegister, instructions.RegisterA),
+		a:         0x02,
+		setup:     setMemory(testData+2, 0x12, 0x34),
+		expectedA: 0x12, expectedB: 0x34, expectedIP: 5,
+	},
+	{
+		name:      "load16 frame pointer with offset",
+		program:   word(instructions.Load16, instructions.FramePointerWithOffset, 0x07),
+		setup:     setMemory(testFrame+7, 0x12, 0x34),
+		expectedA: 0x12, expectedB: 0x34, expectedIP: 5,
+	},
+	{
+		name:    "load16 unknown mode",
+		program: word(instructions.Load16, instructions.Register, 0x00),
+		fault:   "unknown addressing mode 0x03",
+	},
+	{
+		name:    "store16 immediate",
+		program: word(instructions.Store16, instructions.Immediate, 0x00),
+		a:       0x12, b: 0x34, expectedA: 0x12, expectedB: 0x34, expectedIP: 5,
+		check: func(t *testing.T, vm *VM) {
+			expectMemory(testData, 0x12)(t, vm)
+			expectMemory(testData+1, 0x34)(t, vm)
+		},
+	},
+	{
+		name:    "store16 frame pointer minus register",
+		program: word(instructions.Store16, instructions.FramePointerMinusRegister, instructions.RegisterB),
+		a:       0x12, b: 0x04, expectedA: 0x12, expectedB: 0x04, expectedIP: 5,
+		check: func(t *testing.T, vm *VM) {
+			expectMemory(testFrame-4, 0x12)(t, vm)
+			expectMemory(testFrame-3, 0x04)(t, vm)
+		},
+	},
+	{
+		name:    "store16 unknown mode",
+		program: word(instructions.Store16, 0x0e, 0x00),
+		fault:   "unknown addressing mode 0x0e",
+	},
+	wordCase("add16", instructions.Add16, 0x12ff, 0x0001, 0x1300, 0),
+	wordCase("add16 carry", instructions.Add16, 0xffff, 0x0002, 0x0001, FlagCarry),
+	wordCase("add16 zero", instructions.Add16, 0xff00, 0x0100, 0x0000, FlagZero|FlagCarry),
+	wordCase("add16 signed overflow", instructions.Add16, 0x7fff, 0x0001, 0x8000, FlagNegative|FlagOverflow),
+	wordCase("sub16", instructions.Sub16, 0x1300, 0x0001, 0x12ff, 0),
+	wordCase("sub16 borrow", instructions.Sub16, 0x0001, 0x0002, 0xffff, FlagCarry|FlagNegative),
+	wordCase("sub16 signed overflow", instructions.Sub16, 0x8000, 0x0001, 0x7fff, FlagOverflow),
+	wordCase("cmp16 equal", instructions.Cmp16, 0x1234, 0x1234, 0x1234, FlagZero),
+	wordCase("cmp16 below", instructions.Cmp16, 0x1200, 0x1201, 0x1200, FlagCarry|FlagNegative),
+	wordCase("cmp16 above with zero low byte", instructions.Cmp16, 0x1300, 0x1200, 0x1300, 0),
+	{name: "inc16", program: []byte{instructions.Inc16}, a: 0x12, b: 0xff, expectedA: 0x13, expectedB: 0x00, expectedIP: 1},
+	{
+		name:    "inc16 wraps",
+		program: []byte{instructions.Inc16},
+		a:       0xff, b: 0xff,
+		expectedFlags: FlagZero | FlagCarry, expectedIP: 1,
+	},
+
+	// pointer modes address memory through the word at testData, or at an offset from the frame pointer
+	{
+		name:    "load pointer",
+		program: load(instructions.PointerWithOffset, 0x00, instructions.RegisterA),
+		setup: func(vm *VM) {
+			setMemory(testData, 0x03, 0x00)(vm)
+			setMemory(0x0300, 0x12)(vm)
+		},
+		expectedA: 0x12, expectedIP: 6,
+		check: expectMemory(testData+1, 0x00),
+	},
+	{
+		name:    "load pointer with negative offset",
+		program: load(instructions.PointerWithOffset, 0xff, instructions.RegisterA),
+		setup: func(vm *VM) {
+			setMemory(testData, 0x03, 0x00)(vm)
+			setMemory(0x02ff, 0x12)(vm)
+		},
+		expectedA: 0x12, expectedIP: 6,
+	},
+	{
+		name:    "load pointer plus register",
+		program: load(instructions.PointerPlusRegister, instructions.RegisterB, instructions.RegisterA),
+		b:       0x81,
+		setup: func(vm *VM) {
+			setMemory(testData, 0x03, 0x00)(vm)
+			setMemory(0x0381, 0x12)(vm)
+		},
+		expectedA: 0x12, expectedB: 0x81, expectedIP: 6,
+	},
+	{
+		name:    "load pointer post increment",
+		program: load(instructions.PointerPostIncrement, 0x00, instructions.RegisterA),
+		setup: func(vm *VM) {
+			setMemory(testData, 0x03, 0xff)(vm)
+			setMemory(0x03ff, 0x12)(vm)
+		},
+		expectedA: 0x12, expectedIP: 6,
+		check: func(t *testing.T, vm *VM) {
+			expectMemory(testData, 0x04)(t, vm)
+			expectMemory(testData+1, 0x00)(t, vm)
+		},
+	},
+	{
+		name:    "load pointer in frame plus register",
+		program: []byte{instructions.Load, 0x00, 0x07, instructions.PointerPlusRegister | instructions.PointerInFrame, instructions.RegisterB, instructions.RegisterA},
+		b:       0x02,
+		setup: func(vm *VM) {
+			setMemory(testFrame+7, 0x03, 0x00)(vm)
+			setMemory(0x0302, 0x12)(vm)
+		},
+		expectedA: 0x12, expectedB: 0x02, expectedIP: 6,
+	},
+	{
+		name:    "load pointer in frame with negative location",
+		program: []byte{instructions.Load, 0xff, 0xfe, instructions.PointerWithOffset | instructions.PointerInFrame, 0x00, instructions.RegisterA},
+		setup: func(vm *VM) {
+			setMemory(testFrame-2, 0x03, 0x00)(vm)
+			setMemory(0x0300, 0x12)(vm)
+		},
+		expectedA: 0x12, expectedIP: 6,
+	},
+	{
+		name:    "store pointer pre decrement",
+		program: store(instructions.RegisterA, instructions.PointerPreDecrement, 0x00),
+		a:       0x12, expectedA: 0x12, expectedIP: 6,
+		setup: setMemory(testData, 0x03, 0x00),
+		check: func(t *testing.T, vm *VM) {
+			expectMemory(0x02ff, 0x12)(t, vm)
+			expectMemory(testData, 0x02)(t, vm)
+			expectMemory(testData+1, 0xff)(t, vm)
+		},
+	},
+	{
+		name:    "store pointer in frame post increment",
+		program: []byte{instructions.Store, instructions.RegisterA, instructions.PointerPostIncrement | instructions.PointerInFrame, 0x00, 0x00, 0x07},
+		a:       0x12, expectedA: 0x12, expectedIP: 6,
+		setup: setMemory(testFrame+7, 0x03, 0x00),
+		check: func(t *testing.T, vm *VM) {
+			expectMemory(0x0300, 0x12)(t, vm)
+			expectMemory(testFrame+8, 0x01)(t, vm)
+		},
+	},
+	{
+		name:    "load16 pointer post increment steps a word",
+		program: word(instructions.Load16, instructions.PointerPostIncrement, 0x00),
+		setup: func(vm *VM) {
+			setMemory(testData, 0x03, 0x00)(vm)
+			setMemory(0x0300, 0x12, 0x34)(vm)
+		},
+		expectedA: 0x12, expectedB: 0x34, expectedIP: 5,
+		check: expectMemory(testData+1, 0x02),
+	},
+	{
+		name:    "store16 pointer pre decrement steps a word",
+		program: word(instructions.Store16, instructions.PointerPreDecrement, 0x00),
+		a:       0x12, b: 0x34, expectedA: 0x12, expectedB: 0x34, expectedIP: 5,
+		setup: setMemory(testData, 0x03, 0x00),
+		check: func(t *testing.T, vm *VM) {
+			expectMemory(0x02fe, 0x12)(t, vm)
+			expectMemory(0x02ff, 0x34)(t, vm)
+			expectMemory(testData+1, 0xfe)(t, vm)
+		},
+	},
+	{
+		name:    "jump through pointer with offset",
+		program: word(instructions.JumpIndirect, instructions.PointerWithOffset, 0x02),
+		setup: func(vm *VM) {
+			setMemory(testData, 0x03, 0x00)(vm)
+			setMemory(0x0302, 0x12, 0x34)(vm)
+		},
+		expectedIP: 0x1234,
+	},
+	{
+		name:    "load pointer unknown register",
+		program: load(instructions.PointerPlusRegister, 0x10, instructions.RegisterA),
+		fault:   "unknown register 0x10",
+	},
+
+	jumpCase("jump", instructions.Jump, 0, 0x1234),
+	jumpCase("jumpz taken", instructions.Jumpz, 0, 0x1234),
+	jumpCase("jumpz not taken", instructions.Jumpz, 1, 3),
+	jumpCase("jumpnz taken", instructions.Jumpnz, 1, 0x1234),
+	jumpCase("jumpnz not taken", instructions.Jumpnz, 0, 3),
+	flagJumpCase("jc taken", instructions.Jc, FlagCarry, 0x1234),
+	flagJumpCase("jc not taken", instructions.Jc, FlagZero|FlagNegative|FlagOverflow, 3),
+	flagJumpCase("jnc taken", instructions.Jnc, FlagZero|FlagNegative|FlagOverflow, 0x1234),
+	flagJumpCase("jnc not taken", instructions.Jnc, FlagCarry, 3),
+	flagJumpCase("jn taken", instructions.Jn, FlagNegative, 0x1234),
+	flagJumpCase("jn not taken", instructions.Jn, FlagZero|FlagCarry|FlagOverflow, 3),
+	flagJumpCase("je taken", instructions.Je, FlagZero, 0x1234),
+	flagJumpCase("je not taken", instructions.Je, FlagCarry|FlagNegative|FlagOverflow, 3),
+	flagJumpCase("jne taken", instructions.Jne, FlagCarry|FlagNegative|FlagOverflow, 0x1234),
+	flagJumpCase("jne not taken", instructions.Jne, FlagZero, 3),
+	// jumpz tests A rather than the zero flag
+	{
+		name:    "jumpz ignores flags",
+		program: []byte{instructions.Jumpz, 0x12, 0x34},
+		a:       1, flags: FlagZero,
+		expectedA: 1, expectedFlags: FlagZero, expectedIP: 3,
+	},
+
+	{
+		name:       "push immediate",
+		program:    []byte{instructions.Push, instructions.Immediate, 0x12},
+		expectedIP: 3,
+		check:      expectPushed(0x12),
+	},
+	{
+		name:    "push register",
+		program: []byte{instructions.Push, instructions.Register, instructions.RegisterB},
+		b:       0x12, expectedB: 0x12, expectedIP: 3,
+		check: expectPushed(0x12),
+	},
+	{
+		name:       "push register Y",
+		program:    []byte{instructions.Push, instructions.Register, instructions.RegisterY},
+		setup:      setRegister(instructions.RegisterY, 0x12),
+		expectedIP: 3,
+		check:      expectPushed(0x12),
+	},
+	{
+		name:       "push frame pointer with offset",
+		program:    []byte{instructions.Push, instructions.FramePointerWithOffset, 0x07},
+		setup:      setMemory(testFrame+7, 0x12),
+		expectedIP: 3,
+		check:      expectPushed(0x12),
+	},
+	{
+		name:    "push unknown mode",
+		program: []byte{instructions.Push, instructions.ImmediatePlusRegister, instructions.RegisterA},
+		fault:   "push: encountered unknown mode 0x01",
+	},
+	{
+		name:    "push unknown register",
+		program: []byte{instructions.Push, instructions.Register, 0x10},
+		fault:   "unknown register 0x10",
+	},
+	{
+		name:      "pop",
+		program:   []byte{instructions.Pop},
+		setup:     func(vm *VM) { vm.push(0x12) },
+		expectedA: 0x12, expectedIP: 1,
+		check: expectPushed(),
+	},
+	{name: "pop empty stack", program: []byte{instructions.Pop}, fault: ErrStackUnderflow.Error()},
+	{
+		name:       "pop register",
+		program:    []byte{instructions.PopRegister, instructions.RegisterX},
+		setup:      func(vm *VM) { vm.push(0x12) },
+		expectedIP: 2,
+		check: func(t *testing.T, vm *VM) {
+			expectRegister(instructions.RegisterX, 0x12)(t, vm)
+			expectPushed()(t, vm)
+		},
+	},
+	{
+		name:    "pop register empty stack",
+		program: []byte{instructions.PopRegister, instructions.RegisterC},
+		fault:   ErrStackUnderflow.Error(),
+	},
+	{
+		name:    "pop unknown register",
+		program: []byte{instructions.PopRegister, 0x10},
+		setup:   func(vm *VM) { vm.push(0x12) },
+		fault:   "unknown register 0x10",
+	},
+	{
+		name:    "call",
+		program: []byte{instructions.Call, 0x12, 0x34},
+		b:       0x56, expectedB: 0x56, expectedIP: 0x1234,
+		check: func(t *testing.T, vm *VM) {
+			// the return address is the instruction after the call, followed by the caller's frame pointer and B
+			expectPushed(0x56, testFrame&0xff, testFrame>>8, 0x03, 0x00)(t, vm)
+
+			if vm.fp != vm.sp {
+				t.Errorf("expected fp to point at the new frame, got fp 0x%04x and sp 0x%04x", vm.fp, vm.sp)
+			}
+		},
+	},
+	{
+		name:       "jump indirect",
+		program:    word(instructions.JumpIndirect, instructions.Immediate, 0x00),
+		setup:      setMemory(testData, 0x12, 0x34),
+		expectedIP: 0x1234,
+	},
+	{
+		// the register is a byte offset so A is the index of the second entry doubled
+		name:       "jump indirect through a table, A is the entry index doubled",
+		program:    word(instructions.JumpIndirect, instructions.ImmediatePlusRegister, instructions.RegisterA),
+		a:          0x02,
+		setup:      setMemory(testData, 0x00, 0x00, 0x12, 0x34),
+		expectedA:  0x02,
+		expectedIP: 0x1234,
+	},
+	{
+		name:       "jump indirect frame pointer with offset",
+		program:    word(instructions.JumpIndirect, instructions.FramePointerWithOffset, 0x07),
+		setup:      setMemory(testFrame+7, 0x12, 0x34),
+		expectedIP: 0x1234,
+	},
+	{
+		name:    "jump indirect unknown mode",
+		program: word(instructions.JumpIndirect, 0x0e, 0x00),
+		fault:   "unknown addressing mode 0x0e",
+	},
+	{
+		name:      "call indirect",
+		program:   word(instructions.CallIndirect, instructions.Immediate, 0x00),
+		b:         0x56,
+		setup:     setMemory(testData, 0x12, 0x34),
+		expectedB: 0x56, expectedIP: 0x1234,
+		check: expectPushed(0x56, testFrame&0xff, testFrame>>8, 0x05, 0x00),
+	},
+	{
+		name:    "call stack",
+		program: []byte{instructions.CallStack},
+		b:       0x56,
+		setup: func(vm *VM) {
+			vm.push16(0x1234)
+		},
+		expectedB: 0x56, expectedIP: 0x1234,
+		// the address is popped so the frame is where it would be for a call to an immediate address
+		check: expectPushed(0x56, testFrame&0xff, testFrame>>8, 0x01, 0x00),
+	},
+	{name: "call stack empty", program: []byte{instructions.CallStack}, fault: ErrStackUnderflow.Error()},
+	{
+		name:    "ret",
+		program: []byte{instructions.Ret},
+		a:       0x12,
+		setup: func(vm *VM) {
+			vm.push(0x34)
+			vm.push(1)
+			vm.ip = 0x5678
+			vm.saveState(false)
+			vm.ip = 0
+			vm.b = 0xff
+		},
+		// A is the return value so it isn't restored
+		expectedA: 0x12, expectedIP: 0x5678,
+		check: expectPushed(),
+	},
+	{
+		name:    "reti",
+		program: []byte{instructions.Reti},
+		a:       0x12,
+		b:       0x34,
+		flags:   FlagCarry,
+		setup: func(vm *VM) {
+			vm.ip = 0x5678
+			vm.saveState(true)
+			vm.inInterupt = true
+			vm.ip = 0
+			vm.a, vm.b, vm.flags = 0xff, 0xff, FlagZero
+		},
+		expectedA: 0x12, expectedB: 0x34, expectedFlags: FlagCarry, expectedIP: 0x5678,
+		check: func(t *testing.T, vm *VM) {
+			expectPushed()(t, vm)
+
+			if vm.inInterupt {
+				t.Error("expected the VM to leave the interupt")
+			}
+		},
+	},
+	{
+		name:       "rand",
+		program:    []byte{instructions.Rand},
+		expectedA:  uint8(rand.New(rand.NewSource(operationTestSeed)).Intn(255)),
+		expectedIP: 1,
+	},
+	{
+		name:    "sys",
+		program: []byte{instructions.Sys, 0x01},
+		a:       0x12, b: 0x34,
+		setup: func(vm *VM) {
+			vm.RegisterSyscall(0x01, func(vm *VM) error {
+				vm.a += vm.b
+				return nil
+			})
+		},
+		expectedA: 0x46, expectedB: 0x34, expectedIP: 2,
+	},
+	{name: "sys unregistered", program: []byte{instructions.Sys, 0x01}, fault: "no system call registered for 0x01"},
+	{
+		name:       "wait",
+		program:    []byte{instructions.Wait},
+		expectedIP: 1,
+		check: func(t *testing.T, vm *VM) {
+			if !vm.Waiting {
+				t.Error("expected the VM to wait")
+			}
+		},
+	},
+	{name: "db", program: []byte{instructions.Db}, fault: fmt.Sprintf("unknown instruction 0x%02x", instructions.Db)},
+	{name: "dw", program: []byte{instructions.Dw, 0x00}, fault: fmt.Sprintf("unknown instruction 0x%02x", instructions.Dw)},
+	{name: "unknown", program: []byte{0xff}, fault: "unknown instruction 0xff"},
+}
+
+func TestVM_Operations(t *testing.T) {
+	for _, tc := range operationTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := New()
+			vm.Seed(operationTestSeed)
+			vm.Load(tc.program)
+			vm.a, vm.b, vm.flags = tc.a, tc.b, tc.flags
+			vm.fp = testFrame
+
+			if tc.setup != nil {
+				tc.setup(vm)
+			}
+
+			err := vm.Tick()
+
+			if tc.fault != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.fault) {
+					t.Fatalf("expected a fault with %q, got %v", tc.fault, err)
+				}
+
+				if fault := err.(*Fault); fault.IP != 0 {
+					t.Errorf("expected the fault at 0x0000, got 0x%04x", fault.IP)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if vm.a != tc.expectedA || vm.b != tc.expectedB {
+				t.Errorf("expected A 0x%02x and B 0x%02x, got A 0x%02x and B 0x%02x", tc.expectedA, tc.expectedB, vm.a, vm.b)
+			}
+
+			if vm.flags != tc.expectedFlags {
+				t.Errorf("expected flags %s, got %s", formatFlags(tc.expectedFlags), formatFlags(vm.flags))
+			}
+
+			if vm.ip != tc.expectedIP {
+				t.Errorf("expected ip to be 0x%04x, got 0x%04x", tc.expectedIP, vm.ip)
+			}
+
+			if tc.check != nil {
+				tc.check(t, vm)
+			}
+		})
+	}
+}
+
+func TestVM_Operations_CoverEveryOpcode(t *testing.T) {
+	tested := map[uint8]bool{}
+	for _, tc := range operationTestCases {
+		tested[tc.program[0]] = true
+	}
+
+	for opcode, name := range instructions.Names {
+		if !tested[opcode] {
+			t.Errorf("no operation test for %s", name)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package vm
+
+// Profile is the number of instructions and cycles executed at each address while profiling
+type Profile struct {
+	Instructions [memorySize + 1]uint64
+	Cycles       [memorySize + 1]uint64
+}
+
+// StartProfile counts the instructions executed at each address and the cycles they use
+// in the returned profile until StopProfile is called
+func (vm *VM) StartProfile() *Profile {
+	vm.profile = &Profile{}
+	return vm.profile
+}
+
+// StopProfile stops updating the profile returned by StartProfile
+func (vm *VM) StopProfile() {
+	vm.profile = nil
+}
@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// RegionKind is the kind of a region of memory
+type RegionKind uint8
+
+const (
+	// RegionData is writable memory, memory that isn't in any other region is data
+	RegionData RegionKind = iota
+	// RegionCode is the program's instructions
+	RegionCode
+	// RegionROData is data the program can read but not write
+	RegionROData
+	// RegionStack is the stack region set with SetStack
+	RegionStack
+	// RegionIO is memory mapped registers shared with the host
+	RegionIO
+)
+
+func (k RegionKind) String() string {
+	switch k {
+	case RegionData:
+		return "data"
+	case RegionCode:
+		return "code"
+	case RegionROData:
+		return "rodata"
+	case RegionStack:
+		return "stack"
+	case RegionIO:
+		return "io"
+	default:
+		return "unknown"
+	}
+}
+
+// Region is a range of memory of the same kind. End is exclusive, so the last byte of memory can't be
+// in a region and is always data.
+type Region struct {
+	Kind  RegionKind
+	Start uint16
+	End   uint16
+}
+
+// Protection sets what happens when the program stores to code or read only data
+type Protection int
+
+const (
+	// ProtectionOff allows all writes, which is needed by programs that modify their own code
+	ProtectionOff Protection = iota
+	// ProtectionLog allows writes to protected regions and reports them to the violation handler
+	ProtectionLog
+	// ProtectionFault faults on writes to protected regions
+	ProtectionFault
+)
+
+// ErrWriteProtected is returned in a fault when the program stores to code or read only data
+var ErrWriteProtected = errors.New("write to protected memory")
+
+// ProtectionViolation is a store to a protected region
+type ProtectionViolation struct {
+	IP    uint16
+	Addr  uint16
+	Value uint8
+	Kind  RegionKind
+}
+
+// ProtectionViolationHandler is called for each store to a protected region when protection is ProtectionLog
+type ProtectionViolationHandler func(v ProtectionViolation)
+
+// SetRegions marks the kind of each region of memory, memory that isn't in a region is data.
+// Regions are cleared when a program is loaded so they should be set after Load.
+func (vm *VM) SetRegions(regions []Region) error {
+	vm.regions = [memorySize + 1]RegionKind{}
+
+	for _, r := range regions {
+		if r.End < r.Start {
+			return fmt.Errorf("%s region 0x%04x-0x%04x ends before it starts", r.Kind, r.Start, r.End)
+		}
+
+		for addr := uint32(r.Start); addr < uint32(r.End); addr++ {
+			vm.regions[addr] = r.Kind
+		}
+	}
+
+	return nil
+}
+
+// RegionAt returns the kind of memory at addr
+func (vm *VM) RegionAt(addr uint16) RegionKind {
+	if addr >= vm.stackLimit && addr <= vm.stackTop {
+		return RegionStack
+	}
+
+	return vm.regions[addr]
+}
+
+// SetProtection sets what happens when the program stores to code or read only data
+func (vm *VM) SetProtection(p Protection) {
+	vm.protection = p
+}
+
+// OnProtectionViolation sets the handler called for stores to protected regions when protection is ProtectionLog,
+// violations are written to the standard logger if there is no handler
+func (vm *VM) OnProtectionViolation(h ProtectionViolationHandler) {
+	vm.onProtectionViolation = h
+}
+
+func (k RegionKind) protected() bool {
+	return k == RegionCode || k == RegionROData
+}
+
+// checkWrite returns an error if the program isn't allowed to store value at addr
+func (vm *VM) checkWrite(addr uint16, value uint8) error {
+	kind := vm.regions[addr]
+	if !kind.protected() {
+		return nil
+	}
+
+	if vm.protection == ProtectionFault {
+		return fmt.Errorf("%w: 0x%04x is %s", ErrWriteProtected, addr, kind)
+	}
+
+	v := ProtectionViolation{IP: vm.ip, Addr: addr, Value: value, Kind: kind}
+
+	if vm.onProtectionViolation != nil {
+		vm.onProtectionViolation(v)
+	} else {
+		log.Printf("write of 0x%02x to %s at 0x%04x from 0x%04x", v.Value, v.Kind, v.Addr, v.IP)
+	}
+
+	return nil
+}
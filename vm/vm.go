@@ -1,78 +1,312 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"math"
 	"math/rand"
 	"time"
 
 	"github.com/andrewesterhuizen/penpal/instructions"
 )
 
+// memorySize is the highest address, memory has one more byte so that it can be indexed by any uint16
 const memorySize = 0xffff
 
+// DefaultStackTop is the address of the first byte pushed to the stack
+const DefaultStackTop = memorySize - 1
+
+// maxCallChain limits the number of frames recorded in a fault in case the frame pointers have been overwritten
+const maxCallChain = 64
+
+var (
+	// ErrStackOverflow is returned in a fault when a push would write below the stack region
+	ErrStackOverflow = errors.New("stack overflow")
+	// ErrStackUnderflow is returned in a fault when a pop is executed with an empty stack
+	ErrStackUnderflow = errors.New("stack underflow")
+	// ErrDivisionByZero is returned in a fault when div is executed with B set to 0
+	ErrDivisionByZero = errors.New("division by zero")
+	// ErrNoReturn is returned by Call when the subroutine doesn't return
+	ErrNoReturn = errors.New("subroutine did not return")
+)
+
+// the bits of the flags register, they are set by the arithmetic and logic instructions and by cmp
+const (
+	// FlagZero is set when the result is 0
+	FlagZero uint8 = 1 << iota
+	// FlagCarry is set when an addition carries out of bit 7 or a subtraction borrows, shifts set it to the last bit shifted out
+	FlagCarry
+	// FlagNegative is set when bit 7 of the result is set
+	FlagNegative
+	// FlagOverflow is set when the signed result of an addition or subtraction doesn't fit in a byte
+	FlagOverflow
+)
+
+// interuptCount is the number of entries in the interupt table following the entry point
+const interuptCount = 3
+
+// Syscall is a host function called by the sys instruction. Arguments are passed in the A and B registers
+// or on the stack and results are returned in A.
+type Syscall func(vm *VM) error
+
+// InteruptReturnHandler is called when interupt n returns with the number of cycles spent handling it
+type InteruptReturnHandler func(n int, cycles uint64)
+
+// WriteHandler is called after the program stores a value to a mapped address
+type WriteHandler func(addr uint16, value uint8)
+
 type VM struct {
 	Halted bool
+	// Waiting is set by the wait instruction, the VM does not execute instructions until an interupt is raised
+	Waiting bool
 
 	ip     uint16
 	sp     uint16
 	fp     uint16
 	a      uint8
 	b      uint8
-	memory [memorySize]uint8
+	c      uint8
+	d      uint8
+	x      uint8
+	y      uint8
+	flags  uint8
+	memory [memorySize + 1]uint8
+
+	// the stack grows down from stackTop to stackLimit, if stackSize is 0 the stack can grow
+	// down to the end of the loaded program. stackErr is set when a push or pop crosses a limit
+	// and is raised as a fault once the instruction has executed.
+	stackTop   uint16
+	stackSize  uint16
+	stackLimit uint16
+	stackErr   error
+	programEnd uint16
+
+	watchpoints []watchpoint
+	watched     [(memorySize + 1) / 64]uint64
+	nextWatchID int
+
+	regions               [memorySize + 1]RegionKind
+	protection            Protection
+	onProtectionViolation ProtectionViolationHandler
 
 	// TODO: make nested interupts work
-	inInterupt bool
+	inInterupt       bool
+	pendingInterupts [interuptCount]bool
+	// interuptPending is set when any interupt is pending so that Tick doesn't have to check each one
+	interuptPending bool
+
+	cycles              uint64
+	instructionCount    uint64
+	interupt            int
+	interuptStartCycles uint64
+	onInteruptReturn    InteruptReturnHandler
+
+	// history is set while recording steps so they can be undone, see Record
+	history *history
+	// profile is set while profiling, see StartProfile
+	profile *Profile
+	// coverage is set while recording coverage, see StartCoverage
+	coverage *Coverage
+
+	// decoded caches instructions by address, it's indexed by any uint16 so a jump past the end of memory faults
+	// when the instruction is decoded. decodedEnd is the last byte covered by a decoded instruction,
+	// writes above it don't need to invalidate anything.
+	decoded    [memorySize + 1]decodedInstruction
+	decodedEnd uint16
+
+	syscalls      [256]Syscall
+	writeHandlers map[uint16]WriteHandler
+	// mappedWrites has a bit set for each address with a write handler so that stores don't need a map lookup
+	mappedWrites [(memorySize + 1) / 64]uint64
+	rand         *rand.Rand
 }
 
 func New() *VM {
-	rand.Seed(time.Now().UnixNano())
+	vm := VM{
+		writeHandlers: map[uint16]WriteHandler{},
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		stackTop:      DefaultStackTop,
+	}
 
-	vm := VM{}
 	vm.init()
 	return &vm
 }
 
+// IP returns the address of the next instruction to execute
+func (vm *VM) IP() uint16 {
+	return vm.ip
+}
+
+// Flags returns the flags register, see FlagZero, FlagCarry, FlagNegative and FlagOverflow
+func (vm *VM) Flags() uint8 {
+	return vm.flags
+}
+
+// Cycles returns the number of cycles executed since the program was loaded
+func (vm *VM) Cycles() uint64 {
+	return vm.cycles
+}
+
+// Instructions returns the number of instructions executed since the program was loaded
+func (vm *VM) Instructions() uint64 {
+	return vm.instructionCount
+}
+
+// OnInteruptReturn sets a handler that is called each time an interupt handler returns
+func (vm *VM) OnInteruptReturn(h InteruptReturnHandler) {
+	vm.onInteruptReturn = h
+}
+
+// RegisterSyscall sets the host function called by "sys n"
+func (vm *VM) RegisterSyscall(n uint8, fn Syscall) {
+	vm.syscalls[n] = fn
+}
+
+// MapWrite sets a handler that is called when the program stores a value to addr,
+// this is used for memory mapped registers that need to be handled as soon as they are written
+func (vm *VM) MapWrite(addr uint16, h WriteHandler) {
+	vm.writeHandlers[addr] = h
+	vm.mappedWrites[addr/64] |= 1 << (addr % 64)
+}
+
+// SetStack sets the stack region to the size bytes ending at top, the stack pointer starts at top and
+// crossing either end of the region is a fault. If size is 0 the stack can grow down to the end of the program.
+// It resets the stack so it should be called before the program starts.
+func (vm *VM) SetStack(top uint16, size uint16) error {
+	if top >= memorySize {
+		return fmt.Errorf("stack top 0x%04x is outside of memory", top)
+	}
+
+	if uint32(size) > uint32(top)+1 {
+		return fmt.Errorf("stack of %d bytes does not fit below 0x%04x", size, top)
+	}
+
+	vm.stackTop = top
+	vm.stackSize = size
+	vm.resetStack()
+	return nil
+}
+
+func (vm *VM) resetStack() {
+	vm.sp = vm.stackTop
+	vm.fp = vm.stackTop
+	vm.stackErr = nil
+
+	if vm.stackSize > 0 {
+		vm.stackLimit = vm.stackTop - vm.stackSize + 1
+	} else if vm.programEnd <= vm.stackTop {
+		vm.stackLimit = vm.programEnd
+	} else {
+		vm.stackLimit = 0
+	}
+}
+
+// Seed seeds the random number generator used by the rand instruction
+func (vm *VM) Seed(seed int64) {
+	vm.rand.Seed(seed)
+}
+
 func (vm *VM) init() {
+	vm.Halted = false
+	vm.Waiting = false
+	vm.cycles = 0
+	vm.instructionCount = 0
+	vm.inInterupt = false
+	vm.pendingInterupts = [interuptCount]bool{}
+	vm.interuptPending = false
 	vm.ip = 0
-	vm.sp = memorySize - 1
-	vm.fp = memorySize - 1
+	vm.resetStack()
+	vm.resetDecoded()
+
+	if vm.history != nil {
+		vm.Record(len(vm.history.steps))
+	}
+}
+
+// Fault is returned by Tick when the program can't be executed, the VM is halted when a fault occurs
+type Fault struct {
+	IP  uint16
+	Err error
+	// CallChain is the return address of each frame on the stack when the fault occurred, innermost first
+	CallChain []uint16
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("fault at 0x%04x: %s", f.IP, f.Err)
+}
+
+func (f *Fault) Unwrap() error {
+	return f.Err
 }
 
-func (vm *VM) getValueInRegister(r byte) byte {
+func (vm *VM) getValueInRegister(r byte) (byte, error) {
 	switch r {
 	case instructions.RegisterA:
-		return vm.a
+		return vm.a, nil
 	case instructions.RegisterB:
-		return vm.b
+		return vm.b, nil
+	case instructions.RegisterC:
+		return vm.c, nil
+	case instructions.RegisterD:
+		return vm.d, nil
+	case instructions.RegisterX:
+		return vm.x, nil
+	case instructions.RegisterY:
+		return vm.y, nil
 	default:
-		log.Fatalf("unknown register 0x%02x", r)
-		return 0
+		return 0, fmt.Errorf("unknown register 0x%02x", r)
 	}
 }
 
-func (vm *VM) getRegister(r byte) *byte {
+func (vm *VM) getRegister(r byte) (*byte, error) {
 	switch r {
 	case instructions.RegisterA:
-		return &vm.a
+		return &vm.a, nil
 	case instructions.RegisterB:
-		return &vm.b
+		return &vm.b, nil
+	case instructions.RegisterC:
+		return &vm.c, nil
+	case instructions.RegisterD:
+		return &vm.d, nil
+	case instructions.RegisterX:
+		return &vm.x, nil
+	case instructions.RegisterY:
+		return &vm.y, nil
 	default:
-		log.Fatalf("unknown register 0x%02x", r)
-		return &vm.a
+		return nil, fmt.Errorf("unknown register 0x%02x", r)
 	}
 }
 
 func (vm *VM) push(value uint8) {
-	vm.memory[vm.sp] = value
+	if vm.sp < vm.stackLimit || vm.sp > vm.stackTop {
+		vm.setStackErr(ErrStackOverflow)
+		return
+	}
+
+	if vm.isWatched(vm.sp) {
+		vm.watchWrite(vm.ip, vm.sp, value)
+	}
+
+	vm.write(vm.sp, value)
 	vm.sp--
 }
 
 func (vm *VM) pop() uint8 {
+	if vm.sp >= vm.stackTop {
+		vm.setStackErr(ErrStackUnderflow)
+		return 0
+	}
+
 	vm.sp++
 	return vm.memory[vm.sp]
 }
 
+func (vm *VM) setStackErr(err error) {
+	if vm.stackErr == nil {
+		vm.stackErr = err
+	}
+}
+
 func (vm *VM) push16(n uint16) {
 	h := uint8((n & 0xff00) >> 8)
 	l := uint8(n & 0xff)
@@ -88,19 +322,6 @@ func (vm *VM) pop16() uint16 {
 	return (h << 8) | l
 }
 
-func (vm *VM) fetch() uint8 {
-	vm.ip++
-	return vm.memory[vm.ip]
-}
-
-func (vm *VM) fetch16() uint16 {
-	vm.ip++
-	h := uint16(vm.memory[vm.ip])
-	vm.ip++
-	l := uint16(vm.memory[vm.ip])
-	return (h << 8) | l
-}
-
 func (vm *VM) getRelativeAddress(addr uint16, offset int8) uint16 {
 	if offset >= 0 {
 		addr += uint16(offset)
@@ -116,15 +337,153 @@ func (vm *VM) getFramePointerRelativeAddress(offset int8) uint16 {
 	return vm.getRelativeAddress(vm.fp, offset)
 }
 
+// getAddress resolves the address of a load or store of size bytes for the addressing mode
+func (vm *VM) getAddress(addr uint16, mode byte, modeArg byte, size uint16) (uint16, error) {
+	switch mode {
+	case instructions.Immediate:
+		return vm.getRelativeAddress(addr, int8(modeArg)), nil
+
+	case instructions.FramePointerWithOffset:
+		return vm.getFramePointerRelativeAddress(int8(modeArg)), nil
+
+	case instructions.PointerWithOffset,
+		instructions.PointerPlusRegister,
+		instructions.PointerPostIncrement,
+		instructions.PointerPreDecrement,
+		instructions.PointerWithOffset | instructions.PointerInFrame,
+		instructions.PointerPlusRegister | instructions.PointerInFrame,
+		instructions.PointerPostIncrement | instructions.PointerInFrame,
+		instructions.PointerPreDecrement | instructions.PointerInFrame:
+		return vm.getPointerAddress(addr, mode, modeArg, size)
+
+	case instructions.ImmediatePlusRegister,
+		instructions.ImmediateMinusRegister,
+		instructions.FramePointerPlusRegister,
+		instructions.FramePointerMinusRegister:
+		// register offsets are handled below
+
+	default:
+		return 0, fmt.Errorf("encountered unknown addressing mode 0x%02x", mode)
+	}
+
+	offset, err := vm.getValueInRegister(modeArg)
+	if err != nil {
+		return 0, err
+	}
+
+	switch mode {
+	case instructions.ImmediatePlusRegister:
+		return addr + uint16(offset), nil
+	case instructions.ImmediateMinusRegister:
+		return addr - uint16(offset), nil
+	case instructions.FramePointerPlusRegister:
+		return vm.fp + uint16(offset), nil
+	default:
+		return vm.fp - uint16(offset), nil
+	}
+}
+
+// getPointerLocation returns the address of the word holding the pointer of a pointer mode
+func (vm *VM) getPointerLocation(addr uint16, mode byte) uint16 {
+	if mode&instructions.PointerInFrame != 0 {
+		return vm.fp + addr
+	}
+
+	return addr
+}
+
+// getPointerAddress resolves the address of a pointer mode from the pointer stored in memory
+func (vm *VM) getPointerAddress(addr uint16, mode byte, modeArg byte, size uint16) (uint16, error) {
+	location := vm.getPointerLocation(addr, mode)
+
+	if vm.isWatched(location) {
+		vm.watchRead(vm.ip, location)
+	}
+
+	if vm.isWatched(location + 1) {
+		vm.watchRead(vm.ip, location+1)
+	}
+
+	pointer := vm.read16(location)
+
+	switch mode &^ instructions.PointerInFrame {
+	case instructions.PointerPlusRegister:
+		offset, err := vm.getValueInRegister(modeArg)
+		if err != nil {
+			return 0, err
+		}
+
+		return pointer + uint16(offset), nil
+
+	case instructions.PointerPostIncrement:
+		return pointer, nil
+
+	case instructions.PointerPreDecrement:
+		return pointer - size, nil
+
+	default:
+		return vm.getRelativeAddress(pointer, int8(modeArg)), nil
+	}
+}
+
+// updatePointer steps the pointer of a post increment or pre decrement mode by the size of the operand,
+// the pointer is checked and stored like a word stored by the instruction so it must be called before next
+func (vm *VM) updatePointer(addr uint16, mode byte, size uint16) error {
+	var step uint16
+
+	switch mode &^ instructions.PointerInFrame {
+	case instructions.PointerPostIncrement:
+		step = size
+	case instructions.PointerPreDecrement:
+		step = -size
+	default:
+		return nil
+	}
+
+	location := vm.getPointerLocation(addr, mode)
+	pointer := vm.read16(location) + step
+	h := uint8(pointer >> 8)
+	l := uint8(pointer)
+
+	if vm.protection != ProtectionOff {
+		err := vm.checkWrite(location, h)
+		if err == nil {
+			err = vm.checkWrite(location+1, l)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	vm.store(vm.ip, location, h)
+	vm.store(vm.ip, location+1, l)
+	return nil
+}
+
 func (vm *VM) saveState(interupt bool) {
-	// a register is used for return value in subroutines so we don't save it for non interupts
+	// a register is used for return value in subroutines so we don't save it for non interupts,
+	// flags are saved for interupts so that a handler can't change a comparison in the code it interupted.
+	// c and d are free for subroutines to use and x and y are saved by the subroutines that use them, but
+	// an interupt can happen anywhere so it saves them all.
 	if interupt {
+		vm.push(vm.y)
+		vm.push(vm.x)
+		vm.push(vm.d)
+		vm.push(vm.c)
 		vm.push(vm.a)
+		vm.push(vm.flags)
 	}
 
 	vm.push(vm.b)
 	vm.push16(vm.fp)
 	vm.push16(vm.ip)
+
+	// leave fp at the last complete frame so that the call chain of the fault can be followed
+	if vm.stackErr != nil {
+		return
+	}
+
 	vm.fp = vm.sp
 }
 
@@ -135,10 +494,14 @@ func (vm *VM) restoreState(interupt bool) {
 	vm.b = vm.pop()
 
 	if interupt {
+		vm.flags = vm.pop()
 		vm.a = vm.pop()
+		vm.c = vm.pop()
+		vm.d = vm.pop()
+		vm.x = vm.pop()
+		vm.y = vm.pop()
 	}
 
-	vm.sp = vm.fp
 	vm.fp = prevfp
 }
 
@@ -157,292 +520,320 @@ func (vm *VM) ret() {
 	}
 }
 
-func (vm *VM) callInterupt(addr uint16) {
+func (vm *VM) callInterupt(n int) {
 	vm.inInterupt = true
+	vm.interupt = n
+	vm.interuptStartCycles = vm.cycles
 	vm.saveState(true)
-	vm.ip = addr
+	vm.ip = interuptAddress(n)
 }
 
 func (vm *VM) retFromInterupt() {
 	vm.restoreState(true)
 	vm.inInterupt = false
-}
 
-func (vm *VM) Interupt(n int) {
-	if vm.inInterupt {
-		return
+	if vm.onInteruptReturn != nil {
+		vm.onInteruptReturn(vm.interupt, vm.cycles-vm.interuptStartCycles)
 	}
+}
 
-	// only 3 interupts for now
-	if n >= 3 {
+// Interupt raises interupt n. The interupt is latched until the VM is able to service it,
+// so an interupt raised while another is being handled is delayed rather than lost.
+func (vm *VM) Interupt(n int) {
+	if n < 0 || n >= interuptCount {
 		return
 	}
 
-	// each jump instruction is 3 bytes wide
-	// address of interupt jump location = entry point + (interupt number * 3 bytes)
-	addr := uint16(3 + (n * 3))
-
 	// if interupt has been set
-	if vm.memory[addr] > 0 {
-		vm.callInterupt(addr)
+	if vm.memory[interuptAddress(n)] > 0 {
+		vm.pendingInterupts[n] = true
+		vm.interuptPending = true
+		vm.Waiting = false
 	}
 }
 
-func (vm *VM) execute(instruction uint8) {
-	switch instruction {
-	case instructions.Swap:
-		vm.a, vm.b = vm.b, vm.a
-		vm.ip++
+// CancelInterupt clears interupt n if it has been raised and not serviced yet
+func (vm *VM) CancelInterupt(n int) {
+	if n < 0 || n >= interuptCount {
+		return
+	}
 
-	case instructions.Mov:
-		register := vm.fetch()
-		value := vm.fetch()
+	vm.pendingInterupts[n] = false
+	vm.interuptPending = vm.pendingInterupts != [interuptCount]bool{}
+}
 
-		dest := vm.getRegister(register)
-		*dest = value
+func (vm *VM) serviceInterupts() {
+	if vm.inInterupt {
+		return
+	}
 
-		vm.ip++
+	// lower interupt numbers have priority, the rest are left pending until this interupt returns
+	for n, pending := range vm.pendingInterupts {
+		if !pending {
+			continue
+		}
 
-	case instructions.Store:
-		srcRegister := vm.fetch()
-		mode := vm.fetch()
-		modeArg := vm.fetch()
-		addr := vm.fetch16()
+		if vm.history != nil {
+			vm.beginStep(n)
+		}
 
-		value := vm.getValueInRegister(srcRegister)
+		vm.pendingInterupts[n] = false
+		vm.interuptPending = vm.pendingInterupts != [interuptCount]bool{}
+		vm.callInterupt(n)
+		return
+	}
 
-		switch mode {
-		case instructions.Immediate:
-			vm.memory[vm.getRelativeAddress(addr, int8(modeArg))] = value
+	vm.interuptPending = false
+}
 
-		case instructions.ImmediatePlusRegister:
-			offset := vm.getValueInRegister(modeArg)
-			vm.memory[addr+uint16(offset)] = value
+// each jump instruction is 3 bytes wide
+// address of interupt jump location = entry point + (interupt number * 3 bytes)
+func interuptAddress(n int) uint16 {
+	return uint16(3 + (n * 3))
+}
 
-		case instructions.ImmediateMinusRegister:
-			offset := vm.getValueInRegister(modeArg)
-			vm.memory[addr-uint16(offset)] = value
+func (vm *VM) Load(instructions []uint8) {
+	vm.programEnd = uint16(len(instructions))
+	if len(instructions) > memorySize {
+		vm.programEnd = memorySize
+	}
 
-		case instructions.FramePointerWithOffset:
-			vm.memory[vm.getFramePointerRelativeAddress(int8(modeArg))] = value
+	vm.init()
+	vm.regions = [memorySize + 1]RegionKind{}
+	copy(vm.memory[:], instructions)
+}
 
-		case instructions.FramePointerPlusRegister:
-			a := vm.fp + uint16(vm.getValueInRegister(modeArg))
-			vm.memory[a] = value
+// GetRegister returns the value in register r
+func (vm *VM) GetRegister(r uint8) (uint8, error) {
+	return vm.getValueInRegister(r)
+}
 
-		case instructions.FramePointerMinusRegister:
-			a := vm.fp - uint16(vm.getValueInRegister(modeArg))
-			vm.memory[a] = value
+// SetRegister sets the value in register r
+func (vm *VM) SetRegister(r uint8, value uint8) error {
+	dest, err := vm.getRegister(r)
+	if err != nil {
+		return err
+	}
 
-		default:
-			log.Fatalf("encountered unknown addressing mode 0x%02x", mode)
-		}
+	*dest = value
+	return nil
+}
 
-		vm.ip++
+// Push pushes value onto the stack
+func (vm *VM) Push(value uint8) {
+	vm.push(value)
+}
 
-	case instructions.Load:
-		addr := vm.fetch16()
-		mode := vm.fetch()
-		modeArg := vm.fetch()
-		destRegister := vm.fetch()
+// Pop pops a value from the stack
+func (vm *VM) Pop() uint8 {
+	return vm.pop()
+}
 
-		dest := vm.getRegister(destRegister)
+// Call calls the subroutine at addr with no arguments as if it was called from the current ip and executes it until
+// it returns, or until budget instructions have been executed. Faults are returned as they are by Tick, an error
+// wrapping ErrNoReturn is returned if the VM halts, waits for an interupt or uses the budget before it returns.
+func (vm *VM) Call(addr uint16, budget int) error {
+	sp := vm.sp
 
-		switch mode {
-		case instructions.Immediate:
-			*dest = vm.memory[vm.getRelativeAddress(addr, int8(modeArg))]
+	vm.push(0)
+	vm.call(addr)
 
-		case instructions.ImmediatePlusRegister:
-			offset := vm.getValueInRegister(modeArg)
-			*dest = vm.memory[addr+uint16(offset)]
+	if vm.stackErr != nil {
+		return vm.fault(vm.ip, vm.stackErr)
+	}
 
-		case instructions.ImmediateMinusRegister:
-			offset := vm.getValueInRegister(modeArg)
-			*dest = vm.memory[addr-uint16(offset)]
+	for i := 0; i < budget; i++ {
+		err := vm.Tick()
+		if err != nil {
+			return err
+		}
 
-		case instructions.FramePointerWithOffset:
-			*dest = vm.memory[vm.getFramePointerRelativeAddress(int8(modeArg))]
+		switch {
+		case vm.sp >= sp && !vm.inInterupt:
+			return nil
+		case vm.Halted:
+			return fmt.Errorf("%w: halted at 0x%04x", ErrNoReturn, vm.ip)
+		case vm.Waiting:
+			return fmt.Errorf("%w: waiting for an interupt at 0x%04x", ErrNoReturn, vm.ip)
+		}
+	}
 
-		case instructions.FramePointerPlusRegister:
-			a := vm.fp + uint16(vm.getValueInRegister(modeArg))
-			*dest = vm.memory[a]
+	return fmt.Errorf("%w within %d instructions", ErrNoReturn, budget)
+}
 
-		case instructions.FramePointerMinusRegister:
-			a := vm.fp - uint16(vm.getValueInRegister(modeArg))
-			*dest = vm.memory[a]
-		default:
-			log.Fatalf("encountered unknown addressing mode 0x%02x", mode)
-		}
+// GetMemorySection returns a slice of memory, it should only be read as writes
+// through it bypass the decoded instruction cache, use SetMemory to write
+func (vm *VM) GetMemorySection(start uint16, n uint16) []byte {
+	return vm.memory[start : start+n]
+}
 
-		vm.ip++
+func (vm *VM) GetMemory(addr uint16) uint8 {
+	return vm.memory[addr]
+}
 
-	case instructions.Add:
-		vm.a += vm.b
-		vm.ip++
+func (vm *VM) SetMemory(addr uint16, value uint8) {
+	vm.write(addr, value)
+}
 
-	case instructions.Sub:
-		vm.a -= vm.b
-		vm.ip++
+func (vm *VM) PrintReg() {
+	fmt.Printf("a: 0x%02x | b: 0x%02x | c: 0x%02x | d: 0x%02x | x: 0x%02x | y: 0x%02x | flags: %s\n",
+		vm.a, vm.b, vm.c, vm.d, vm.x, vm.y, formatFlags(vm.flags))
+}
 
-	case instructions.Mul:
-		vm.a *= vm.b
-		vm.ip++
+// formatFlags returns the names of the set flags in the order ZCNV with - for those that are clear
+func formatFlags(flags uint8) string {
+	names := []byte("ZCNV")
 
-	case instructions.Div:
-		vm.a /= vm.b
-		vm.ip++
+	for i := range names {
+		if flags&(1<<i) == 0 {
+			names[i] = '-'
+		}
+	}
 
-	case instructions.Shl:
-		vm.a = vm.a << vm.b
-		vm.ip++
+	return string(names)
+}
 
-	case instructions.Shr:
-		vm.a = vm.a >> vm.b
-		vm.ip++
+func (vm *VM) PrintMem(start uint16, n uint16) {
+	for i := start; i < start+n; i++ {
+		if vm.sp == i {
+			fmt.Printf("sp ->")
+		} else {
+			fmt.Print("     ")
+		}
 
-	case instructions.And:
-		vm.a = vm.a & vm.b
-		vm.ip++
+		fmt.Printf("%04x: 0x%02x", i, vm.memory[i])
 
-	case instructions.Or:
-		vm.a = vm.a | vm.b
-		vm.ip++
+		if vm.fp == i {
+			fmt.Printf("<- fp\n")
+		} else {
+			fmt.Print("\n")
+		}
+	}
+}
 
-	case instructions.GT:
-		vm.a = boolToByte(vm.a > vm.b)
-		vm.ip++
+// Run executes up to budget instructions and returns the number of instructions executed.
+// It returns early if the VM halts, faults or waits for an interupt.
+func (vm *VM) Run(budget int) (int, error) {
+	if budget <= 0 {
+		return 0, nil
+	}
 
-	case instructions.GTE:
-		vm.a = boolToByte(vm.a >= vm.b)
-		vm.ip++
+	start := vm.instructionCount
+	err := vm.run(uint64(budget), math.MaxUint64)
+	return int(vm.instructionCount - start), err
+}
 
-	case instructions.LT:
-		vm.a = boolToByte(vm.a < vm.b)
-		vm.ip++
+// RunCycles executes instructions until at least budget cycles have been used and returns the number of cycles used.
+// It returns early if the VM halts, faults or waits for an interupt.
+func (vm *VM) RunCycles(budget uint64) (uint64, error) {
+	start := vm.cycles
+	err := vm.run(math.MaxUint64, budget)
+	return vm.cycles - start, err
+}
 
-	case instructions.LTE:
-		vm.a = boolToByte(vm.a <= vm.b)
-		vm.ip++
+// Tick executes the next instruction, any error returned is a *Fault
+func (vm *VM) Tick() error {
+	return vm.run(1, math.MaxUint64)
+}
 
-	case instructions.Eq:
-		vm.a = boolToByte(vm.a == vm.b)
-		vm.ip++
+// run executes instructions until either budget is used, the VM halts, faults or waits for an interupt.
+// The whole loop is in one function so that the only call for most instructions is the dispatch itself.
+func (vm *VM) run(instructionBudget uint64, cycleBudget uint64) error {
+	startInstructions := vm.instructionCount
+	startCycles := vm.cycles
 
-	case instructions.Neq:
-		vm.a = boolToByte(vm.a != vm.b)
-		vm.ip++
+	for !vm.Halted && vm.instructionCount-startInstructions < instructionBudget && vm.cycles-startCycles < cycleBudget {
+		if vm.interuptPending {
+			ip := vm.ip
+			vm.serviceInterupts()
 
-	case instructions.Jump:
-		addr := vm.fetch16()
-		vm.ip = addr
+			if vm.stackErr != nil {
+				return vm.fault(ip, vm.stackErr)
+			}
+		}
 
-	case instructions.Jumpz:
-		addr := vm.fetch16()
-		if vm.a == 0 {
-			vm.ip = addr
-		} else {
-			vm.ip++
+		if vm.Waiting {
+			return nil
 		}
 
-	case instructions.Jumpnz:
-		addr := vm.fetch16()
-		if vm.a != 0 {
-			vm.ip = addr
-		} else {
-			vm.ip++
+		if vm.history != nil {
+			vm.beginStep(-1)
 		}
 
-	case instructions.Push:
-		mode := vm.fetch()
-		modeArg := vm.fetch()
+		ip := vm.ip
+		in := &vm.decoded[ip]
 
-		switch mode {
-		case instructions.Register:
-			vm.push(vm.getValueInRegister(modeArg))
-		case instructions.FramePointerWithOffset:
-			addr := vm.getFramePointerRelativeAddress(int8(modeArg))
-			vm.push(vm.memory[addr])
+		if in.width == 0 {
+			err := vm.decode(ip)
+			if err != nil {
+				return vm.fault(ip, err)
+			}
+		}
 
-		case instructions.Immediate:
-			vm.push(modeArg)
+		// reti is counted before it executes so that it's included in the cycles of the interupt
+		vm.cycles += uint64(in.cycles)
+		vm.instructionCount++
 
-		default:
-			log.Fatalf("push: encountered unknown mode 0x%02x\n", mode)
+		if vm.profile != nil {
+			vm.profile.Instructions[ip]++
+			vm.profile.Cycles[ip] += uint64(in.cycles)
 		}
 
-		vm.ip++
-
-	case instructions.Pop:
-		vm.a = vm.pop()
-		vm.ip++
+		if vm.coverage != nil {
+			vm.coverage.Executed[ip]++
+		}
 
-	case instructions.Call:
-		addr := vm.fetch16()
-		vm.call(addr)
+		if in.opcode == instructions.Halt {
+			vm.Halted = true
+			return nil
+		}
 
-	case instructions.Ret:
-		vm.ret()
-		vm.ip++
+		op := operations[in.opcode]
+		if op == nil {
+			return vm.fault(ip, fmt.Errorf("encountered unknown instruction 0x%02x", in.opcode))
+		}
 
-	case instructions.Reti:
-		vm.retFromInterupt()
+		err := op(vm, in)
+		if err == nil {
+			err = vm.stackErr
+		}
 
-	case instructions.Rand:
-		vm.a = uint8(rand.Intn(255))
-		vm.ip++
+		if err != nil {
+			return vm.fault(ip, err)
+		}
 
-	default:
-		log.Fatalf("encountered unknown instruction 0x%02x, name=%s", instruction, instructions.Names[instruction])
+		if vm.coverage != nil {
+			vm.coverage.recordBranch(ip, in, vm.ip)
+		}
 	}
 
+	return nil
 }
 
-func (vm *VM) Load(instructions []uint8) {
-	vm.init()
-	copy(vm.memory[:], instructions)
+// fault halts the VM and returns a fault for the instruction at ip
+func (vm *VM) fault(ip uint16, err error) error {
+	vm.Halted = true
+	return &Fault{IP: ip, Err: err, CallChain: vm.callChain()}
 }
 
-func (vm *VM) GetMemorySection(start uint16, n uint16) []byte {
-	return vm.memory[start : start+n]
-}
-
-func (vm *VM) GetMemory(addr uint16) uint8 {
-	return vm.memory[addr]
-}
-
-func (vm *VM) SetMemory(addr uint16, value uint8) {
-	vm.memory[addr] = value
-}
+// callChain follows the saved frame pointers from the current frame and returns the return address of each frame
+func (vm *VM) callChain() []uint16 {
+	chain := []uint16{}
+	fp := vm.fp
 
-func (vm *VM) PrintReg() {
-	fmt.Printf("a: 0x%02x | b: 0x%02x\n", vm.a, vm.b)
-}
+	// a frame is the saved ip followed by the saved fp, see saveState
+	for len(chain) < maxCallChain && uint32(fp)+4 <= uint32(vm.stackTop) {
+		chain = append(chain, vm.read16(fp+1))
 
-func (vm *VM) PrintMem(start uint16, n uint16) {
-	for i := start; i < start+n; i++ {
-		if vm.sp == i {
-			fmt.Printf("sp ->")
-		} else {
-			fmt.Print("     ")
+		prev := vm.read16(fp + 3)
+		if prev <= fp {
+			break
 		}
 
-		fmt.Printf("%04x: 0x%02x", i, vm.memory[i])
-
-		if vm.fp == i {
-			fmt.Printf("<- fp\n")
-		} else {
-			fmt.Print("\n")
-		}
-	}
-}
-
-func (vm *VM) Tick() {
-	if vm.memory[vm.ip] == instructions.Halt {
-		vm.Halted = true
-		return
+		fp = prev
 	}
 
-	vm.execute(vm.memory[vm.ip])
+	return chain
 }
 
 func boolToByte(v bool) byte {
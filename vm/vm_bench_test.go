@@ -0,0 +1,189 @@
+package vm_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/andrewesterhuizen/penpal/assembler"
+	"github.com/andrewesterhuizen/penpal/penpal"
+	"github.com/andrewesterhuizen/penpal/vm"
+)
+
+// assemble assembles a program with the penpal system includes and interupt labels
+func assemble(b *testing.B, filename string, source string) []byte {
+	systemIncludes, err := penpal.GetSystemIncludes()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	a := assembler.New(assembler.Config{
+		SystemIncludes: systemIncludes,
+		InteruptLabels: penpal.InteruptLabels,
+	})
+
+	program, err := a.GetProgram(filename, source)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return program
+}
+
+func assembleFile(b *testing.B, filename string) []byte {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return assemble(b, filename, string(source))
+}
+
+// newBenchmarkVM loads program into a VM with stub versions of the runtime's midi system calls
+func newBenchmarkVM(program []byte) *vm.VM {
+	v := vm.New()
+
+	v.RegisterSyscall(penpal.SyscallSendMidi, func(v *vm.VM) error {
+		v.Pop()
+		v.Pop()
+		v.Pop()
+		return nil
+	})
+
+	v.RegisterSyscall(penpal.SyscallScheduleNote, func(v *vm.VM) error {
+		v.Pop()
+		v.Pop()
+		v.Pop()
+		v.Pop()
+		return nil
+	})
+
+	v.Load(program)
+	return v
+}
+
+// runUntilWaiting runs the VM until it waits for the next interupt
+func runUntilWaiting(b *testing.B, v *vm.VM) {
+	for !v.Waiting {
+		_, err := v.Run(1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if v.Halted {
+			b.Fatal("program halted")
+		}
+	}
+}
+
+// BenchmarkVM_StepSeq measures a clock tick of cmd/stepseq.asm, from the tick interupt until the program waits again
+func BenchmarkVM_StepSeq(b *testing.B) {
+	v := newBenchmarkVM(assembleFile(b, "../cmd/stepseq.asm"))
+	runUntilWaiting(b, v)
+
+	start := v.Instructions()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		v.Interupt(penpal.InteruptTick)
+		runUntilWaiting(b, v)
+	}
+
+	b.ReportMetric(float64(v.Instructions()-start)/float64(b.N), "instructions/op")
+}
+
+// runInstructions executes n instructions and raises the tick interupt every interuptEvery instructions if it isn't 0
+func runInstructions(b *testing.B, v *vm.VM, n int, interuptEvery int) {
+	for n > 0 {
+		budget := n
+		if interuptEvery > 0 && interuptEvery < budget {
+			budget = interuptEvery
+			v.Interupt(penpal.InteruptTick)
+		}
+
+		executed, err := v.Run(budget)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if v.Halted {
+			b.Fatal("program halted")
+		}
+
+		n -= executed
+	}
+}
+
+// benchmarkThroughput measures the time taken per instruction for a program that never halts
+func benchmarkThroughput(b *testing.B, source string, interuptEvery int) {
+	v := newBenchmarkVM(assemble(b, "bench.asm", source))
+
+	b.ResetTimer()
+	runInstructions(b, v, b.N, interuptEvery)
+	b.StopTimer()
+
+	b.ReportMetric(float64(v.Cycles())/float64(v.Instructions()), "cycles/instruction")
+}
+
+// BenchmarkVM_Arithmetic measures a tight loop of register arithmetic and conditional jumps
+func BenchmarkVM_Arithmetic(b *testing.B) {
+	benchmarkThroughput(b, `
+start:
+	mov A, 0
+loop:
+	mov B, 3
+	add
+	mov B, 2
+	mul
+	swap
+	mov A, 0x0f
+	and
+	mov B, 1
+	shl
+	jumpnz loop
+	jump start
+`, 0)
+}
+
+// BenchmarkVM_Recursion measures call and ret through a subroutine that calls itself 16 levels deep
+func BenchmarkVM_Recursion(b *testing.B) {
+	benchmarkThroughput(b, `
+start:
+	push 16
+	push 1
+	call count_down
+	jump start
+
+count_down:
+	load (fp+7), A
+	jumpz count_down_end
+	mov B, 1
+	sub
+	push
+	push 1
+	call count_down
+count_down_end:
+	ret
+`, 0)
+}
+
+// BenchmarkVM_Interupts measures a busy loop that is interupted every 16 instructions by a handler
+// that updates a counter in memory
+func BenchmarkVM_Interupts(b *testing.B) {
+	benchmarkThroughput(b, `
+count: db 0
+
+start:
+	mov A, 0
+loop:
+	mov B, 1
+	add
+	jump loop
+
+on_tick:
+	load count, A
+	mov B, 1
+	add
+	store A, count
+	reti
+`, 16)
+}
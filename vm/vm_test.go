@@ -1,164 +1,1203 @@
 package vm
 
-// import (
-// 	"fmt"
-// 	"testing"
-// )
+import (
+	"errors"
+	"testing"
 
-// func TestVM_pushpop(t *testing.T) {
-// 	vm := New()
+	"github.com/andrewesterhuizen/penpal/instructions"
+)
 
-// 	value := byte(0xab)
+func TestVM_pushpop(t *testing.T) {
+	vm := New()
 
-// 	vm.push(value)
+	value := byte(0xab)
 
-// 	poppedValue := vm.pop()
+	vm.push(value)
 
-// 	if value != poppedValue {
-// 		t.Errorf("expected popped value to be %04x, got %04x", value, poppedValue)
-// 	}
-// }
+	poppedValue := vm.pop()
 
-// func TestVM_push16pop16(t *testing.T) {
-// 	vm := New()
+	if value != poppedValue {
+		t.Errorf("expected popped value to be %04x, got %04x", value, poppedValue)
+	}
+}
 
-// 	value := uint16(0xabcd)
+func TestVM_push16pop16(t *testing.T) {
+	vm := New()
 
-// 	vm.push16(value)
+	value := uint16(0xabcd)
 
-// 	poppedValue := vm.pop16()
+	vm.push16(value)
 
-// 	if value != poppedValue {
-// 		t.Errorf("expected popped value to be %04x, got %04x", value, poppedValue)
-// 	}
-// }
+	poppedValue := vm.pop16()
 
-// func uint16hl(n uint16) (byte, byte) {
-// 	h := (n & 0xff00) >> 8
-// 	l := n & 0xff
+	if value != poppedValue {
+		t.Errorf("expected popped value to be %04x, got %04x", value, poppedValue)
+	}
+}
 
-// 	return byte(h), byte(l)
-// }
+func uint16hl(n uint16) (byte, byte) {
+	h := (n & 0xff00) >> 8
+	l := n & 0xff
 
-// func TestVM_StateSaveRestore(t *testing.T) {
-// 	vm := New()
+	return byte(h), byte(l)
+}
 
-// 	initialSP := uint16(0xffff - 1)
-// 	initialBRegister := byte(0x56)
-// 	initialFP := uint16(0x1234)
-// 	initialIP := uint16(0xabcd)
+func TestVM_StateSaveRestore(t *testing.T) {
+	vm := New()
 
-// 	// set VM state
-// 	vm.b = initialBRegister
-// 	vm.ip = initialIP
-// 	vm.sp = initialSP
-// 	vm.fp = initialFP
+	initialSP := uint16(0xffff - 1)
+	initialBRegister := byte(0x56)
+	initialFP := uint16(0x1234)
+	initialIP := uint16(0xabcd)
 
-// 	// save state to stack
-// 	vm.saveState(false)
+	// set VM state
+	vm.b = initialBRegister
+	vm.ip = initialIP
+	vm.sp = initialSP
+	vm.fp = initialFP
 
-// 	iph, ipl := uint16hl(initialIP)
-// 	fph, fpl := uint16hl(initialFP)
+	// save state to stack
+	vm.saveState(false)
 
-// 	// assert values are saved on stack
-// 	if vm.memory[initialSP] != vm.b {
-// 		t.Errorf("VM did not save B register")
-// 	}
+	iph, ipl := uint16hl(initialIP)
+	fph, fpl := uint16hl(initialFP)
 
-// 	if vm.memory[initialSP-1] != fpl {
-// 		t.Errorf("VM did not save fp low byte")
-// 	}
+	// assert values are saved on stack
+	if vm.memory[initialSP] != vm.b {
+		t.Errorf("VM did not save B register")
+	}
 
-// 	if vm.memory[initialSP-2] != fph {
-// 		t.Errorf("VM did not save fp high byte")
-// 	}
+	if vm.memory[initialSP-1] != fpl {
+		t.Errorf("VM did not save fp low byte")
+	}
 
-// 	if vm.memory[initialSP-3] != ipl {
-// 		t.Errorf("VM did not save ip low byte")
-// 	}
+	if vm.memory[initialSP-2] != fph {
+		t.Errorf("VM did not save fp high byte")
+	}
 
-// 	if vm.memory[initialSP-4] != iph {
-// 		t.Errorf("VM did not save ip high byte")
-// 	}
+	if vm.memory[initialSP-3] != ipl {
+		t.Errorf("VM did not save ip low byte")
+	}
 
-// 	// restore state from stack
-// 	vm.restoreState(false)
+	if vm.memory[initialSP-4] != iph {
+		t.Errorf("VM did not save ip high byte")
+	}
 
-// 	// assert state has been restored
-// 	if vm.b != initialBRegister {
-// 		t.Errorf("VM did not restore B register")
-// 	}
+	// restore state from stack
+	vm.restoreState(false)
 
-// 	if vm.ip != initialIP {
-// 		t.Errorf("expected ip to be 0x%04x and got 0x%04x", initialIP, vm.ip)
-// 	}
+	// assert state has been restored
+	if vm.b != initialBRegister {
+		t.Errorf("VM did not restore B register")
+	}
 
-// 	if vm.sp != initialSP {
-// 		t.Errorf("expected sp to be 0x%04x and got 0x%04x", initialSP, vm.sp)
-// 	}
-// }
+	if vm.ip != initialIP {
+		t.Errorf("expected ip to be 0x%04x and got 0x%04x", initialIP, vm.ip)
+	}
 
-// func TestVM_ret_RemovesArgsFromStack(t *testing.T) {
-// 	vm := New()
+	if vm.sp != initialSP {
+		t.Errorf("expected sp to be 0x%04x and got 0x%04x", initialSP, vm.sp)
+	}
+}
 
-// 	initialStackPointer := vm.sp
+func TestVM_ret_RemovesArgsFromStack(t *testing.T) {
+	vm := New()
 
-// 	arg := byte(0xbb)
+	initialStackPointer := vm.sp
 
-// 	vm.push(arg) // push arg
-// 	vm.push(arg) // push arg
-// 	vm.push(arg) // push arg
-// 	vm.push(3)   // number of args
+	arg := byte(0xbb)
 
-// 	// save state to stack
-// 	vm.saveState(false)
+	vm.push(arg) // push arg
+	vm.push(arg) // push arg
+	vm.push(arg) // push arg
+	vm.push(3)   // number of args
 
-// 	// restore state and remove args from stack
-// 	vm.ret()
+	// save state to stack
+	vm.saveState(false)
 
-// 	if vm.sp != initialStackPointer {
-// 		t.Errorf("VM did not restore stack pointer")
-// 	}
-// }
+	// restore state and remove args from stack
+	vm.ret()
 
-// func TestVM_ret_RemovesArgsFromStackNested(t *testing.T) {
-// 	vm := New()
+	if vm.sp != initialStackPointer {
+		t.Errorf("VM did not restore stack pointer")
+	}
+}
 
-// 	initialStackPointer := vm.sp
+func TestVM_ret_RemovesArgsFromStackNested(t *testing.T) {
+	vm := New()
 
-// 	// sub 1
-// 	fmt.Println("sub 1")
+	initialStackPointer := vm.sp
 
-// 	vm.ip = 0xabcd
-// 	vm.b = 0xbb
+	// sub 1
+	vm.ip = 0xabcd
+	vm.b = 0xbb
 
-// 	// push args and number of args
-// 	vm.push(0x12)
-// 	vm.push(1)
+	// push args and number of args
+	vm.push(0x12)
+	vm.push(1)
 
-// 	// save state to stack
-// 	vm.saveState(false)
+	// save state to stack
+	vm.saveState(false)
 
-// 	// sub 2
-// 	fmt.Println("sub 2")
+	// sub 2
+	vm.ip = 0xef56
+	vm.b = 0xcc
 
-// 	vm.ip = 0xef56
-// 	vm.b = 0xcc
+	// push args and number of args
+	vm.push(0x34)
+	vm.push(1)
 
-// 	// push args and number of args
-// 	vm.push(0x34)
-// 	vm.push(1)
+	// save state to stack
+	vm.saveState(false)
 
-// 	// save state to stack
-// 	vm.saveState(false)
+	// restore state from sub 2
+	vm.ret()
 
-// 	// restore state from sub 1
-// 	vm.ret()
+	// restore state from sub 1
+	vm.ret()
 
-// 	// restore state from sub 2
-// 	vm.ret()
+	if vm.sp != initialStackPointer {
+		t.Errorf("expected sp to be 0x%04x and got 0x%04x", initialStackPointer, vm.sp)
+	}
+}
 
-// 	if vm.sp != initialStackPointer {
-// 		t.Errorf("expected sp to be 0x%04x and got 0x%04x", initialStackPointer, vm.sp)
-// 	}
-// }
+func TestVM_RunCycles_CountsInstructionCycles(t *testing.T) {
+	vm := New()
+
+	vm.Load([]byte{
+		instructions.Mul,
+		instructions.Add,
+		instructions.Mul,
+		instructions.Halt,
+	})
+
+	used, err := vm.RunCycles(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mul and add use exactly the budget of 5 cycles, so the second mul isn't started
+	if used != 5 {
+		t.Errorf("expected 5 cycles to be used, got %d", used)
+	}
+
+	if vm.Instructions() != 2 {
+		t.Errorf("expected 2 instructions to be executed, got %d", vm.Instructions())
+	}
+
+	used, err = vm.RunCycles(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if used != uint64(instructions.Cycles[instructions.Mul]+instructions.Cycles[instructions.Halt]) {
+		t.Errorf("expected the remaining mul and halt to be executed, used %d cycles", used)
+	}
+
+	if vm.Cycles() != 10 {
+		t.Errorf("expected 10 cycles in total, got %d", vm.Cycles())
+	}
+}
+
+func TestVM_SelfModifyingStoreInvalidatesDecodedInstruction(t *testing.T) {
+	vm := New()
+
+	// 0x00: mov A, 0x01
+	// 0x03: mov B, 0x09
+	// 0x06: store B, 0x0002 (overwrites the operand of the first mov)
+	// 0x0c: jump 0x0000
+	vm.Load([]byte{
+		instructions.Mov, instructions.RegisterA, 0x01,
+		instructions.Mov, instructions.RegisterB, 0x09,
+		instructions.Store, instructions.RegisterB, instructions.Immediate, 0x00, 0x00, 0x02,
+		instructions.Jump, 0x00, 0x00,
+	})
+
+	_, err := vm.Run(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.a != 0x09 {
+		t.Errorf("expected mov to load the stored operand 0x09, got 0x%02x", vm.a)
+	}
+
+	vm.SetMemory(0x0002, 0x42)
+	vm.ip = 0
+
+	err = vm.Tick()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.a != 0x42 {
+		t.Errorf("expected mov to load the value set with SetMemory 0x42, got 0x%02x", vm.a)
+	}
+}
+
+func TestVM_InstructionPastEndOfMemoryFaults(t *testing.T) {
+	vm := New()
+	vm.Load([]byte{instructions.Jump, 0xff, 0xfe})
+	vm.memory[0xfffe] = instructions.Jump
+
+	var fault *Fault
+
+	_, err := vm.Run(2)
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected fault, got %v", err)
+	}
+
+	if fault.IP != 0xfffe {
+		t.Errorf("expected fault at 0xfffe, got 0x%04x", fault.IP)
+	}
+
+	if !vm.Halted {
+		t.Error("expected VM to halt after fault")
+	}
+}
+
+// runawayRecursion pushes an argument count and calls itself until the stack overflows
+var runawayRecursion = []byte{
+	instructions.Push, instructions.Immediate, 0x00,
+	instructions.Call, 0x00, 0x00,
+}
+
+func TestVM_StackOverflow_FaultsWithCallChain(t *testing.T) {
+	vm := New()
+
+	err := vm.SetStack(DefaultStackTop, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.Load(runawayRecursion)
+
+	_, err = vm.Run(1000)
+
+	var fault *Fault
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected fault, got %v", err)
+	}
+
+	if !errors.Is(err, ErrStackOverflow) {
+		t.Errorf("expected stack overflow, got %v", fault.Err)
+	}
+
+	// each level pushes the argument count and a 5 byte frame
+	if len(fault.CallChain) != 5 {
+		t.Errorf("expected 5 frames in the call chain, got %d", len(fault.CallChain))
+	}
+
+	for _, addr := range fault.CallChain {
+		if addr != 0x0006 {
+			t.Errorf("expected return address 0x0006, got 0x%04x", addr)
+		}
+	}
+
+	// sp points at the next free byte, which is one below the region when the stack is full
+	if vm.sp < DefaultStackTop-32 {
+		t.Errorf("stack pointer 0x%04x is below the stack region", vm.sp)
+	}
+}
+
+func TestVM_StackOverflow_DefaultStackStopsAtProgram(t *testing.T) {
+	vm := New()
+	vm.Load(runawayRecursion)
+
+	_, err := vm.Run(100000)
+	if !errors.Is(err, ErrStackOverflow) {
+		t.Fatalf("expected stack overflow, got %v", err)
+	}
+
+	for i, b := range runawayRecursion {
+		if vm.memory[i] != b {
+			t.Errorf("program was overwritten at 0x%04x", i)
+		}
+	}
+}
+
+func TestVM_StackUnderflow_Faults(t *testing.T) {
+	vm := New()
+	vm.Load([]byte{instructions.Pop})
+
+	err := vm.Tick()
+
+	var fault *Fault
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected fault, got %v", err)
+	}
+
+	if !errors.Is(err, ErrStackUnderflow) {
+		t.Errorf("expected stack underflow, got %v", fault.Err)
+	}
+
+	if fault.IP != 0 {
+		t.Errorf("expected fault at 0x0000, got 0x%04x", fault.IP)
+	}
+}
+
+func TestVM_SetStack_ReturnsErrorIfStackDoesNotFit(t *testing.T) {
+	vm := New()
+
+	if err := vm.SetStack(0x000f, 32); err == nil {
+		t.Error("expected error for stack that does not fit below its top")
+	}
+
+	if err := vm.SetStack(0xffff, 16); err == nil {
+		t.Error("expected error for stack top outside of memory")
+	}
+}
+
+// storeToCode stores A over the halt at the end of the program
+var storeToCode = []byte{
+	instructions.Mov, instructions.RegisterA, instructions.Swap,
+	instructions.Store, instructions.RegisterA, instructions.Immediate, 0x00, 0x00, 0x09,
+	instructions.Halt,
+}
+
+func newProtectedVM(t *testing.T, protection Protection) *VM {
+	vm := New()
+	vm.Load(storeToCode)
+
+	err := vm.SetRegions([]Region{{Kind: RegionCode, Start: 0, End: uint16(len(storeToCode))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.SetProtection(protection)
+	return vm
+}
+
+func TestVM_Protection_FaultsOnWriteToCode(t *testing.T) {
+	vm := newProtectedVM(t, ProtectionFault)
+
+	_, err := vm.Run(10)
+
+	var fault *Fault
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected fault, got %v", err)
+	}
+
+	if !errors.Is(err, ErrWriteProtected) {
+		t.Errorf("expected write protected error, got %v", fault.Err)
+	}
+
+	if fault.IP != 0x0003 {
+		t.Errorf("expected fault at 0x0003, got 0x%04x", fault.IP)
+	}
+
+	if vm.memory[0x0009] != instructions.Halt {
+		t.Error("expected protected memory to be unchanged")
+	}
+}
+
+func TestVM_Protection_LogsWriteToCode(t *testing.T) {
+	vm := newProtectedVM(t, ProtectionLog)
+
+	violations := []ProtectionViolation{}
+	vm.OnProtectionViolation(func(v ProtectionViolation) {
+		violations = append(violations, v)
+	})
+
+	_, err := vm.Run(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ProtectionViolation{IP: 0x0003, Addr: 0x0009, Value: instructions.Swap, Kind: RegionCode}
+	if len(violations) != 1 || violations[0] != expected {
+		t.Errorf("expected violation %v, got %v", expected, violations)
+	}
+
+	// the write is allowed so the halt is replaced with a swap
+	if vm.memory[0x0009] != instructions.Swap {
+		t.Error("expected write to be allowed")
+	}
+}
+
+func TestVM_Protection_OffAllowsSelfModifyingCode(t *testing.T) {
+	vm := newProtectedVM(t, ProtectionOff)
+
+	_, err := vm.Run(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.Halted {
+		t.Error("expected the halt to have been replaced")
+	}
+}
+
+func TestVM_Protection_Store16ChecksBothBytes(t *testing.T) {
+	vm := New()
+
+	// 0x00: store16 0x0007, the low byte of the word is stored to the code at 0x0008
+	// 0x05: halt
+	// 0x06: data
+	vm.Load([]byte{
+		instructions.Store16, 0x00, 0x07, instructions.Immediate, 0x00,
+		instructions.Halt,
+		0x00, 0x00,
+		instructions.Halt,
+	})
+
+	err := vm.SetRegions([]Region{{Kind: RegionCode, Start: 0, End: 6}, {Kind: RegionCode, Start: 8, End: 9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.SetProtection(ProtectionFault)
+	vm.a, vm.b = 0x12, 0x34
+
+	err = vm.Tick()
+	if !errors.Is(err, ErrWriteProtected) {
+		t.Fatalf("expected write protected error, got %v", err)
+	}
+
+	if vm.memory[0x07] != 0x00 || vm.memory[0x08] != instructions.Halt {
+		t.Error("expected neither byte of the word to be stored")
+	}
+}
+
+func TestVM_SetRegions_ReturnsErrorIfEndIsBeforeStart(t *testing.T) {
+	vm := New()
+
+	err := vm.SetRegions([]Region{{Kind: RegionCode, Start: 0x10, End: 0x08}})
+	if err == nil {
+		t.Error("expected error for region that ends before it starts")
+	}
+}
+
+func TestVM_Protection_PointerUpdateFaultsBeforeStore(t *testing.T) {
+	vm := New()
+
+	// 0x00: store A, ((0x0007)+), the pointer is in rodata so it can't be incremented
+	// 0x06: halt
+	// 0x07: pointer to 0x0100
+	vm.Load([]byte{
+		instructions.Store, instructions.RegisterA, instructions.PointerPostIncrement, 0x00, 0x00, 0x07,
+		instructions.Halt,
+		0x01, 0x00,
+	})
+
+	err := vm.SetRegions([]Region{{Kind: RegionCode, Start: 0, End: 7}, {Kind: RegionROData, Start: 7, End: 9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.SetProtection(ProtectionFault)
+	vm.a = 0x12
+
+	err = vm.Tick()
+	if !errors.Is(err, ErrWriteProtected) {
+		t.Fatalf("expected write protected error, got %v", err)
+	}
+
+	if vm.memory[0x0100] != 0x00 || vm.memory[0x08] != 0x00 {
+		t.Error("expected neither the value or the pointer to be stored")
+	}
+}
+
+func TestVM_RegionAt(t *testing.T) {
+	vm := newProtectedVM(t, ProtectionOff)
+
+	if vm.RegionAt(0x0000) != RegionCode {
+		t.Errorf("expected code at 0x0000, got %s", vm.RegionAt(0x0000))
+	}
+
+	if vm.RegionAt(0x1000) != RegionStack {
+		t.Errorf("expected stack at 0x1000, got %s", vm.RegionAt(0x1000))
+	}
+
+	vm.SetStack(DefaultStackTop, 0x100)
+
+	if vm.RegionAt(0x1000) != RegionData {
+		t.Errorf("expected data at 0x1000, got %s", vm.RegionAt(0x1000))
+	}
+}
+
+// watchProgram loads 0x20 into A, then stores 0x05 and 0x05 again to 0x20
+var watchProgram = []byte{
+	instructions.Load, 0x00, 0x20, instructions.Immediate, 0x00, instructions.RegisterA,
+	instructions.Mov, instructions.RegisterB, 0x05,
+	instructions.Store, instructions.RegisterB, instructions.Immediate, 0x00, 0x00, 0x20,
+	instructions.Store, instructions.RegisterB, instructions.Immediate, 0x00, 0x00, 0x20,
+	instructions.Halt,
+}
+
+func runWatched(t *testing.T, kind WatchKind) []WatchHit {
+	vm := New()
+	vm.Load(watchProgram)
+	vm.SetMemory(0x20, 0x01)
+
+	hits := []WatchHit{}
+	vm.Watch(0x20, 0x21, kind, func(hit WatchHit) {
+		hits = append(hits, hit)
+	})
+
+	_, err := vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hits
+}
+
+func expectHits(t *testing.T, expected []WatchHit, hits []WatchHit) {
+	if len(hits) != len(expected) {
+		t.Fatalf("expected %d hits and got %d: %v", len(expected), len(hits), hits)
+	}
+
+	for i, hit := range expected {
+		if hits[i] != hit {
+			t.Errorf("expected hit %v and got %v", hit, hits[i])
+		}
+	}
+}
+
+func TestVM_Watch_Read(t *testing.T) {
+	expectHits(t, []WatchHit{
+		{IP: 0x00, Addr: 0x20, Kind: WatchRead, Old: 0x01, New: 0x01},
+	}, runWatched(t, WatchRead))
+}
+
+func TestVM_Watch_Write(t *testing.T) {
+	expectHits(t, []WatchHit{
+		{IP: 0x09, Addr: 0x20, Kind: WatchWrite, Old: 0x01, New: 0x05},
+		{IP: 0x0f, Addr: 0x20, Kind: WatchWrite, Old: 0x05, New: 0x05},
+	}, runWatched(t, WatchWrite))
+}
+
+func TestVM_Watch_Change(t *testing.T) {
+	// the second store writes the same value so it isn't a change
+	expectHits(t, []WatchHit{
+		{IP: 0x09, Addr: 0x20, Kind: WatchChange, Old: 0x01, New: 0x05},
+	}, runWatched(t, WatchChange))
+}
+
+func TestVM_Watch_Push(t *testing.T) {
+	vm := New()
+
+	// 0x00: push 0x12
+	// 0x03: call 0x0007
+	// 0x06: halt
+	// 0x07: halt
+	vm.Load([]byte{
+		instructions.Push, instructions.Immediate, 0x12,
+		instructions.Call, 0x00, 0x07,
+		instructions.Halt,
+		instructions.Halt,
+	})
+
+	hits := []WatchHit{}
+	record := func(hit WatchHit) {
+		hits = append(hits, hit)
+	}
+
+	// the pushed argument and the low byte of the return address in the frame pushed by call
+	vm.Watch(DefaultStackTop, DefaultStackTop+1, WatchWrite, record)
+	vm.Watch(DefaultStackTop-4, DefaultStackTop-3, WatchWrite, record)
+
+	_, err := vm.Run(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectHits(t, []WatchHit{
+		{IP: 0x00, Addr: DefaultStackTop, Kind: WatchWrite, Old: 0x00, New: 0x12},
+		{IP: 0x06, Addr: DefaultStackTop - 4, Kind: WatchWrite, Old: 0x00, New: 0x06},
+	}, hits)
+}
+
+func TestVM_Unwatch(t *testing.T) {
+	vm := New()
+	vm.Load(watchProgram)
+
+	hits := 0
+	id := vm.Watch(0x20, 0x21, WatchRead|WatchWrite, func(hit WatchHit) {
+		hits++
+	})
+
+	vm.Unwatch(id)
+
+	_, err := vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hits != 0 {
+		t.Errorf("expected no hits after unwatch and got %d", hits)
+	}
+}
+
+func TestVM_StepBack_UndoesRegistersAndMemory(t *testing.T) {
+	vm := New()
+	vm.Load(watchProgram)
+	vm.SetMemory(0x20, 0x01)
+	vm.Record(16)
+
+	_, err := vm.Run(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.memory[0x20] != 0x05 || vm.Recorded() != 3 {
+		t.Fatalf("expected the store to write 0x05 after 3 recorded steps, got 0x%02x after %d", vm.memory[0x20], vm.Recorded())
+	}
+
+	if !vm.StepBack() {
+		t.Fatal("expected the store to be undone")
+	}
+
+	if vm.memory[0x20] != 0x01 || vm.ip != 0x09 || vm.Instructions() != 2 {
+		t.Errorf("expected 0x01 at 0x20 and ip 0x09 after 2 instructions, got 0x%02x, ip 0x%04x after %d",
+			vm.memory[0x20], vm.ip, vm.Instructions())
+	}
+
+	vm.StepBack()
+	vm.StepBack()
+
+	if vm.ip != 0 || vm.a != 0 || vm.b != 0 || vm.Cycles() != 0 {
+		t.Errorf("expected the initial state, got ip 0x%04x A 0x%02x B 0x%02x after %d cycles", vm.ip, vm.a, vm.b, vm.Cycles())
+	}
+
+	if vm.StepBack() {
+		t.Error("expected nothing to undo before recording started")
+	}
+}
+
+func TestVM_StepBack_UndoesPopIntoRegister(t *testing.T) {
+	vm := New()
+	vm.Load([]byte{
+		instructions.Push, instructions.Immediate, 0x12,
+		instructions.PopRegister, instructions.RegisterX,
+		instructions.Halt,
+	})
+	vm.Record(16)
+
+	_, err := vm.Run(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.x != 0x12 {
+		t.Fatalf("expected X to be 0x12, got 0x%02x", vm.x)
+	}
+
+	vm.StepBack()
+
+	if vm.x != 0 || vm.sp != DefaultStackTop-1 {
+		t.Errorf("expected X to be 0 with 0x12 on the stack, got X 0x%02x and sp 0x%04x", vm.x, vm.sp)
+	}
+}
+
+func TestVM_StepBack_UndoesHalt(t *testing.T) {
+	vm := New()
+	vm.Load(watchProgram)
+	vm.Record(16)
+
+	_, err := vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.StepBack()
+
+	if vm.Halted || vm.ip != 0x15 {
+		t.Errorf("expected the VM to be running at the halt at 0x0015, got halted %v at 0x%04x", vm.Halted, vm.ip)
+	}
+}
+
+func TestVM_StepBack_InvalidatesDecodedInstruction(t *testing.T) {
+	vm := New()
+
+	// the store overwrites the operand of the first mov, which has already been decoded
+	vm.Load([]byte{
+		instructions.Mov, instructions.RegisterA, 0x01,
+		instructions.Mov, instructions.RegisterB, 0x09,
+		instructions.Store, instructions.RegisterB, instructions.Immediate, 0x00, 0x00, 0x02,
+		instructions.Jump, 0x00, 0x00,
+	})
+	vm.Record(16)
+
+	_, err := vm.Run(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.RunBackToWrite(0x0002)
+	vm.ip = 0
+
+	err = vm.Tick()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.a != 0x01 {
+		t.Errorf("expected mov to load the restored operand 0x01, got 0x%02x", vm.a)
+	}
+}
+
+func TestVM_RunBackToWrite(t *testing.T) {
+	vm := New()
+	vm.Load(watchProgram)
+	vm.Record(16)
+
+	_, err := vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !vm.RunBackToWrite(0x20) {
+		t.Fatal("expected to find the write to 0x20")
+	}
+
+	// the last write was the second store
+	if vm.ip != 0x0f || vm.memory[0x20] != 0x05 {
+		t.Errorf("expected ip 0x000f with 0x05 at 0x20, got ip 0x%04x with 0x%02x", vm.ip, vm.memory[0x20])
+	}
+
+	if vm.RunBackToWrite(0x30) {
+		t.Error("expected no write to 0x30")
+	}
+
+	if vm.ip != 0x0f {
+		t.Errorf("expected the VM to be unchanged, got ip 0x%04x", vm.ip)
+	}
+}
+
+func TestVM_Record_DropsOldestSteps(t *testing.T) {
+	vm := New()
+	vm.Load(watchProgram)
+	vm.Record(2)
+
+	_, err := vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.Recorded() != 2 {
+		t.Fatalf("expected 2 recorded steps, got %d", vm.Recorded())
+	}
+
+	vm.StepBack()
+	vm.StepBack()
+
+	if vm.ip != 0x0f || vm.StepBack() {
+		t.Errorf("expected to stop at the second store at 0x000f, got 0x%04x", vm.ip)
+	}
+}
+
+func TestVM_RewindToInterupt(t *testing.T) {
+	vm := New()
+
+	// 0x00: jump 0x000c
+	// 0x03: jump 0x0010 (interupt 0)
+	// 0x0c: wait, jump 0x000c
+	// 0x10: mov A, 0x07, reti
+	vm.Load([]byte{
+		instructions.Jump, 0x00, 0x0c,
+		instructions.Jump, 0x00, 0x10,
+		0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00,
+		instructions.Wait,
+		instructions.Jump, 0x00, 0x0c,
+		instructions.Mov, instructions.RegisterA, 0x07,
+		instructions.Reti,
+	})
+	vm.Record(16)
+
+	_, err := vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.Interupt(0)
+
+	_, err = vm.Run(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.a != 0x07 {
+		t.Fatalf("expected the handler to set A, got 0x%02x", vm.a)
+	}
+
+	if !vm.RewindToInterupt(0) {
+		t.Fatal("expected to find the entry to interupt 0")
+	}
+
+	if vm.ip != 0x03 || vm.a != 0 || !vm.inInterupt {
+		t.Errorf("expected to be in the interupt at 0x0003 with A 0x00, got 0x%04x with A 0x%02x", vm.ip, vm.a)
+	}
+
+	vm.StepBack()
+
+	if vm.inInterupt || !vm.pendingInterupts[0] {
+		t.Error("expected the interupt to be pending after undoing its entry")
+	}
+
+	if vm.RewindToInterupt(1) {
+		t.Error("expected no entry to interupt 1")
+	}
+}
+
+func TestVM_Profile_CountsInstructionsAndCyclesByAddress(t *testing.T) {
+	vm := New()
+
+	vm.Load([]byte{
+		instructions.Mul,
+		instructions.Add,
+		instructions.Jump, 0x00, 0x01,
+	})
+
+	p := vm.StartProfile()
+
+	_, err := vm.Run(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.StopProfile()
+
+	_, err = vm.Run(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[uint16]uint64{0x00: 1, 0x01: 2, 0x02: 2}
+
+	for addr, n := range expected {
+		if p.Instructions[addr] != n {
+			t.Errorf("expected %d instructions at 0x%04x, got %d", n, addr, p.Instructions[addr])
+		}
+	}
+
+	if cycles := 2 * uint64(instructions.Cycles[instructions.Jump]); p.Cycles[0x02] != cycles {
+		t.Errorf("expected %d cycles at 0x0002, got %d", cycles, p.Cycles[0x02])
+	}
+}
+
+func TestVM_Coverage_RecordsExecutedAddressesAndBranches(t *testing.T) {
+	vm := New()
+
+	vm.Load([]byte{
+		instructions.Mov, instructions.RegisterA, 0x00,
+		instructions.Jumpz, 0x00, 0x07,
+		instructions.Halt,
+		instructions.Mov, instructions.RegisterA, 0x01,
+		instructions.Jumpz, 0x00, 0x00,
+		instructions.Halt,
+	})
+
+	c := vm.StartCoverage()
+
+	_, err := vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []uint16{0x00, 0x03, 0x07, 0x0a, 0x0d} {
+		if c.Executed[addr] != 1 {
+			t.Errorf("expected 0x%04x to be executed once, got %d", addr, c.Executed[addr])
+		}
+	}
+
+	if c.Executed[0x06] != 0 {
+		t.Error("expected the halt skipped by the first jump not to be executed")
+	}
+
+	if c.Taken[0x03] != 1 || c.NotTaken[0x03] != 0 {
+		t.Errorf("expected the first jump to be taken, got %d taken and %d not taken", c.Taken[0x03], c.NotTaken[0x03])
+	}
+
+	if c.Taken[0x0a] != 0 || c.NotTaken[0x0a] != 1 {
+		t.Errorf("expected the second jump not to be taken, got %d taken and %d not taken", c.Taken[0x0a], c.NotTaken[0x0a])
+	}
+}
+
+func TestVM_Call_RunsSubroutineUntilItReturns(t *testing.T) {
+	vm := New()
+
+	// 0x00: halt
+	// 0x01: mov A, 0x07, ret
+	// 0x05: jump 0x0005
+	vm.Load([]byte{
+		instructions.Halt,
+		instructions.Mov, instructions.RegisterA, 0x07,
+		instructions.Ret,
+		instructions.Jump, 0x00, 0x05,
+	})
+
+	sp := vm.sp
+
+	err := vm.Call(0x01, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.a != 0x07 || vm.ip != 0x00 || vm.sp != sp {
+		t.Errorf("expected to return to 0x0000 with A 0x07, got A 0x%02x at 0x%04x with sp 0x%04x", vm.a, vm.ip, vm.sp)
+	}
+
+	err = vm.Call(0x05, 100)
+	if !errors.Is(err, ErrNoReturn) {
+		t.Errorf("expected the loop not to return, got %v", err)
+	}
+}
+
+func TestVM_CallRet_FrameLayout(t *testing.T) {
+	vm := New()
+
+	// 0x00: mov B, 0x22
+	// 0x03: push 0x11, push 0x12 (args in reverse), push 2 (number of args)
+	// 0x0c: call 0x0010
+	// 0x0f: halt
+	// 0x10: load (fp+7), A (first arg), mov B, 0x33, ret
+	vm.Load([]byte{
+		instructions.Mov, instructions.RegisterB, 0x22,
+		instructions.Push, instructions.Immediate, 0x11,
+		instructions.Push, instructions.Immediate, 0x12,
+		instructions.Push, instructions.Immediate, 0x02,
+		instructions.Call, 0x00, 0x10,
+		instructions.Halt,
+		instructions.Load, 0x00, 0x00, instructions.FramePointerWithOffset, 0x07, instructions.RegisterA,
+		instructions.Mov, instructions.RegisterB, 0x33,
+		instructions.Ret,
+	})
+
+	_, err := vm.Run(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.ip != 0x10 || vm.fp != vm.sp {
+		t.Fatalf("expected to be at 0x0010 with fp at sp, got 0x%04x with fp 0x%04x and sp 0x%04x", vm.ip, vm.fp, vm.sp)
+	}
+
+	if addr := vm.read16(vm.fp + 1); addr != 0x000f {
+		t.Errorf("expected the return address 0x000f at fp+1, got 0x%04x", addr)
+	}
+
+	if fp := vm.read16(vm.fp + 3); fp != DefaultStackTop {
+		t.Errorf("expected the caller's fp 0x%04x at fp+3, got 0x%04x", uint16(DefaultStackTop), fp)
+	}
+
+	for offset, value := range map[uint16]uint8{5: 0x22, 6: 0x02, 7: 0x12, 8: 0x11} {
+		if vm.memory[vm.fp+offset] != value {
+			t.Errorf("expected 0x%02x at fp+%d, got 0x%02x", value, offset, vm.memory[vm.fp+offset])
+		}
+	}
+
+	_, err = vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !vm.Halted || vm.ip != 0x0f {
+		t.Errorf("expected to return to the halt at 0x000f, got 0x%04x", vm.ip)
+	}
+
+	if vm.a != 0x12 || vm.b != 0x22 {
+		t.Errorf("expected A to be the first arg 0x12 and B to be restored to 0x22, got A 0x%02x and B 0x%02x", vm.a, vm.b)
+	}
+
+	if vm.sp != DefaultStackTop || vm.fp != DefaultStackTop {
+		t.Errorf("expected the args and frame to be removed, got sp 0x%04x and fp 0x%04x", vm.sp, vm.fp)
+	}
+}
+
+func TestVM_CancelInterupt(t *testing.T) {
+	vm := New()
+
+	// 0x00: jump 0x000c
+	// 0x03: jump 0x0010 (interupt 0)
+	// 0x0c: wait, jump 0x000c
+	// 0x10: mov A, 0x07, reti
+	vm.Load([]byte{
+		instructions.Jump, 0x00, 0x0c,
+		instructions.Jump, 0x00, 0x10,
+		0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00,
+		instructions.Wait,
+		instructions.Jump, 0x00, 0x0c,
+		instructions.Mov, instructions.RegisterA, 0x07,
+		instructions.Reti,
+	})
+
+	_, err := vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.Interupt(0)
+	vm.CancelInterupt(0)
+
+	_, err = vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.a != 0 || vm.interuptPending {
+		t.Errorf("expected the cancelled interupt not to run, got A 0x%02x", vm.a)
+	}
+}
+
+func TestVM_Interupt_EntryAndExit(t *testing.T) {
+	vm := New()
+
+	// 0x00: jump 0x000c
+	// 0x03: jump 0x0010 (interupt 0)
+	// 0x0c: wait, jump 0x000c
+	// 0x10: mov A, 0x07, mov B, 0x08, mov X, 0x09, add, reti
+	vm.Load([]byte{
+		instructions.Jump, 0x00, 0x0c,
+		instructions.Jump, 0x00, 0x10,
+		0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00,
+		instructions.Wait,
+		instructions.Jump, 0x00, 0x0c,
+		instructions.Mov, instructions.RegisterA, 0x07,
+		instructions.Mov, instructions.RegisterB, 0x08,
+		instructions.Mov, instructions.RegisterX, 0x09,
+		instructions.Add,
+		instructions.Reti,
+	})
+
+	returns := []uint64{}
+	vm.OnInteruptReturn(func(n int, cycles uint64) {
+		if n != 0 {
+			t.Errorf("expected interupt 0 to return, got %d", n)
+		}
+
+		returns = append(returns, cycles)
+	})
+
+	vm.a, vm.b, vm.flags = 0x01, 0x02, FlagCarry
+	vm.c, vm.d, vm.x, vm.y = 0x03, 0x04, 0x05, 0x06
+
+	_, err := vm.Run(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !vm.Waiting || vm.ip != 0x0d {
+		t.Fatalf("expected to wait at 0x000d, got 0x%04x", vm.ip)
+	}
+
+	// interupt 1 has no handler so it is ignored
+	vm.Interupt(1)
+
+	if vm.interuptPending || !vm.Waiting {
+		t.Error("expected an interupt without a handler to be ignored")
+	}
+
+	vm.Interupt(0)
+
+	err = vm.Tick()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !vm.inInterupt || vm.ip != 0x10 {
+		t.Fatalf("expected to enter the handler at 0x0010, got 0x%04x", vm.ip)
+	}
+
+	// interupts save the flags and every register as well as the frame saved by call
+	if addr := vm.read16(vm.fp + 1); addr != 0x000d {
+		t.Errorf("expected the return address 0x000d at fp+1, got 0x%04x", addr)
+	}
+
+	for offset, value := range map[uint16]uint8{5: 0x02, 6: FlagCarry, 7: 0x01, 8: 0x03, 9: 0x04, 10: 0x05, 11: 0x06} {
+		if vm.memory[vm.fp+offset] != value {
+			t.Errorf("expected 0x%02x at fp+%d, got 0x%02x", value, offset, vm.memory[vm.fp+offset])
+		}
+	}
+
+	// an interupt raised during the handler is serviced once it returns
+	vm.Interupt(0)
+
+	_, err = vm.Run(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.inInterupt || vm.ip != 0x0d {
+		t.Fatalf("expected to return to 0x000d, got 0x%04x", vm.ip)
+	}
+
+	if vm.a != 0x01 || vm.b != 0x02 || vm.flags != FlagCarry || vm.sp != DefaultStackTop {
+		t.Errorf("expected A, B, flags and sp to be restored, got A 0x%02x, B 0x%02x, flags %s and sp 0x%04x",
+			vm.a, vm.b, formatFlags(vm.flags), vm.sp)
+	}
+
+	if vm.c != 0x03 || vm.d != 0x04 || vm.x != 0x05 || vm.y != 0x06 {
+		t.Errorf("expected C, D, X and Y to be restored, got 0x%02x, 0x%02x, 0x%02x and 0x%02x", vm.c, vm.d, vm.x, vm.y)
+	}
+
+	cycles := uint64(instructions.Cycles[instructions.Jump] + 3*instructions.Cycles[instructions.Mov] +
+		instructions.Cycles[instructions.Add] + instructions.Cycles[instructions.Reti])
+	if len(returns) != 1 || returns[0] != cycles {
+		t.Errorf("expected one return from the handler in %d cycles, got %v", cycles, returns)
+	}
+
+	err = vm.Tick()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !vm.inInterupt || vm.ip != 0x10 {
+		t.Errorf("expected the latched interupt to enter the handler, got 0x%04x", vm.ip)
+	}
+}
+
+func TestVM_AddWithCarry_AddsMultiByteValues(t *testing.T) {
+	vm := New()
+
+	// adds the 16 bit value at 0x0032 to the one at 0x0030 and jumps to the halt at 0x002a if the sum carries
+	//
+	// 0x00: load 0x0031, A, load 0x0033, B, add, store A, 0x0031
+	// 0x13: load 0x0030, A, load 0x0032, B, adc, store A, 0x0030
+	// 0x26: jc 0x002a, halt
+	// 0x2a: halt
+	program := []byte{
+		instructions.Load, 0x00, 0x31, instructions.Immediate, 0x00, instructions.RegisterA,
+		instructions.Load, 0x00, 0x33, instructions.Immediate, 0x00, instructions.RegisterB,
+		instructions.Add,
+		instructions.Store, instructions.RegisterA, instructions.Immediate, 0x00, 0x00, 0x31,
+		instructions.Load, 0x00, 0x30, instructions.Immediate, 0x00, instructions.RegisterA,
+		instructions.Load, 0x00, 0x32, instructions.Immediate, 0x00, instructions.RegisterB,
+		instructions.Adc,
+		instructions.Store, instructions.RegisterA, instructions.Immediate, 0x00, 0x00, 0x30,
+		instructions.Jc, 0x00, 0x2a,
+		instructions.Halt,
+		instructions.Halt,
+	}
+
+	for _, tc := range []struct {
+		a, b     uint16
+		expected uint16
+		carry    bool
+	}{
+		{0x01ff, 0x0001, 0x0200, false},
+		{0x1234, 0x4321, 0x5555, false},
+		{0xffff, 0x0002, 0x0001, true},
+	} {
+		vm.Load(program)
+		vm.memory[0x30], vm.memory[0x31] = uint16hl(tc.a)
+		vm.memory[0x32], vm.memory[0x33] = uint16hl(tc.b)
+
+		_, err := vm.Run(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sum := vm.read16(0x30); sum != tc.expected {
+			t.Errorf("expected 0x%04x + 0x%04x to be 0x%04x, got 0x%04x", tc.a, tc.b, tc.expected, sum)
+		}
+
+		if carried := vm.ip == 0x2a; carried != tc.carry {
+			t.Errorf("expected carry to be %v for 0x%04x + 0x%04x", tc.carry, tc.a, tc.b)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package vm
+
+import "fmt"
+
+// WatchKind is the kind of memory access a watchpoint reports, kinds can be combined
+type WatchKind uint8
+
+const (
+	// WatchRead reports loads from the watched range
+	WatchRead WatchKind = 1 << iota
+	// WatchWrite reports stores to the watched range
+	WatchWrite
+	// WatchChange reports stores that change the value in the watched range
+	WatchChange
+)
+
+func (k WatchKind) String() string {
+	switch k {
+	case WatchRead:
+		return "read"
+	case WatchWrite:
+		return "write"
+	case WatchChange:
+		return "change"
+	default:
+		return fmt.Sprintf("WatchKind(%d)", uint8(k))
+	}
+}
+
+// WatchHit is an access to a watched address. Old and New are the same for reads.
+type WatchHit struct {
+	IP   uint16
+	Addr uint16
+	Kind WatchKind
+	Old  uint8
+	New  uint8
+}
+
+// WatchHandler is called for each access that matches a watchpoint
+type WatchHandler func(hit WatchHit)
+
+type watchpoint struct {
+	id      int
+	start   uint16
+	end     uint16
+	kind    WatchKind
+	handler WatchHandler
+}
+
+// Watch calls h for the program's loads and stores of kind in the range start to end (exclusive)
+// and returns an id that can be passed to Unwatch. Watchpoints are kept when a program is loaded.
+// Pushes are reported as writes, the frames pushed by call are reported with the return address
+// as the IP and the frames pushed on interupt entry with the address of the interupted instruction.
+func (vm *VM) Watch(start uint16, end uint16, kind WatchKind, h WatchHandler) int {
+	id := vm.nextWatchID
+	vm.nextWatchID++
+
+	vm.watchpoints = append(vm.watchpoints, watchpoint{id: id, start: start, end: end, kind: kind, handler: h})
+	vm.updateWatched()
+
+	return id
+}
+
+// Unwatch removes the watchpoint with id
+func (vm *VM) Unwatch(id int) {
+	for i, w := range vm.watchpoints {
+		if w.id == id {
+			vm.watchpoints = append(vm.watchpoints[:i], vm.watchpoints[i+1:]...)
+			break
+		}
+	}
+
+	vm.updateWatched()
+}
+
+// updateWatched sets the bit for each watched address so that accesses to other addresses only cost a bit test
+func (vm *VM) updateWatched() {
+	vm.watched = [len(vm.watched)]uint64{}
+
+	for _, w := range vm.watchpoints {
+		for addr := uint32(w.start); addr < uint32(w.end); addr++ {
+			vm.watched[addr/64] |= 1 << (addr % 64)
+		}
+	}
+}
+
+func (vm *VM) isWatched(addr uint16) bool {
+	return vm.watched[addr/64]&(1<<(addr%64)) != 0
+}
+
+// watchRead reports a load from addr by the instruction at ip
+func (vm *VM) watchRead(ip uint16, addr uint16) {
+	value := vm.memory[addr]
+
+	for _, w := range vm.watchpoints {
+		if w.kind&WatchRead != 0 && addr >= w.start && addr < w.end {
+			w.handler(WatchHit{IP: ip, Addr: addr, Kind: WatchRead, Old: value, New: value})
+		}
+	}
+}
+
+// watchWrite reports a store of value to addr by the instruction at ip, it's called before the store
+func (vm *VM) watchWrite(ip uint16, addr uint16, value uint8) {
+	old := vm.memory[addr]
+
+	for _, w := range vm.watchpoints {
+		if addr < w.start || addr >= w.end {
+			continue
+		}
+
+		hit := WatchHit{IP: ip, Addr: addr, Old: old, New: value}
+
+		if w.kind&WatchWrite != 0 {
+			hit.Kind = WatchWrite
+			w.handler(hit)
+		} else if w.kind&WatchChange != 0 && old != value {
+			hit.Kind = WatchChange
+			w.handler(hit)
+		}
+	}
+}